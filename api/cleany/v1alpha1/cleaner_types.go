@@ -23,6 +23,37 @@ import (
 
 const (
 	CleanerFinalizer = "cleany.wys1203.com/cleaner-finalizer"
+
+	// CleanerLabel is set on each CleaningReport to the name of the
+	// Cleaner that generated it
+	CleanerLabel = "cleany.wys1203.com/cleaner"
+
+	// ProtectAnnotation, set to "true" on a resource, prevents Cleaners
+	// from deleting or transforming it
+	ProtectAnnotation = "cleany.wys1203.com/protect"
+
+	// ConditionLimitExceeded is True when the last run was aborted because
+	// it would have acted on more resources than the Cleaner Limits allow
+	ConditionLimitExceeded = "LimitExceeded"
+
+	// ConditionRunFailed is True when the last run failed, after all the
+	// attempts allowed by the Cleaner RetryPolicy
+	ConditionRunFailed = "RunFailed"
+
+	// ApprovedAnnotation, set to "true" on a pending CleaningReport,
+	// approves the action it lists
+	ApprovedAnnotation = "cleany.wys1203.com/approved"
+
+	// RestoreAnnotation on a CleaningReport re-creates the resources the
+	// run deleted: all of them when set to "*", else those named in a comma
+	// separated list of namespace/name, or name for cluster scoped resources.
+	// Unless the Cleaner has a ServiceAccount, only the resources in the
+	// namespace of the report are restored.
+	RestoreAnnotation = "cleany.wys1203.com/restore"
+
+	// ReportLabel is set on the Secrets holding the snapshots of the
+	// resources of a CleaningReport to the report name
+	ReportLabel = "cleany.wys1203.com/report"
 )
 
 // CleanerSpec defines the desired state of Cleaner
@@ -46,6 +77,165 @@ type CleanerSpec struct {
 
 	// Schedule in Cron format, see https://en.wikipedia.org/wiki/Cron.
 	Schedule string `json:"schedule"`
+
+	// Timeout bounds the duration of a run. Defaults to the run timeout
+	// configured for the operator.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// ReportsHistoryLimit is the number of CleaningReports of the Cleaner
+	// to keep. Older reports are deleted after each run. All reports are
+	// kept if unset.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ReportsHistoryLimit *int32 `json:"reportsHistoryLimit,omitempty"`
+
+	// ServiceAccountRef is the ServiceAccount impersonated to select
+	// resources and act on them, so its RBAC determines what the Cleaner
+	// can do. Actions it is not allowed are reported for each resource.
+	// If unset, the Cleaner has the permissions of the operator.
+	// +optional
+	ServiceAccountRef *ServiceAccountRef `json:"serviceAccountRef,omitempty"`
+
+	// DryRun sends the delete and update requests of the action as
+	// server-side dry runs: they go through admission and their outcome is
+	// reported for each resource, but nothing is persisted. Limits are not
+	// enforced on dry runs.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// ObjectEvents records an Event on each resource a run deletes or
+	// transforms, up to 50 per run, besides the Events on the Cleaner
+	// +optional
+	ObjectEvents bool `json:"objectEvents,omitempty"`
+
+	// Deletion orders the deletion of the selected resources. Whatever the
+	// order, resources whose owners are all deleted by the run are left to
+	// the garbage collector.
+	// +optional
+	Deletion *DeletionPolicy `json:"deletion,omitempty"`
+
+	// RetryPolicy retries failed runs, as well as the requests for a
+	// resource failing on a conflict or a transient error. Neither is
+	// retried if unset.
+	// +optional
+	RetryPolicy *RetryPolicy `json:"retryPolicy,omitempty"`
+
+	// RateLimit bounds the rate of the delete and update requests of a
+	// run, on top of the rate limit of the operator shared by all Cleaners
+	// +optional
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+
+	// Approval, when set, makes each scheduled run only list the resources
+	// it would act on in a pending CleaningReport. The action is taken once
+	// the report is approved with the cleany.wys1203.com/approved
+	// annotation, on the resources left unchanged since the report was
+	// created.
+	// +optional
+	Approval *Approval `json:"approval,omitempty"`
+
+	// Limits bound the number of resources a run can delete or transform.
+	// A run exceeding them takes no action at all and only reports the
+	// resources it would have acted on.
+	// +optional
+	Limits *Limits `json:"limits,omitempty"`
+
+	// LuaLibraries lists ConfigMaps, in the Cleaner namespace, whose data
+	// entries are lua modules that the evaluate, transform and
+	// aggregatedSelection functions can load with require("name").
+	// The module name is the entry key without its ".lua" suffix.
+	// +optional
+	LuaLibraries []LuaLibraryReference `json:"luaLibraries,omitempty"`
+}
+
+// ServiceAccountRef references a ServiceAccount
+type ServiceAccountRef struct {
+	// Namespace of the ServiceAccount. Defaults to the Cleaner namespace.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name of the ServiceAccount
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// DeletionPolicy orders the deletion of the resources of a run in stages
+type DeletionPolicy struct {
+	// KindOrder lists kinds, as Kind.group, whose resources are deleted in
+	// this order, a stage for each kind, before the resources of the other
+	// kinds. Namespaces are deleted last unless listed.
+	// +optional
+	KindOrder []string `json:"kindOrder,omitempty"`
+
+	// WaitForStages waits, within the run timeout, for the resources of a
+	// stage to be gone before deleting the next stage
+	// +optional
+	WaitForStages bool `json:"waitForStages,omitempty"`
+}
+
+// RetryPolicy configures the retries of a Cleaner
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a run is attempted, and a request
+	// for a resource sent, including the first time
+	// +kubebuilder:default:=3
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxAttempts int32 `json:"maxAttempts,omitempty"`
+
+	// Backoff is the delay before the second attempt of a failed run,
+	// doubled for each following attempt
+	// +kubebuilder:default:="10s"
+	// +optional
+	Backoff metav1.Duration `json:"backoff,omitempty"`
+
+	// MaxBackoff bounds the delay between two attempts of a run
+	// +kubebuilder:default:="5m"
+	// +optional
+	MaxBackoff metav1.Duration `json:"maxBackoff,omitempty"`
+}
+
+// RateLimit bounds the rate of the requests of a Cleaner
+type RateLimit struct {
+	// QPS is the sustained number of requests per second
+	// +kubebuilder:validation:Minimum=1
+	QPS int32 `json:"qps"`
+
+	// Burst is the number of requests that can be sent at once. Defaults
+	// to QPS.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Burst int32 `json:"burst,omitempty"`
+}
+
+// Approval configures the approval of the actions of a Cleaner
+type Approval struct {
+	// Expiry is how long a pending CleaningReport can be approved for
+	// +kubebuilder:default:="24h"
+	// +optional
+	Expiry metav1.Duration `json:"expiry,omitempty"`
+}
+
+// Limits bound the blast radius of a Cleaner run
+type Limits struct {
+	// MaxObjectsPerRun is the maximum number of resources deleted or
+	// transformed by a run
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxObjectsPerRun *int32 `json:"maxObjectsPerRun,omitempty"`
+
+	// MaxFractionOfSelected is the maximum fraction, between 0 and 1, of
+	// the resources listed by the resource selectors, before evaluation,
+	// that a run can delete or transform, e.g. "0.2"
+	// +kubebuilder:validation:Pattern=`^(0(\.[0-9]+)?|1(\.0+)?)$`
+	// +optional
+	MaxFractionOfSelected string `json:"maxFractionOfSelected,omitempty"`
+}
+
+// LuaLibraryReference references a ConfigMap holding lua modules
+type LuaLibraryReference struct {
+	// Name of the ConfigMap
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
 }
 
 // CleanerStatus defines the observed state of Cleaner
@@ -61,6 +251,99 @@ type CleanerStatus struct {
 	// FailureMessage provides more information about the error, if
 	// any occurred
 	FailureMessage *string `json:"failureMessage,omitempty"`
+
+	// LastRun contains the outcome of the most recent completed run
+	// +optional
+	LastRun *CleanerRun `json:"lastRun,omitempty"`
+
+	// RunHistory contains the most recent completed runs, most recent
+	// first, LastRun included
+	// +kubebuilder:validation:MaxItems=10
+	// +optional
+	RunHistory []CleanerRun `json:"runHistory,omitempty"`
+
+	// LuaLibraries records the version of each lua library the scripts
+	// were last validated against
+	// +optional
+	LuaLibraries []LuaLibraryStatus `json:"luaLibraries,omitempty"`
+
+	// Conditions describe the state of the Cleaner
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// LuaLibraryStatus identifies the content of a lua library
+type LuaLibraryStatus struct {
+	// Name of the ConfigMap
+	Name string `json:"name"`
+
+	// ResourceVersion of the ConfigMap
+	ResourceVersion string `json:"resourceVersion"`
+
+	// Hash is the SHA-256 of the modules of the library
+	Hash string `json:"hash"`
+}
+
+// CleanerRun records what a single run of a Cleaner did
+type CleanerRun struct {
+	// ID identifies the run, which its start time, kept to the second,
+	// does not
+	// +optional
+	ID string `json:"id,omitempty"`
+
+	// StartTime is when the run started
+	StartTime metav1.Time `json:"startTime"`
+
+	// EndTime is when the run completed
+	// +optional
+	EndTime *metav1.Time `json:"endTime,omitempty"`
+
+	// Action is the action taken on matching resources
+	Action Action `json:"action"`
+
+	// DryRun is set when the action was not persisted
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Result is the outcome of the run
+	Result RunResult `json:"result"`
+
+	// Attempts is the number of times the run was attempted, see
+	// RetryPolicy
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// MatchingResources is the number of resources selected by the run
+	MatchingResources int `json:"matchingResources"`
+
+	// DeletedResources is the number of resources deleted
+	DeletedResources int `json:"deletedResources"`
+
+	// TransformedResources is the number of resources updated
+	TransformedResources int `json:"transformedResources"`
+
+	// FailedResources is the number of resources the action failed on
+	FailedResources int `json:"failedResources"`
+
+	// SkippedResources is the number of protected resources left untouched
+	// +optional
+	SkippedResources int `json:"skippedResources,omitempty"`
+
+	// Message explains why the run took no action, when it exceeded the
+	// Cleaner limits or awaits approval
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Errors contains the errors hit during the run, if any
+	// +optional
+	Errors []string `json:"errors,omitempty"`
+
+	// ReportName is the name of the CleaningReport generated by the run,
+	// in the Cleaner namespace
+	// +optional
+	ReportName string `json:"reportName,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -101,14 +384,22 @@ type ResourceSelector struct {
 	// Group of the resource deployed in the Cluster.
 	Group string `json:"group"`
 
-	// Version of the resource deployed in the Cluster.
-	Version string `json:"version"`
+	// Version of the resource deployed in the Cluster. If empty, the
+	// preferred version served by the Cluster for Group and Kind is used.
+	// +optional
+	Version string `json:"version,omitempty"`
 
 	// Kind of the resource deployed in the Cluster.
 	// +kubebuilder:validation:MinLength=1
 	Kind string `json:"kind"`
 
 	// LabelFilters allows to filter resources based on current labels.
+	// Events selected by labels only, by a single selector of a Cleaner
+	// deleting right away (no dry run, approval, limits, deletion policy
+	// or aggregated selection), are deleted with a DeleteCollection
+	// request per namespace: the Events created or annotated as protected
+	// after the run listed them are deleted too. Resources of other kinds
+	// are always deleted one by one.
 	LabelFilters []libsveltosv1alpha1.LabelFilter `json:"labelFilters,omitempty"`
 
 	// Evaluate contains a function "evaluate" in lua language.
@@ -116,8 +407,27 @@ type ResourceSelector struct {
 	// above criteria.
 	// Must return struct with field "matching" representing whether
 	// object is a match and an optional "message" field.
+	// It can also return an "action" (Delete, Transform or Scan) overriding
+	// the Cleaner action for the object, a "severity" (Info, Low, Medium,
+	// High or Critical) and "details", a table of key/values, which are
+	// recorded in the CleaningReport.
+	// Helpers such as k8s.age(obj), k8s.condition(obj, "Ready") or
+	// k8s.parseQuantity("512Mi") are available in the global k8s table.
+	// Like transform, each call is bounded in time, and in the size of the
+	// strings and tables built by the helpers and of the value returned,
+	// by the limits of the operator. Strings built with .. and tables
+	// filled by assignment are only bounded in time.
 	// +optional
 	Evaluate string `json:"evaluate,omitempty"`
+
+	// EvaluateCEL is a CEL expression evaluating to true for the resources
+	// to select, with the resource available as "object", e.g.
+	// object.metadata.labels["app"] == "web".
+	// The expression is type checked against the schema of the kind when
+	// the cluster publishes it.
+	// When Evaluate is also set, resources must match both.
+	// +optional
+	EvaluateCEL string `json:"evaluateCEL,omitempty"`
 }
 
 type ResourcePolicySet struct {
@@ -134,7 +444,42 @@ type ResourcePolicySet struct {
 	// on the resources, looking at all resources together.
 	// This can be useful for more sophisticated tasks, such as identifying resources
 	// that are related to each other or that have similar properties.
+	// Must contain a function "evaluate" returning a struct with field
+	// "resources", an array of {resource = obj, message = "..."} for each
+	// resource to keep.
+	// +optional
 	AggregatedSelection string `json:"aggregatedSelection,omitempty"`
+
+	// AggregatedSelectionCEL is a CEL expression evaluating to the list of
+	// resources to keep, with the resources selected by ResourceSelectors
+	// available as "resources", e.g.
+	// resources.filter(r, r.metadata.namespace != "kube-system").
+	// When AggregatedSelection is also set, it is passed the resources
+	// kept by this expression.
+	// +optional
+	AggregatedSelectionCEL string `json:"aggregatedSelectionCEL,omitempty"`
+
+	// AllowLookups gives the evaluate and aggregatedSelection functions
+	// read-only access to the cluster through
+	// k8s.get(group, version, kind, namespace, name) and
+	// k8s.list(group, version, kind, namespace, labelSelector).
+	// Results are cached for the duration of a run and the number of
+	// calls per run is capped by the operator configuration.
+	// +optional
+	AllowLookups bool `json:"allowLookups,omitempty"`
+
+	// ExcludedNamespaces lists namespaces whose resources are never
+	// selected, unless a resource selector names the namespace in its
+	// Namespace field.
+	// +optional
+	ExcludedNamespaces []string `json:"excludedNamespaces,omitempty"`
+
+	// ExcludeSystemNamespaces excludes the namespaces of the Kubernetes
+	// components, kube-system, kube-public and kube-node-lease, along with
+	// ExcludedNamespaces, without listing them there. Defaults to true: set
+	// it to false to select resources in those namespaces from the next run.
+	// +optional
+	ExcludeSystemNamespaces *bool `json:"excludeSystemNamespaces,omitempty"`
 }
 
 // Action specifies the action to take on matching resources
@@ -151,3 +496,24 @@ const (
 	// ActionScan will identify matching objects. No action is taken on those.
 	ActionScan = Action("Scan")
 )
+
+// RunResult is the outcome of a Cleaner run
+// +kubebuilder:validation:Enum:=Succeeded;Failed;LimitExceeded;PendingApproval
+type RunResult string
+
+const (
+	// RunResultSucceeded indicates the run completed without errors
+	RunResultSucceeded = RunResult("Succeeded")
+
+	// RunResultFailed indicates the run, or the action on at least one
+	// resource, failed
+	RunResultFailed = RunResult("Failed")
+
+	// RunResultLimitExceeded indicates the run took no action as it
+	// exceeded the Cleaner Limits
+	RunResultLimitExceeded = RunResult("LimitExceeded")
+
+	// RunResultPendingApproval indicates the run took no action and
+	// created a CleaningReport awaiting approval
+	RunResultPendingApproval = RunResult("PendingApproval")
+)
@@ -31,18 +31,125 @@ type CleaningReportSpec struct {
 
 	// Action indicates the action to take on selected object.
 	Action Action `json:"action"`
+
+	// Snapshots is where the full resources are stored: Inline, in the
+	// FullResource of each ResourceInfo, or Secrets, labeled with the
+	// report name and keyed by the index of the ResourceInfo, when they are
+	// too large for the report. The full resources of Secrets are always
+	// stored in Secrets, the others stay inline when they fit in the
+	// report. Defaults to Inline.
+	// +optional
+	Snapshots SnapshotStore `json:"snapshots,omitempty"`
+
+	// StoredResources is the number of resources listed after those of
+	// ResourceInfo, in the Secrets of the report, keyed by their index
+	// followed by ".resource", when there are too many for the report. The
+	// snapshots are then stored in the Secrets too.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	StoredResources int `json:"storedResources,omitempty"`
+
+	// DryRun is set when the action was only taken as a server-side dry run
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Message explains why the action of the Cleaner was not taken, when
+	// the run only reports the resources it selected
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // CleaningReportStatus defines the observed state of CleaningReport
 type CleaningReportStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of a report listing the action of a Cleaner requiring
+	// approval, unset for other reports
+	// +optional
+	Phase ApprovalPhase `json:"phase,omitempty"`
+
+	// ExpirationTime is when a pending report can no longer be approved
+	// +optional
+	ExpirationTime *metav1.Time `json:"expirationTime,omitempty"`
+
+	// Digest is the SHA-256 of the action, resources and snapshots listed
+	// by the report, recorded by the run. The action of a pending report is
+	// only taken once approved, and resources are only restored, if they
+	// still match it.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// InProgress is set while the run acts on the resources listed, which
+	// are recorded along with their snapshots before the first one is acted
+	// on. The report is updated with the outcome once the run is done.
+	// +optional
+	InProgress bool `json:"inProgress,omitempty"`
+
+	// ExecutionReport is the name of the CleaningReport of the action
+	// taken once the report was approved
+	// +optional
+	ExecutionReport string `json:"executionReport,omitempty"`
+
+	// Message provides more information about the phase
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Restore is the outcome of the last restore of the resources deleted
+	// by the run
+	// +optional
+	Restore *RestoreStatus `json:"restore,omitempty"`
+}
+
+// RestoreStatus is the outcome of a restore
+type RestoreStatus struct {
+	// Selection is the value of the restore annotation processed
+	Selection string `json:"selection"`
+
+	// Time is when the resources were restored
+	Time metav1.Time `json:"time"`
+
+	// RestoredResources is the number of resources re-created
+	RestoredResources int `json:"restoredResources"`
+
+	// Errors lists the resources that could not be restored, and why
+	// +optional
+	Errors []string `json:"errors,omitempty"`
 }
 
+// SnapshotStore is where the full resources of a CleaningReport are stored
+// +kubebuilder:validation:Enum:=Inline;Secrets
+type SnapshotStore string
+
+const (
+	SnapshotStoreInline  = SnapshotStore("Inline")
+	SnapshotStoreSecrets = SnapshotStore("Secrets")
+)
+
+// ApprovalPhase is the state of a CleaningReport requiring approval
+// +kubebuilder:validation:Enum:=Pending;Approved;Executed;Expired;Failed
+type ApprovalPhase string
+
+const (
+	// ApprovalPhasePending indicates the report awaits approval
+	ApprovalPhasePending = ApprovalPhase("Pending")
+
+	// ApprovalPhaseApproved indicates the action of the report is queued
+	ApprovalPhaseApproved = ApprovalPhase("Approved")
+
+	// ApprovalPhaseExecuted indicates the action of the report was taken
+	ApprovalPhaseExecuted = ApprovalPhase("Executed")
+
+	// ApprovalPhaseExpired indicates the report was not approved in time
+	ApprovalPhaseExpired = ApprovalPhase("Expired")
+
+	// ApprovalPhaseFailed indicates the action of the report could not
+	// be taken
+	ApprovalPhaseFailed = ApprovalPhase("Failed")
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
 // CleaningReport is the Schema for the cleaningreports API
+// +kubebuilder:validation:XValidation:rule="self.spec == oldSelf.spec || (has(oldSelf.status) && has(oldSelf.status.inProgress) && oldSelf.status.inProgress)",message="spec is immutable once the run is done"
 type CleaningReport struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -69,11 +176,47 @@ type ResourceInfo struct {
 	Resource corev1.ObjectReference `json:"resource,omitempty"`
 
 	// FullResource contains full resources before
-	// before Cleaner took an action on it
+	// before Cleaner took an action on it, unless the report stores
+	// snapshots in Secrets
 	// +optional
 	FullResource []byte `json:"fullResource,omitempty"`
 
 	// Message is an optional field.
 	// +optional
 	Message string `json:"message,omitempty"`
+
+	// Action is the action taken on the resource, when the evaluate
+	// function overrides the Cleaner action
+	// +optional
+	Action Action `json:"action,omitempty"`
+
+	// Severity is set by the evaluate function to rank the resource
+	// +optional
+	Severity Severity `json:"severity,omitempty"`
+
+	// Details are arbitrary key/values set by the evaluate function
+	// +optional
+	Details map[string]string `json:"details,omitempty"`
+
+	// Diff is the JSON patch the transform would apply to the resource,
+	// on a dry run
+	// +optional
+	Diff string `json:"diff,omitempty"`
+
+	// SkipReason is why the action was not taken on the resource, when
+	// it is protected
+	// +optional
+	SkipReason string `json:"skipReason,omitempty"`
 }
+
+// Severity ranks a resource reported by a Cleaner
+// +kubebuilder:validation:Enum:=Info;Low;Medium;High;Critical
+type Severity string
+
+const (
+	SeverityInfo     = Severity("Info")
+	SeverityLow      = Severity("Low")
+	SeverityMedium   = Severity("Medium")
+	SeverityHigh     = Severity("High")
+	SeverityCritical = Severity("Critical")
+)
@@ -0,0 +1,87 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NamespacedCleanerLabel is set on each CleaningReport to the name of
+	// the NamespacedCleaner that generated it
+	NamespacedCleanerLabel = "cleany.wys1203.com/namespaced-cleaner"
+)
+
+// NamespacedCleanerSpec defines the desired state of NamespacedCleaner
+type NamespacedCleanerSpec struct {
+	// CleanerSpec is the same as for a Cleaner, except that resource
+	// selectors can only select namespaced resources in the
+	// NamespacedCleaner namespace: their Namespace, if set, must be this
+	// namespace and NamespaceSelector cannot be set. ServiceAccountRef
+	// cannot be set either, ServiceAccountName is used instead.
+	CleanerSpec `json:",inline"`
+
+	// ServiceAccountName is the name of the ServiceAccount, in the
+	// NamespacedCleaner namespace, impersonated to select resources and
+	// act on them, so its RBAC determines what the NamespacedCleaner can do.
+	// +kubebuilder:validation:MinLength=1
+	ServiceAccountName string `json:"serviceAccountName"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// NamespacedCleaner is the Schema for the namespacedcleaners API.
+// Unlike a Cleaner, it is confined to its own namespace, so it can be
+// owned by the team owning the namespace.
+type NamespacedCleaner struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NamespacedCleanerSpec `json:"spec,omitempty"`
+	Status CleanerStatus         `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NamespacedCleanerList contains a list of NamespacedCleaner
+type NamespacedCleanerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespacedCleaner `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespacedCleaner{}, &NamespacedCleanerList{})
+}
+
+// AsCleaner returns a Cleaner with the name, spec and status of c, whose
+// resource selectors select resources in the namespace of c only and which
+// impersonates the ServiceAccount of c.
+func (c *NamespacedCleaner) AsCleaner() *Cleaner {
+	cleaner := &Cleaner{
+		ObjectMeta: *c.ObjectMeta.DeepCopy(),
+		Spec:       *c.Spec.CleanerSpec.DeepCopy(),
+		Status:     *c.Status.DeepCopy(),
+	}
+	cleaner.Spec.ServiceAccountRef = &ServiceAccountRef{Namespace: c.Namespace, Name: c.Spec.ServiceAccountName}
+	for i := range cleaner.Spec.ResourcePolicySet.ResourceSelectors {
+		cleaner.Spec.ResourcePolicySet.ResourceSelectors[i].Namespace = c.Namespace
+		cleaner.Spec.ResourcePolicySet.ResourceSelectors[i].NamespaceSelector = ""
+	}
+	return cleaner
+}
@@ -20,15 +20,18 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
+	"slices"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -36,8 +39,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
 	cleanycontroller "github.com/wys1203/Cleany/internal/controller/cleany"
 	"github.com/wys1203/Cleany/internal/manager"
+	webhookcleanyv1alpha1 "github.com/wys1203/Cleany/internal/webhook/cleany/v1alpha1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -60,6 +65,8 @@ func main() {
 	var secureMetrics bool
 	var enableHTTP2 bool
 	var tlsOpts []func(*tls.Config)
+	var configFile string
+	cleanyConfig := config.New()
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -70,6 +77,11 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&configFile, "config", "",
+		"Path to a YAML file with cleaner manager settings, keyed by flag name. "+
+			"Settings can also be set through CLEANY_<FLAG_NAME> environment variables; "+
+			"command line flags take precedence over the environment, which takes precedence over the file.")
+	cleanyConfig.BindFlags(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
@@ -78,6 +90,16 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if err := cleanyConfig.Load(flag.CommandLine, configFile); err != nil {
+		setupLog.Error(err, "unable to load configuration")
+		os.Exit(1)
+	}
+	// cleaners must never remove the operator itself
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" &&
+		!slices.Contains(cleanyConfig.ProtectedNamespaces, namespace) {
+		cleanyConfig.ProtectedNamespaces = append(cleanyConfig.ProtectedNamespaces, namespace)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -128,6 +150,11 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "c7c411f6.wys1203.com",
+		// ConfigMaps are only read as lua libraries: rather than caching
+		// every ConfigMap of the cluster, they are read from the API server
+		Client: client.Options{
+			Cache: &client.CacheOptions{DisableFor: []client.Object{&corev1.ConfigMap{}}},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -145,15 +172,55 @@ func main() {
 		os.Exit(1)
 	}
 
+	// CleanerManager needs leader election, so cleaners only run on the leader.
+	cleanerManager := manager.NewCleanerManager(mgr, cleanyConfig)
+	if err = mgr.Add(cleanerManager); err != nil {
+		setupLog.Error(err, "unable to set up cleaner manager")
+		os.Exit(1)
+	}
+
 	if err = (&cleanycontroller.CleanerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		CleanerManager: cleanerManager,
+		Recorder:       mgr.GetEventRecorderFor("cleaner-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Cleaner")
 		os.Exit(1)
 	}
-
-	mgr = manager.NewCleanerManager(mgr, 5)
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookcleanyv1alpha1.SetupCleanerWebhookWithManager(mgr, cleanyConfig); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Cleaner")
+			os.Exit(1)
+		}
+	}
+	if err = (&cleanycontroller.NamespacedCleanerReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		CleanerManager: cleanerManager,
+		Recorder:       mgr.GetEventRecorderFor("namespacedcleaner-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "NamespacedCleaner")
+		os.Exit(1)
+	}
+	if err = (&cleanycontroller.CleaningReportReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		Config:         mgr.GetConfig(),
+		APIReader:      mgr.GetAPIReader(),
+		CleanerManager: cleanerManager,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CleaningReport")
+		os.Exit(1)
+	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookcleanyv1alpha1.SetupNamespacedCleanerWebhookWithManager(mgr, cleanyConfig); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "NamespacedCleaner")
+			os.Exit(1)
+		}
+	}
 
 	// +kubebuilder:scaffold:builder
 
@@ -0,0 +1,400 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// envPrefix is prepended to the upper-cased flag name to get the
+	// environment variable for a setting, e.g. CLEANY_WORKER_COUNT.
+	envPrefix = "CLEANY_"
+
+	defaultWorkerCount     = 5
+	defaultQueueSize       = 2000
+	defaultRunTimeout      = 1 * time.Minute
+	defaultListConcurrency = 1
+
+	defaultLuaCallTimeout   = 1 * time.Second
+	defaultLuaMaxStackSize  = 256 * 1024
+	defaultLuaMaxCallDepth  = 200
+	defaultLuaMaxStringSize = 1024 * 1024
+	defaultLuaMaxTableSize  = 100 * 1024
+	defaultLuaMaxResultSize = 4 * 1024 * 1024
+	defaultLuaMaxLookups    = 100
+
+	defaultSnapshotInlineLimit = 256 * 1024
+
+	defaultActionQPS   = 20
+	defaultActionBurst = 30
+)
+
+var (
+	// defaultProtectedNamespaces are the namespaces of the control plane
+	defaultProtectedNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+	// defaultProtectedKinds are the kinds whose removal would take down
+	// APIs of the cluster
+	defaultProtectedKinds = []string{
+		"CustomResourceDefinition.apiextensions.k8s.io",
+		"APIService.apiregistration.k8s.io",
+	}
+)
+
+// Config contains the settings used to size the operator.
+// Values are taken, in increasing order of precedence, from the defaults,
+// the config file, the environment and the command line flags.
+type Config struct {
+	// WorkerCount is the number of workers running cleaners concurrently
+	WorkerCount int
+
+	// QueueSize is the capacity of the queue of cleaners waiting for a worker
+	QueueSize int
+
+	// RunTimeout is the maximum duration of a single cleaner run
+	RunTimeout time.Duration
+
+	// ListConcurrency is the number of namespaces listed concurrently
+	// for each resource selector, unless ListConcurrencyPerResource sets
+	// it for the selected resource
+	ListConcurrency int
+
+	// ListConcurrencyPerResource is the number of namespaces listed
+	// concurrently for the resources named, as resource.group, e.g.
+	// deployments.apps, for the resources whose lists are large or cheap
+	ListConcurrencyPerResource map[string]int
+
+	// LuaCallTimeout is the maximum duration of a single call to a lua
+	// function (evaluate, transform)
+	LuaCallTimeout time.Duration
+
+	// LuaMaxStackSize is the maximum number of values on a lua stack
+	LuaMaxStackSize int
+
+	// LuaMaxCallDepth is the maximum depth of nested lua function calls
+	LuaMaxCallDepth int
+
+	// LuaMaxStringSize is the maximum size of a string built by string.rep,
+	// table.concat and the k8s helpers, and of a document they decode
+	LuaMaxStringSize int
+
+	// LuaMaxTableSize is the maximum number of values in a table built by
+	// the k8s helpers or grown by table.insert
+	LuaMaxTableSize int
+
+	// LuaMaxResultSize is the maximum size of the value returned by a call
+	// to a lua function
+	LuaMaxResultSize int
+
+	// LuaMaxLookups is the maximum number of API calls made by k8s.get and
+	// k8s.list during a single cleaner run
+	LuaMaxLookups int
+
+	// SnapshotInlineLimit is the size of the snapshots of the resources of
+	// a run above which they are stored in Secrets rather than in the
+	// CleaningReport
+	SnapshotInlineLimit int
+
+	// ActionQPS is the number of delete and update requests per second
+	// sent by all cleaners together, 0 for no limit
+	ActionQPS float64
+
+	// ActionBurst is the number of delete and update requests that can be
+	// sent at once by all cleaners together
+	ActionBurst int
+
+	// ProtectedNamespaces are the namespaces in which no resource is ever
+	// deleted or transformed, nor are the namespaces themselves
+	ProtectedNamespaces []string
+
+	// ProtectedKinds are the kinds, as Kind.group, never deleted or
+	// transformed
+	ProtectedKinds []string
+}
+
+// New returns a Config with default values.
+func New() *Config {
+	return &Config{
+		WorkerCount:     defaultWorkerCount,
+		QueueSize:       defaultQueueSize,
+		RunTimeout:      defaultRunTimeout,
+		ListConcurrency: defaultListConcurrency,
+
+		LuaCallTimeout:   defaultLuaCallTimeout,
+		LuaMaxStackSize:  defaultLuaMaxStackSize,
+		LuaMaxCallDepth:  defaultLuaMaxCallDepth,
+		LuaMaxStringSize: defaultLuaMaxStringSize,
+		LuaMaxTableSize:  defaultLuaMaxTableSize,
+		LuaMaxResultSize: defaultLuaMaxResultSize,
+		LuaMaxLookups:    defaultLuaMaxLookups,
+
+		SnapshotInlineLimit: defaultSnapshotInlineLimit,
+
+		ActionQPS:   defaultActionQPS,
+		ActionBurst: defaultActionBurst,
+
+		ProtectedNamespaces: slices.Clone(defaultProtectedNamespaces),
+		ProtectedKinds:      slices.Clone(defaultProtectedKinds),
+	}
+}
+
+// BindFlags registers the flags for all settings on fs.
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.WorkerCount, "worker-count", c.WorkerCount,
+		"The number of cleaners run concurrently.")
+	fs.IntVar(&c.QueueSize, "queue-size", c.QueueSize,
+		"The number of cleaners that can wait for a free worker.")
+	fs.DurationVar(&c.RunTimeout, "run-timeout", c.RunTimeout,
+		"The maximum duration of a single cleaner run.")
+	fs.IntVar(&c.ListConcurrency, "list-concurrency", c.ListConcurrency,
+		"The number of namespaces listed concurrently for each resource selector.")
+	fs.Var((*intMap)(&c.ListConcurrencyPerResource), "list-concurrency-per-resource",
+		"Comma separated resource.group=count pairs overriding list-concurrency for the resources named, e.g. pods=10,deployments.apps=4.")
+	fs.DurationVar(&c.LuaCallTimeout, "lua-call-timeout", c.LuaCallTimeout,
+		"The maximum duration of a single call to a lua function.")
+	fs.IntVar(&c.LuaMaxStackSize, "lua-max-stack-size", c.LuaMaxStackSize,
+		"The maximum number of values on the stack of a lua script.")
+	fs.IntVar(&c.LuaMaxCallDepth, "lua-max-call-depth", c.LuaMaxCallDepth,
+		"The maximum depth of nested lua function calls.")
+	fs.IntVar(&c.LuaMaxStringSize, "lua-max-string-size", c.LuaMaxStringSize,
+		"The maximum size in bytes of a string built by string.rep, table.concat and the k8s helpers in a lua script.")
+	fs.IntVar(&c.LuaMaxTableSize, "lua-max-table-size", c.LuaMaxTableSize,
+		"The maximum number of values in a table built by the k8s helpers or table.insert in a lua script.")
+	fs.IntVar(&c.LuaMaxResultSize, "lua-max-result-size", c.LuaMaxResultSize,
+		"The maximum size in bytes of the value returned by a call to a lua function.")
+	fs.IntVar(&c.LuaMaxLookups, "lua-max-lookups", c.LuaMaxLookups,
+		"The maximum number of API calls made by k8s.get and k8s.list in lua scripts during a cleaner run.")
+	fs.IntVar(&c.SnapshotInlineLimit, "snapshot-inline-limit", c.SnapshotInlineLimit,
+		"The size in bytes of the resources of a run above which they are stored in Secrets instead of the report.")
+	fs.Float64Var(&c.ActionQPS, "action-qps", c.ActionQPS,
+		"The number of delete and update requests per second sent by all cleaners together, 0 for no limit.")
+	fs.IntVar(&c.ActionBurst, "action-burst", c.ActionBurst,
+		"The number of delete and update requests that can be sent at once by all cleaners together.")
+	fs.Var((*stringList)(&c.ProtectedNamespaces), "protected-namespaces",
+		"Comma separated namespaces in which cleaners never delete nor transform resources.")
+	fs.Var((*stringList)(&c.ProtectedKinds), "protected-kinds",
+		"Comma separated kinds, as Kind.group, that cleaners never delete nor transform.")
+}
+
+// Load completes the settings bound to fs with the values found in the
+// config file at path (if any) and in the environment. Flags explicitly set
+// on the command line are left untouched. Must be called after fs is parsed.
+func (c *Config) Load(fs *flag.FlagSet, path string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	set := func(name, value, source string) error {
+		if explicit[name] {
+			return nil
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s from %s: %w", value, name, source, err)
+		}
+		return nil
+	}
+
+	settings := settingNames()
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			if !settings[name] {
+				return fmt.Errorf("unknown setting %q in %s", name, path)
+			}
+			if err := set(name, value, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name := range settings {
+		env := envName(name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := set(name, value, env); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.Validate()
+}
+
+// Validate verifies all settings have acceptable values.
+func (c *Config) Validate() error {
+	if c.WorkerCount < 1 {
+		return fmt.Errorf("worker-count must be at least 1, got %d", c.WorkerCount)
+	}
+	if c.QueueSize < 1 {
+		return fmt.Errorf("queue-size must be at least 1, got %d", c.QueueSize)
+	}
+	if c.RunTimeout <= 0 {
+		return fmt.Errorf("run-timeout must be positive, got %s", c.RunTimeout)
+	}
+	if c.ListConcurrency < 1 {
+		return fmt.Errorf("list-concurrency must be at least 1, got %d", c.ListConcurrency)
+	}
+	for resource, concurrency := range c.ListConcurrencyPerResource {
+		if resource == "" || strings.HasPrefix(resource, ".") {
+			return fmt.Errorf("list-concurrency-per-resource must name resources as resource.group, got %q", resource)
+		}
+		if concurrency < 1 {
+			return fmt.Errorf("list-concurrency-per-resource must be at least 1, got %d for %s", concurrency, resource)
+		}
+	}
+	if c.LuaCallTimeout <= 0 {
+		return fmt.Errorf("lua-call-timeout must be positive, got %s", c.LuaCallTimeout)
+	}
+	if c.LuaMaxStackSize < 1024 {
+		return fmt.Errorf("lua-max-stack-size must be at least 1024, got %d", c.LuaMaxStackSize)
+	}
+	if c.LuaMaxCallDepth < 1 {
+		return fmt.Errorf("lua-max-call-depth must be at least 1, got %d", c.LuaMaxCallDepth)
+	}
+	if c.LuaMaxStringSize < 1 {
+		return fmt.Errorf("lua-max-string-size must be at least 1, got %d", c.LuaMaxStringSize)
+	}
+	if c.LuaMaxTableSize < 1 {
+		return fmt.Errorf("lua-max-table-size must be at least 1, got %d", c.LuaMaxTableSize)
+	}
+	if c.LuaMaxResultSize < 1 {
+		return fmt.Errorf("lua-max-result-size must be at least 1, got %d", c.LuaMaxResultSize)
+	}
+	if c.LuaMaxLookups < 0 {
+		return fmt.Errorf("lua-max-lookups must not be negative, got %d", c.LuaMaxLookups)
+	}
+	if c.SnapshotInlineLimit < 0 {
+		return fmt.Errorf("snapshot-inline-limit must not be negative, got %d", c.SnapshotInlineLimit)
+	}
+	if c.ActionQPS < 0 {
+		return fmt.Errorf("action-qps must not be negative, got %g", c.ActionQPS)
+	}
+	if c.ActionBurst < 1 {
+		return fmt.Errorf("action-burst must be at least 1, got %d", c.ActionBurst)
+	}
+	for _, kind := range c.ProtectedKinds {
+		if strings.HasPrefix(kind, ".") {
+			return fmt.Errorf("protected-kinds must be Kind.group, got %q", kind)
+		}
+	}
+	return nil
+}
+
+// settingNames returns the names of the flags bound by BindFlags.
+func settingNames() map[string]bool {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	New().BindFlags(fs)
+	names := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
+}
+
+// readFile reads a YAML file mapping flag names to values, e.g.
+//
+//	worker-count: 10
+//	run-timeout: 5m
+//	protected-namespaces: [kube-system, cleany-system]
+//	list-concurrency-per-resource: {pods: 10, deployments.apps: 4}
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if list, ok := value.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i := range list {
+				items[i] = fmt.Sprint(list[i])
+			}
+			values[name] = strings.Join(items, ",")
+			continue
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			items := make([]string, 0, len(m))
+			for key, item := range m {
+				items = append(items, fmt.Sprintf("%s=%v", key, item))
+			}
+			slices.Sort(items)
+			values[name] = strings.Join(items, ",")
+			continue
+		}
+		if f, ok := value.(float64); ok {
+			// avoid exponent notation for large integers
+			values[name] = strconv.FormatFloat(f, 'f', -1, 64)
+			continue
+		}
+		values[name] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+// stringList is a flag.Value holding a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// intMap is a flag.Value holding comma separated key=value pairs with
+// integer values.
+type intMap map[string]int
+
+func (m *intMap) String() string {
+	items := make([]string, 0, len(*m))
+	for key, value := range *m {
+		items = append(items, key+"="+strconv.Itoa(value))
+	}
+	slices.Sort(items)
+	return strings.Join(items, ",")
+}
+
+func (m *intMap) Set(value string) error {
+	*m = make(map[string]int)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, count, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		(*m)[strings.TrimSpace(key)] = n
+	}
+	return nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		expected func(c *Config)
+		err      string
+	}{
+		{
+			name:     "defaults",
+			expected: func(c *Config) {},
+		},
+		{
+			name: "file over defaults",
+			file: "worker-count: 10\nrun-timeout: 5m\n",
+			expected: func(c *Config) {
+				c.WorkerCount = 10
+				c.RunTimeout = 5 * time.Minute
+			},
+		},
+		{
+			name: "env over file",
+			file: "worker-count: 10\nqueue-size: 100\n",
+			env:  map[string]string{"CLEANY_WORKER_COUNT": "20"},
+			expected: func(c *Config) {
+				c.WorkerCount = 20
+				c.QueueSize = 100
+			},
+		},
+		{
+			name: "flags over env and file",
+			file: "worker-count: 10\nqueue-size: 100\n",
+			env:  map[string]string{"CLEANY_WORKER_COUNT": "20", "CLEANY_QUEUE_SIZE": "200"},
+			args: []string{"--worker-count=30"},
+			expected: func(c *Config) {
+				c.WorkerCount = 30
+				c.QueueSize = 200
+			},
+		},
+		{
+			name: "lists",
+			file: "protected-namespaces: [kube-system, cleany-system]\n",
+			env:  map[string]string{"CLEANY_PROTECTED_KINDS": " Node , ,CustomResourceDefinition.apiextensions.k8s.io"},
+			expected: func(c *Config) {
+				c.ProtectedNamespaces = []string{"kube-system", "cleany-system"}
+				c.ProtectedKinds = []string{"Node", "CustomResourceDefinition.apiextensions.k8s.io"}
+			},
+		},
+		{
+			name: "empty list",
+			args: []string{"--protected-namespaces="},
+			expected: func(c *Config) {
+				c.ProtectedNamespaces = nil
+			},
+		},
+		{
+			name: "list concurrency per resource",
+			file: "list-concurrency-per-resource: {pods: 10, deployments.apps: 4}\n",
+			expected: func(c *Config) {
+				c.ListConcurrencyPerResource = map[string]int{"pods": 10, "deployments.apps": 4}
+			},
+		},
+		{
+			name: "large integer",
+			file: "snapshot-inline-limit: 10000000\n",
+			expected: func(c *Config) {
+				c.SnapshotInlineLimit = 10000000
+			},
+		},
+		{
+			name: "unknown setting",
+			file: "workers: 10\n",
+			err:  `unknown setting "workers"`,
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{"CLEANY_RUN_TIMEOUT": "often"},
+			err:  "invalid value \"often\" for run-timeout from CLEANY_RUN_TIMEOUT",
+		},
+		{
+			name: "invalid setting",
+			args: []string{"--worker-count=0"},
+			err:  "worker-count must be at least 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := New()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			c.BindFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			err := c.Load(fs, path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := New()
+			tt.expected(expected)
+			if !reflect.DeepEqual(c, expected) {
+				t.Errorf("expected %+v, got %+v", expected, c)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no queue", func(c *Config) { c.QueueSize = 0 }, "queue-size"},
+		{"no run timeout", func(c *Config) { c.RunTimeout = 0 }, "run-timeout"},
+		{"no list concurrency", func(c *Config) { c.ListConcurrency = 0 }, "list-concurrency"},
+		{"no list concurrency for a resource", func(c *Config) {
+			c.ListConcurrencyPerResource = map[string]int{"pods": 0}
+		}, "list-concurrency-per-resource"},
+		{"resource without name", func(c *Config) {
+			c.ListConcurrencyPerResource = map[string]int{".apps": 2}
+		}, "list-concurrency-per-resource"},
+		{"small lua stack", func(c *Config) { c.LuaMaxStackSize = 10 }, "lua-max-stack-size"},
+		{"no lua table", func(c *Config) { c.LuaMaxTableSize = 0 }, "lua-max-table-size"},
+		{"no lua result", func(c *Config) { c.LuaMaxResultSize = 0 }, "lua-max-result-size"},
+		{"negative lookups", func(c *Config) { c.LuaMaxLookups = -1 }, "lua-max-lookups"},
+		{"no lookups", func(c *Config) { c.LuaMaxLookups = 0 }, ""},
+		{"negative qps", func(c *Config) { c.ActionQPS = -1 }, "action-qps"},
+		{"unlimited qps", func(c *Config) { c.ActionQPS = 0 }, ""},
+		{"kind without name", func(c *Config) { c.ProtectedKinds = []string{".apps"} }, "protected-kinds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			tt.modify(c)
+			err := c.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -17,46 +17,342 @@ limitations under the License.
 package cleany
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"slices"
+	"time"
 
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor"
+	"github.com/wys1203/Cleany/internal/executor/resource"
+	"github.com/wys1203/Cleany/internal/manager"
+)
+
+const (
+	// runPollInterval is how often a Cleaner with a queued or running task
+	// is reconciled to pick up the outcome of the run
+	runPollInterval = 10 * time.Second
+
+	// luaLibraryIndex indexes Cleaners by the name of the ConfigMaps they
+	// use as lua libraries
+	luaLibraryIndex = "spec.luaLibraries.name"
 )
 
 // CleanerReconciler reconciles a Cleaner object
 type CleanerReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// CleanerManager runs the Cleaners when they are due
+	CleanerManager *manager.CleanerManager
+
+	// Recorder records Events on the Cleaners
+	Recorder record.EventRecorder
 }
 
 // +kubebuilder:rbac:groups=cleany.wys1203.com,resources=cleaners,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=cleany.wys1203.com,resources=cleaners/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=cleany.wys1203.com,resources=cleaners/finalizers,verbs=update
+// +kubebuilder:rbac:groups=cleany.wys1203.com,resources=cleaningreports,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=*,resources=*,verbs=get;list;watch;create;update;delete;deletecollection
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the Cleaner object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// Reconcile queues a run of the Cleaner when it is due according to its
+// schedule, and copies the outcome of the most recent run into its status.
+// Once it is deleted, the metrics of its runs are dropped.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.18.4/pkg/reconcile
 func (r *CleanerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	cleaner := &cleanyv1alpha1.Cleaner{}
+	if err := r.Get(ctx, req.NamespacedName, cleaner); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.CleanerManager.ForgetCleaner(manager.TaskName(&cleanyv1alpha1.Cleaner{
+				ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}}))
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !cleaner.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	patch := client.MergeFrom(cleaner.DeepCopy())
+	result, err := reconcileSchedule(ctx, r.Client, r.CleanerManager, r.Recorder, cleaner, cleaner)
+	if err != nil {
+		logger.Error(err, "failed to schedule cleaner")
+	}
+
+	if err := r.Status().Patch(ctx, cleaner, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// reconcileSchedule queues a run when the Cleaner is due and updates the
+// Cleaner status accordingly. Events are recorded on owner, the Cleaner or
+// the NamespacedCleaner whose AsCleaner view is cleaner.
+func reconcileSchedule(ctx context.Context, c client.Client, cleanerManager *manager.CleanerManager,
+	recorder record.EventRecorder, owner client.Object, cleaner *cleanyv1alpha1.Cleaner,
+) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	_, namespaced := owner.(*cleanyv1alpha1.NamespacedCleaner)
+	taskName := manager.TaskName(cleaner)
+	if namespaced {
+		taskName = manager.NamespacedTaskName(cleaner)
+	}
+
+	if runs := cleanerManager.GetRunHistory(taskName); len(runs) > 0 {
+		lastRun := runs[0].DeepCopy()
+		cleaner.Status.LastRun = lastRun
+		cleaner.Status.RunHistory = mergeRunHistory(runs, cleaner.Status.RunHistory)
+		setLimitExceededCondition(cleaner, lastRun)
+		setRunFailedCondition(cleaner, lastRun)
+	}
+
+	schedule, err := cron.ParseStandard(cleaner.Spec.Schedule)
+	if err != nil {
+		msg := fmt.Sprintf("invalid schedule %q: %v", cleaner.Spec.Schedule, err)
+		cleaner.Status.FailureMessage = &msg
+		cleaner.Status.NextScheduleTime = nil
+		recorder.Event(owner, corev1.EventTypeWarning, "InvalidSchedule", msg)
+		return ctrl.Result{}, err
+	}
+	if err := validate(ctx, c, cleaner); err != nil {
+		msg := err.Error()
+		cleaner.Status.FailureMessage = &msg
+		cleaner.Status.NextScheduleTime = nil
+		recorder.Event(owner, corev1.EventTypeWarning, "InvalidSpec", msg)
+		return ctrl.Result{}, err
+	}
+	cleaner.Status.FailureMessage = nil
+
+	now := time.Now()
+	if cleaner.Status.NextScheduleTime == nil {
+		next := metav1.NewTime(schedule.Next(now))
+		cleaner.Status.NextScheduleTime = &next
+	}
+
+	if !cleaner.Status.NextScheduleTime.After(now) {
+		task := &manager.Task{Name: taskName, Cleaner: cleaner.DeepCopy(), Namespaced: namespaced}
+		if cleanerManager.AddTask(task) {
+			logger.Info("queued cleaner run")
+			recorder.Event(owner, corev1.EventTypeNormal, "RunQueued", "run queued as scheduled")
+			lastRunTime := metav1.NewTime(now)
+			cleaner.Status.LastRunTime = &lastRunTime
+		} else {
+			logger.Info("cleaner run not queued, previous run still pending or queue is full")
+			recorder.Event(owner, corev1.EventTypeWarning, "RunNotQueued",
+				"scheduled run not queued, the previous run is still pending or the queue is full")
+		}
+		next := metav1.NewTime(schedule.Next(now))
+		cleaner.Status.NextScheduleTime = &next
+	}
+
+	requeueAfter := cleaner.Status.NextScheduleTime.Sub(now)
+	if task := cleanerManager.GetTaskStatus(taskName); task != nil && task.Status != manager.StatusDone &&
+		requeueAfter > runPollInterval {
+		requeueAfter = runPollInterval
+	}
 
-	// TODO(user): your logic here
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// mergeRunHistory returns the runs known to the CleanerManager, recent, along
+// with those already in the status, recorded, most recent first and up to
+// manager.MaxRunHistory. The status keeps the runs completed before the
+// CleanerManager was restarted or another replica became the leader. Runs
+// are identified by their ID, or their start time for the runs recorded
+// without one.
+func mergeRunHistory(recent, recorded []cleanyv1alpha1.CleanerRun) []cleanyv1alpha1.CleanerRun {
+	history := make([]cleanyv1alpha1.CleanerRun, 0, len(recent)+len(recorded))
+	seen := make(map[string]bool)
+	for _, runs := range [][]cleanyv1alpha1.CleanerRun{recent, recorded} {
+		for i := range runs {
+			id := runs[i].ID
+			if id == "" {
+				id = runs[i].StartTime.UTC().Format(time.RFC3339)
+			}
+			if !seen[id] {
+				seen[id] = true
+				history = append(history, *runs[i].DeepCopy())
+			}
+		}
+	}
+	slices.SortStableFunc(history, func(a, b cleanyv1alpha1.CleanerRun) int {
+		return cmp.Compare(b.StartTime.Unix(), a.StartTime.Unix())
+	})
+	if len(history) > manager.MaxRunHistory {
+		history = history[:manager.MaxRunHistory]
+	}
+	return history
+}
+
+// setLimitExceededCondition reflects in the Cleaner conditions whether its
+// last run was aborted by its limits.
+func setLimitExceededCondition(cleaner *cleanyv1alpha1.Cleaner, lastRun *cleanyv1alpha1.CleanerRun) {
+	condition := metav1.Condition{
+		Type:               cleanyv1alpha1.ConditionLimitExceeded,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: cleaner.Generation,
+		Reason:             "WithinLimits",
+		Message:            "the last run was within the limits",
+	}
+	if lastRun.Result == cleanyv1alpha1.RunResultLimitExceeded {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = string(cleanyv1alpha1.RunResultLimitExceeded)
+		condition.Message = lastRun.Message
+	}
+	meta.SetStatusCondition(&cleaner.Status.Conditions, condition)
+}
+
+// setRunFailedCondition reflects in the Cleaner conditions whether its last
+// run failed, after all its attempts.
+func setRunFailedCondition(cleaner *cleanyv1alpha1.Cleaner, lastRun *cleanyv1alpha1.CleanerRun) {
+	condition := metav1.Condition{
+		Type:               cleanyv1alpha1.ConditionRunFailed,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: cleaner.Generation,
+		Reason:             "RunCompleted",
+		Message:            "the last run completed",
+	}
+	if lastRun.Result == cleanyv1alpha1.RunResultFailed {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = string(cleanyv1alpha1.RunResultFailed)
+		condition.Message = fmt.Sprintf("the last run failed after %d attempts", max(lastRun.Attempts, 1))
+		if len(lastRun.Errors) != 0 {
+			condition.Message += ": " + lastRun.Errors[0]
+		}
+	}
+	meta.SetStatusCondition(&cleaner.Status.Conditions, condition)
+}
+
+// validate verifies the expressions and scripts of the Cleaner, with the
+// current content of its lua libraries, which is recorded in its status.
+func validate(ctx context.Context, c client.Client, cleaner *cleanyv1alpha1.Cleaner) error {
+	if err := validateCEL(cleaner); err != nil {
+		return err
+	}
+
+	modules, libraries, err := executor.LoadLuaLibraries(ctx, c, cleaner)
+	if err != nil {
+		return err
+	}
+	cleaner.Status.LuaLibraries = libraries
 
-	return ctrl.Result{}, nil
+	scripts := map[string]string{
+		"transform":           cleaner.Spec.Transform,
+		"aggregatedSelection": cleaner.Spec.ResourcePolicySet.AggregatedSelection,
+	}
+	functions := map[string]string{
+		"transform":           "transform",
+		"aggregatedSelection": "evaluate",
+	}
+	for i, selector := range cleaner.Spec.ResourcePolicySet.ResourceSelectors {
+		name := fmt.Sprintf("evaluate of resource selector %d", i)
+		scripts[name] = selector.Evaluate
+		functions[name] = "evaluate"
+	}
+	for name, source := range scripts {
+		if source == "" {
+			continue
+		}
+		if err := validateLua(ctx, name, source, functions[name], modules); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validateLua compiles and loads a script, which catches syntax errors
+// as well as errors in the modules it requires when loaded, and verifies
+// it defines the function fn.
+func validateLua(ctx context.Context, name, source, fn string, modules resource.LuaModules) error {
+	script, err := resource.CompileLuaScript(name, source, resource.DefaultLuaLimits)
+	if err != nil {
+		return err
+	}
+	defer script.Close()
+	script.UseModules(modules)
+	return script.Validate(ctx, fn)
+}
+
+// validateCEL verifies the CEL expressions of the Cleaner compile. They are
+// not type checked against the selected kinds here, which happens on each run.
+func validateCEL(cleaner *cleanyv1alpha1.Cleaner) error {
+	for i := range cleaner.Spec.ResourcePolicySet.ResourceSelectors {
+		expression := cleaner.Spec.ResourcePolicySet.ResourceSelectors[i].EvaluateCEL
+		if expression == "" {
+			continue
+		}
+		if _, err := resource.CompileCEL(expression, nil); err != nil {
+			return fmt.Errorf("invalid evaluateCEL of resource selector %d: %w", i, err)
+		}
+	}
+	if expression := cleaner.Spec.ResourcePolicySet.AggregatedSelectionCEL; expression != "" {
+		if _, err := resource.CompileAggregatedCEL(expression); err != nil {
+			return fmt.Errorf("invalid aggregatedSelectionCEL: %w", err)
+		}
+	}
+	return nil
+}
+
+// cleanersForLibrary returns a request for each Cleaner using the ConfigMap
+// as a lua library, so its scripts are validated again when it changes.
+func (r *CleanerReconciler) cleanersForLibrary(ctx context.Context, obj client.Object) []reconcile.Request {
+	cleaners := &cleanyv1alpha1.CleanerList{}
+	if err := r.List(ctx, cleaners, client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{luaLibraryIndex: obj.GetName()}); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list cleaners using lua library", "configMap", obj.GetName())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, len(cleaners.Items))
+	for i := range cleaners.Items {
+		requests[i] = reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cleaners.Items[i])}
+	}
+	return requests
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CleanerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &cleanyv1alpha1.Cleaner{}, luaLibraryIndex,
+		func(obj client.Object) []string {
+			cleaner := obj.(*cleanyv1alpha1.Cleaner)
+			names := make([]string, len(cleaner.Spec.LuaLibraries))
+			for i := range cleaner.Spec.LuaLibraries {
+				names[i] = cleaner.Spec.LuaLibraries[i].Name
+			}
+			return names
+		})
+	if err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&cleanyv1alpha1.Cleaner{}).
+		// only the metadata of ConfigMaps is cached, their data is read
+		// when a Cleaner is reconciled
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.cleanersForLibrary), builder.OnlyMetadata).
 		Complete(r)
 }
@@ -18,16 +18,21 @@ package cleany
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/manager"
 )
 
 var _ = Describe("Cleaner Controller", func() {
@@ -51,7 +56,15 @@ var _ = Describe("Cleaner Controller", func() {
 						Name:      resourceName,
 						Namespace: "default",
 					},
-					// TODO(user): Specify other spec details if needed.
+					Spec: cleanyv1alpha1.CleanerSpec{
+						ResourcePolicySet: cleanyv1alpha1.ResourcePolicySet{
+							ResourceSelectors: []cleanyv1alpha1.ResourceSelector{
+								{Group: "", Version: "v1", Kind: "ConfigMap", Namespace: "default"},
+							},
+						},
+						Action:   cleanyv1alpha1.ActionScan,
+						Schedule: "0 3 * * *",
+					},
 				}
 				Expect(k8sClient.Create(ctx, resource)).To(Succeed())
 			}
@@ -69,16 +82,96 @@ var _ = Describe("Cleaner Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &CleanerReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:         k8sClient,
+				Scheme:         k8sClient.Scheme(),
+				CleanerManager: manager.NewCleanerManager(nil, config.New()),
+				Recorder:       record.NewFakeRecorder(10),
 			}
 
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+			By("Checking the next run is scheduled")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, cleaner)).To(Succeed())
+			Expect(cleaner.Status.NextScheduleTime).NotTo(BeNil())
+			Expect(cleaner.Status.FailureMessage).To(BeNil())
+		})
+		It("should report a missing lua library", func() {
+			By("Referencing a lua library that does not exist")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, cleaner)).To(Succeed())
+			cleaner.Spec.LuaLibraries = []cleanyv1alpha1.LuaLibraryReference{{Name: "missing"}}
+			Expect(k8sClient.Update(ctx, cleaner)).To(Succeed())
+
+			controllerReconciler := &CleanerReconciler{
+				Client:         k8sClient,
+				Scheme:         k8sClient.Scheme(),
+				CleanerManager: manager.NewCleanerManager(nil, config.New()),
+				Recorder:       record.NewFakeRecorder(10),
+			}
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
 			})
 			Expect(err).NotTo(HaveOccurred())
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+
+			By("Checking the failure is reported and no run is scheduled")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, cleaner)).To(Succeed())
+			Expect(cleaner.Status.FailureMessage).NotTo(BeNil())
+			Expect(*cleaner.Status.FailureMessage).To(ContainSubstring("lua library missing"))
+			Expect(cleaner.Status.NextScheduleTime).To(BeNil())
 		})
 	})
 })
+
+var _ = Describe("mergeRunHistory", func() {
+	run := func(id string, start time.Time) cleanyv1alpha1.CleanerRun {
+		return cleanyv1alpha1.CleanerRun{ID: id, StartTime: metav1.NewTime(start),
+			Result: cleanyv1alpha1.RunResultSucceeded}
+	}
+	now := time.Now()
+
+	It("should keep the runs recorded before the manager started", func() {
+		recent := []cleanyv1alpha1.CleanerRun{run("c", now), run("b", now.Add(-time.Hour))}
+		// the status keeps start times to the second
+		recorded := []cleanyv1alpha1.CleanerRun{run("b", now.Add(-time.Hour).Truncate(time.Second)),
+			run("a", now.Add(-2*time.Hour))}
+
+		history := mergeRunHistory(recent, recorded)
+		Expect(history).To(HaveLen(3))
+		Expect(history[0].StartTime.Time).To(Equal(now))
+		Expect(history[1].StartTime.Time).To(Equal(now.Add(-time.Hour)))
+		Expect(history[2].StartTime.Time).To(Equal(now.Add(-2 * time.Hour)))
+	})
+
+	It("should keep the runs started in the same second", func() {
+		start := now.Truncate(time.Second)
+		recent := []cleanyv1alpha1.CleanerRun{run("b", start.Add(500*time.Millisecond)), run("a", start)}
+		recorded := []cleanyv1alpha1.CleanerRun{run("a", start)}
+
+		history := mergeRunHistory(recent, recorded)
+		Expect(history).To(HaveLen(2))
+		Expect(history[0].ID).To(Equal("b"))
+		Expect(history[1].ID).To(Equal("a"))
+	})
+
+	It("should identify the runs recorded without ID by their start time", func() {
+		recorded := []cleanyv1alpha1.CleanerRun{run("", now.Add(-time.Hour)), run("", now.Add(-time.Hour))}
+
+		history := mergeRunHistory([]cleanyv1alpha1.CleanerRun{run("a", now)}, recorded)
+		Expect(history).To(HaveLen(2))
+	})
+
+	It("should keep the most recent runs only", func() {
+		var recorded []cleanyv1alpha1.CleanerRun
+		for i := 1; i <= manager.MaxRunHistory; i++ {
+			recorded = append(recorded, run(fmt.Sprint(i), now.Add(-time.Duration(i)*time.Hour)))
+		}
+
+		history := mergeRunHistory([]cleanyv1alpha1.CleanerRun{run("0", now)}, recorded)
+		Expect(history).To(HaveLen(manager.MaxRunHistory))
+		Expect(history[0].StartTime.Time).To(Equal(now))
+		Expect(history[manager.MaxRunHistory-1].StartTime.Time).To(Equal(recorded[manager.MaxRunHistory-2].StartTime.Time))
+	})
+})
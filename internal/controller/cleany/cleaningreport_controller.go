@@ -0,0 +1,191 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleany
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor"
+	"github.com/wys1203/Cleany/internal/manager"
+)
+
+// CleaningReportReconciler runs the action listed in a pending
+// CleaningReport once it is approved, and expires it otherwise. It also
+// restores the resources deleted by a run on request.
+type CleaningReportReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Config is the configuration of the clients restoring resources, as
+	// the ServiceAccount of the Cleaner if any
+	Config *rest.Config
+
+	// APIReader reads the Secrets holding snapshots, which are not cached
+	APIReader client.Reader
+
+	// CleanerManager runs the approved actions
+	CleanerManager *manager.CleanerManager
+}
+
+// +kubebuilder:rbac:groups=cleany.wys1203.com,resources=cleaningreports/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=create
+
+// Reconcile restores the resources named in the restore annotation of a
+// CleaningReport, queues the action of an approved pending CleaningReport,
+// or marks it as expired when it was not approved in time.
+func (r *CleaningReportReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	report := &cleanyv1alpha1.CleaningReport{}
+	if err := r.Get(ctx, req.NamespacedName, report); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	selection, restore := report.Annotations[cleanyv1alpha1.RestoreAnnotation]
+	restore = restore && (report.Status.Restore == nil || report.Status.Restore.Selection != selection)
+	phase := report.Status.Phase
+	if !restore && phase != cleanyv1alpha1.ApprovalPhasePending && phase != cleanyv1alpha1.ApprovalPhaseApproved {
+		return ctrl.Result{}, nil
+	}
+
+	task, err := r.reportTask(ctx, report)
+	if err != nil || task == nil {
+		// without its Cleaner the report is garbage collected
+		return ctrl.Result{}, err
+	}
+
+	if restore {
+		return ctrl.Result{}, r.restore(ctx, report, task.Cleaner, selection)
+	}
+
+	patch := client.MergeFrom(report.DeepCopy())
+	var result ctrl.Result
+	now := time.Now()
+	switch {
+	case phase == cleanyv1alpha1.ApprovalPhaseApproved:
+		// the action is queued again if it was lost, e.g. on a new leader,
+		// but not once its task is known: when done, the outcome may not
+		// show in the cached report yet
+		status := r.CleanerManager.GetTaskStatus(task.Name)
+		if status == nil || (status.ReportName != report.Name && status.Status == manager.StatusDone) {
+			r.CleanerManager.AddTask(task)
+		}
+		result.RequeueAfter = runPollInterval
+	case report.Status.ExpirationTime != nil && !now.Before(report.Status.ExpirationTime.Time):
+		report.Status.Phase = cleanyv1alpha1.ApprovalPhaseExpired
+		report.Status.Message = "not approved before expiration"
+	case report.Annotations[cleanyv1alpha1.ApprovedAnnotation] == "true":
+		if r.CleanerManager.AddTask(task) {
+			logger.Info("queued approved action")
+			report.Status.Phase = cleanyv1alpha1.ApprovalPhaseApproved
+		} else {
+			logger.Info("approved action not queued, a run is still pending or queue is full")
+		}
+		result.RequeueAfter = runPollInterval
+	case report.Status.ExpirationTime != nil:
+		result.RequeueAfter = report.Status.ExpirationTime.Sub(now)
+	}
+
+	if err := r.Status().Patch(ctx, report, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// restore re-creates the resources deleted by the run recorded in report and
+// named in selection, with the permissions of the Cleaner, and records the
+// outcome in the report status.
+func (r *CleaningReportReconciler) restore(ctx context.Context, report *cleanyv1alpha1.CleaningReport,
+	cleaner *cleanyv1alpha1.Cleaner, selection string,
+) error {
+	restConfig := executor.CleanerRestConfig(r.Config, cleaner)
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	// without a ServiceAccount, restore is limited to the namespace of the
+	// report, as with the permissions of the controller
+	namespace := ""
+	if cleaner.Spec.ServiceAccountRef == nil {
+		namespace = report.Namespace
+	}
+	status, err := executor.Restore(ctx, r.APIReader, dynamicClient, mapper, report, selection, namespace)
+	if err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("restored resources", "restored", status.RestoredResources,
+		"errors", len(status.Errors))
+
+	patch := client.MergeFrom(report.DeepCopy())
+	report.Status.Restore = status
+	return r.Status().Patch(ctx, report, patch)
+}
+
+// reportTask returns the task taking the action of report, or nil if the
+// Cleaner or NamespacedCleaner that created it is gone.
+func (r *CleaningReportReconciler) reportTask(ctx context.Context, report *cleanyv1alpha1.CleaningReport,
+) (*manager.Task, error) {
+	if name, ok := report.Labels[cleanyv1alpha1.NamespacedCleanerLabel]; ok {
+		namespacedCleaner := &cleanyv1alpha1.NamespacedCleaner{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: report.Namespace, Name: name},
+			namespacedCleaner); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return &manager.Task{
+			Name:       manager.NamespacedTaskName(namespacedCleaner),
+			Cleaner:    namespacedCleaner.AsCleaner(),
+			Namespaced: true,
+			ReportName: report.Name,
+		}, nil
+	}
+
+	cleaner := &cleanyv1alpha1.Cleaner{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: report.Namespace, Name: report.Labels[cleanyv1alpha1.CleanerLabel]},
+		cleaner); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return &manager.Task{
+		Name:       manager.TaskName(cleaner),
+		Cleaner:    cleaner,
+		ReportName: report.Name,
+	}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CleaningReportReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&cleanyv1alpha1.CleaningReport{}).
+		Complete(r)
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleany
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor"
+	"github.com/wys1203/Cleany/internal/manager"
+)
+
+// runCleaner runs the Cleaner identified by key once, as the CleanerManager
+// does, and returns the name of the CleaningReport created.
+func runCleaner(ctx context.Context, key types.NamespacedName) string {
+	exe, err := executor.NewExecutor(ctx, key, false, config.New(), executor.NewActionLimiter(config.New()),
+		record.NewFakeRecorder(100), cfg, k8sClient, k8sClient, scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+	summary, err := exe.Run(ctx)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(summary.ReportName).NotTo(BeEmpty())
+	return summary.ReportName
+}
+
+// newConfigMapCleaner returns a Cleaner named name taking action on the
+// ConfigMaps of the default namespace labelled app=name.
+func newConfigMapCleaner(name string, action cleanyv1alpha1.Action) *cleanyv1alpha1.Cleaner {
+	return &cleanyv1alpha1.Cleaner{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Spec: cleanyv1alpha1.CleanerSpec{
+			ResourcePolicySet: cleanyv1alpha1.ResourcePolicySet{
+				ResourceSelectors: []cleanyv1alpha1.ResourceSelector{
+					{Group: "", Version: "v1", Kind: "ConfigMap", Namespace: "default",
+						LabelFilters: []libsveltosv1alpha1.LabelFilter{
+							{Key: "app", Operation: libsveltosv1alpha1.OperationEqual, Value: name},
+						}},
+				},
+			},
+			Action:   action,
+			Schedule: "0 3 * * *",
+		},
+	}
+}
+
+// newConfigMap returns a ConfigMap of the default namespace labelled
+// app=app.
+func newConfigMap(name, app string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{"app": app},
+		},
+		Data: map[string]string{"name": name},
+	}
+}
+
+var _ = Describe("CleaningReport Controller", func() {
+	Context("When approving a run", func() {
+		const cleanerName = "approval-cleaner"
+
+		ctx := context.Background()
+
+		cleanerKey := types.NamespacedName{
+			Name:      cleanerName,
+			Namespace: "default",
+		}
+		taskName := manager.TaskName(&cleanyv1alpha1.Cleaner{ObjectMeta: metav1.ObjectMeta{
+			Name:      cleanerName,
+			Namespace: "default",
+		}})
+		var controllerReconciler *CleaningReportReconciler
+		var reportKey types.NamespacedName
+
+		BeforeEach(func() {
+			By("creating a Cleaner requiring approval and a ConfigMap it selects")
+			cleaner := newConfigMapCleaner(cleanerName, cleanyv1alpha1.ActionDelete)
+			cleaner.Spec.Approval = &cleanyv1alpha1.Approval{Expiry: metav1.Duration{Duration: time.Hour}}
+			Expect(k8sClient.Create(ctx, cleaner)).To(Succeed())
+			err := k8sClient.Create(ctx, newConfigMap("approval-a", cleanerName))
+			if !errors.IsAlreadyExists(err) {
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			By("running the Cleaner")
+			reportKey = types.NamespacedName{Name: runCleaner(ctx, cleanerKey), Namespace: "default"}
+
+			controllerReconciler = &CleaningReportReconciler{
+				Client:         k8sClient,
+				Scheme:         k8sClient.Scheme(),
+				Config:         cfg,
+				APIReader:      k8sClient,
+				CleanerManager: manager.NewCleanerManager(nil, config.New()),
+			}
+		})
+
+		AfterEach(func() {
+			cleaner := &cleanyv1alpha1.Cleaner{}
+			Expect(k8sClient.Get(ctx, cleanerKey, cleaner)).To(Succeed())
+
+			By("Cleanup the Cleaner and its CleaningReports")
+			Expect(k8sClient.Delete(ctx, cleaner)).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &cleanyv1alpha1.CleaningReport{}, client.InNamespace("default"),
+				client.MatchingLabels{cleanyv1alpha1.CleanerLabel: cleanerName})).To(Succeed())
+		})
+
+		reconcileReport := func() (reconcile.Result, *cleanyv1alpha1.CleaningReport) {
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: reportKey})
+			Expect(err).NotTo(HaveOccurred())
+			report := &cleanyv1alpha1.CleaningReport{}
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			return result, report
+		}
+
+		approve := func() {
+			report := &cleanyv1alpha1.CleaningReport{}
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			report.Annotations = map[string]string{cleanyv1alpha1.ApprovedAnnotation: "true"}
+			Expect(k8sClient.Update(ctx, report)).To(Succeed())
+		}
+
+		It("should wait for approval until the report expires", func() {
+			By("Reconciling the pending report")
+			result, report := reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhasePending))
+			Expect(report.Status.Digest).NotTo(BeEmpty())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+			Expect(result.RequeueAfter).To(BeNumerically("<=", time.Hour))
+			Expect(controllerReconciler.CleanerManager.GetTaskStatus(taskName)).To(BeNil())
+
+			By("Reconciling the report once its expiration time passed")
+			expired := metav1.NewTime(time.Now().Add(-time.Minute))
+			report.Status.ExpirationTime = &expired
+			Expect(k8sClient.Status().Update(ctx, report)).To(Succeed())
+			result, report = reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseExpired))
+			Expect(report.Status.Message).To(Equal("not approved before expiration"))
+			Expect(result.RequeueAfter).To(BeZero())
+
+			By("Checking an expired report is not approved")
+			approve()
+			result, report = reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseExpired))
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(controllerReconciler.CleanerManager.GetTaskStatus(taskName)).To(BeNil())
+		})
+
+		It("should queue the action once approved", func() {
+			By("Approving the pending report")
+			approve()
+			result, report := reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseApproved))
+			Expect(result.RequeueAfter).To(Equal(runPollInterval))
+
+			By("Checking the action of the report is queued")
+			task := controllerReconciler.CleanerManager.GetTaskStatus(taskName)
+			Expect(task).NotTo(BeNil())
+			Expect(task.ReportName).To(Equal(reportKey.Name))
+			Expect(task.Status).To(Equal(manager.StatusInQueue))
+
+			By("Checking the action is not queued twice")
+			result, report = reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseApproved))
+			Expect(result.RequeueAfter).To(Equal(runPollInterval))
+			Expect(controllerReconciler.CleanerManager.GetTaskStatus(taskName)).To(BeIdenticalTo(task))
+
+			By("Checking the action is queued again once lost, e.g. on a new leader")
+			controllerReconciler.CleanerManager = manager.NewCleanerManager(nil, config.New())
+			_, _ = reconcileReport()
+			task = controllerReconciler.CleanerManager.GetTaskStatus(taskName)
+			Expect(task).NotTo(BeNil())
+			Expect(task.ReportName).To(Equal(reportKey.Name))
+		})
+
+		It("should refuse an approved report that does not match its digest", func() {
+			By("Checking the listed resources cannot be changed")
+			report := &cleanyv1alpha1.CleaningReport{}
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			report.Spec.ResourceInfo = nil
+			Expect(k8sClient.Update(ctx, report)).NotTo(Succeed())
+
+			By("Approving the report after its digest changed")
+			approve()
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			report.Status.Digest = "sha256:tampered"
+			Expect(k8sClient.Status().Update(ctx, report)).To(Succeed())
+			_, report = reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseApproved))
+
+			By("Running the approved action")
+			exe, err := executor.NewExecutor(ctx, cleanerKey, false, config.New(),
+				executor.NewActionLimiter(config.New()), record.NewFakeRecorder(100), cfg, k8sClient, k8sClient,
+				scheme.Scheme)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = exe.RunApproved(ctx, reportKey.Name)
+			Expect(err).To(HaveOccurred())
+
+			By("Checking the report failed and the ConfigMap was left alone")
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseFailed))
+			Expect(report.Status.Message).To(ContainSubstring("changed since approval"))
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "approval-a", Namespace: "default"},
+				&corev1.ConfigMap{})).To(Succeed())
+
+			By("Checking the failed report is not queued again")
+			controllerReconciler.CleanerManager = manager.NewCleanerManager(nil, config.New())
+			result, report := reconcileReport()
+			Expect(report.Status.Phase).To(Equal(cleanyv1alpha1.ApprovalPhaseFailed))
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(controllerReconciler.CleanerManager.GetTaskStatus(taskName)).To(BeNil())
+		})
+	})
+
+	Context("When restoring resources", func() {
+		const cleanerName = "restore-cleaner"
+
+		ctx := context.Background()
+
+		cleanerKey := types.NamespacedName{
+			Name:      cleanerName,
+			Namespace: "default",
+		}
+		configMapKey := func(name string) types.NamespacedName {
+			return types.NamespacedName{Name: name, Namespace: "default"}
+		}
+		var controllerReconciler *CleaningReportReconciler
+		var reportKey types.NamespacedName
+		var keeper *corev1.ConfigMap
+
+		BeforeEach(func() {
+			By("creating a Cleaner deleting ConfigMaps, one owning another")
+			Expect(k8sClient.Create(ctx, newConfigMapCleaner(cleanerName, cleanyv1alpha1.ActionDelete))).To(Succeed())
+			owner := newConfigMap("restore-owner", cleanerName)
+			Expect(k8sClient.Create(ctx, owner)).To(Succeed())
+			keeper = newConfigMap("restore-keeper", "")
+			Expect(k8sClient.Create(ctx, keeper)).To(Succeed())
+			owned := newConfigMap("restore-owned", cleanerName)
+			owned.OwnerReferences = []metav1.OwnerReference{
+				{APIVersion: "v1", Kind: "ConfigMap", Name: owner.Name, UID: owner.UID},
+				{APIVersion: "v1", Kind: "ConfigMap", Name: keeper.Name, UID: keeper.UID},
+				{APIVersion: "v1", Kind: "ConfigMap", Name: "restore-gone", UID: "3c5d9b1e-0000-4000-8000-000000000000"},
+			}
+			Expect(k8sClient.Create(ctx, owned)).To(Succeed())
+			Expect(k8sClient.Create(ctx, newConfigMap("restore-other", cleanerName))).To(Succeed())
+
+			By("running the Cleaner")
+			reportKey = types.NamespacedName{Name: runCleaner(ctx, cleanerKey), Namespace: "default"}
+			for _, name := range []string{"restore-owner", "restore-owned", "restore-other"} {
+				err := k8sClient.Get(ctx, configMapKey(name), &corev1.ConfigMap{})
+				Expect(errors.IsNotFound(err)).To(BeTrue())
+			}
+
+			controllerReconciler = &CleaningReportReconciler{
+				Client:         k8sClient,
+				Scheme:         k8sClient.Scheme(),
+				Config:         cfg,
+				APIReader:      k8sClient,
+				CleanerManager: manager.NewCleanerManager(nil, config.New()),
+			}
+		})
+
+		AfterEach(func() {
+			cleaner := &cleanyv1alpha1.Cleaner{}
+			Expect(k8sClient.Get(ctx, cleanerKey, cleaner)).To(Succeed())
+
+			By("Cleanup the Cleaner, its CleaningReports and the ConfigMaps")
+			Expect(k8sClient.Delete(ctx, cleaner)).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &cleanyv1alpha1.CleaningReport{}, client.InNamespace("default"),
+				client.MatchingLabels{cleanyv1alpha1.CleanerLabel: cleanerName})).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &corev1.ConfigMap{}, client.InNamespace("default"),
+				client.MatchingLabels{"app": cleanerName})).To(Succeed())
+			Expect(k8sClient.Delete(ctx, keeper)).To(Succeed())
+		})
+
+		restore := func(selection string) *cleanyv1alpha1.RestoreStatus {
+			report := &cleanyv1alpha1.CleaningReport{}
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			report.Annotations = map[string]string{cleanyv1alpha1.RestoreAnnotation: selection}
+			Expect(k8sClient.Update(ctx, report)).To(Succeed())
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: reportKey})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			Expect(report.Status.Restore).NotTo(BeNil())
+			Expect(report.Status.Restore.Selection).To(Equal(selection))
+			return report.Status.Restore
+		}
+
+		It("should restore the resources selected", func() {
+			By("Restoring a single ConfigMap by namespace/name")
+			status := restore("default/restore-other")
+			Expect(status.RestoredResources).To(Equal(1))
+			Expect(status.Errors).To(BeEmpty())
+			Expect(k8sClient.Get(ctx, configMapKey("restore-other"), &corev1.ConfigMap{})).To(Succeed())
+			err := k8sClient.Get(ctx, configMapKey("restore-owner"), &corev1.ConfigMap{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			By("Checking the same selection is not restored twice")
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: reportKey})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeZero())
+			report := &cleanyv1alpha1.CleaningReport{}
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			Expect(report.Status.Restore).To(Equal(status))
+
+			By("Restoring all the ConfigMaps deleted")
+			status = restore("*")
+			Expect(status.RestoredResources).To(Equal(2))
+			Expect(status.Errors).To(ConsistOf(ContainSubstring("restore-other: already exists")))
+
+			By("Checking the owned ConfigMap refers to its restored owner only if it still exists")
+			owner := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, configMapKey("restore-owner"), owner)).To(Succeed())
+			owned := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, configMapKey("restore-owned"), owned)).To(Succeed())
+			Expect(owned.Data).To(Equal(map[string]string{"name": "restore-owned"}))
+			Expect(owned.OwnerReferences).To(ConsistOf(
+				metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: owner.Name, UID: owner.UID},
+				metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: keeper.Name, UID: keeper.UID},
+			))
+		})
+
+		It("should not restore resources from a report that does not match its digest", func() {
+			By("Changing the digest of the report")
+			report := &cleanyv1alpha1.CleaningReport{}
+			Expect(k8sClient.Get(ctx, reportKey, report)).To(Succeed())
+			report.Status.Digest = "sha256:tampered"
+			Expect(k8sClient.Status().Update(ctx, report)).To(Succeed())
+
+			By("Restoring all the ConfigMaps deleted")
+			status := restore("*")
+			Expect(status.RestoredResources).To(BeZero())
+			Expect(status.Errors).To(ConsistOf(
+				"the report or its snapshots do not match the digest recorded by the run"))
+			for _, name := range []string{"restore-owner", "restore-owned", "restore-other"} {
+				err := k8sClient.Get(ctx, configMapKey(name), &corev1.ConfigMap{})
+				Expect(errors.IsNotFound(err)).To(BeTrue())
+			}
+		})
+	})
+})
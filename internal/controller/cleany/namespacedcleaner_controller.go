@@ -0,0 +1,158 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleany
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/manager"
+)
+
+// NamespacedCleanerReconciler reconciles a NamespacedCleaner object
+type NamespacedCleanerReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// CleanerManager runs the NamespacedCleaners when they are due
+	CleanerManager *manager.CleanerManager
+
+	// Recorder records Events on the NamespacedCleaners
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=cleany.wys1203.com,resources=namespacedcleaners,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cleany.wys1203.com,resources=namespacedcleaners/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=cleany.wys1203.com,resources=namespacedcleaners/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=impersonate
+
+// Reconcile schedules the NamespacedCleaner as a Cleaner confined to its
+// namespace, see NamespacedCleaner.AsCleaner. Once it is deleted, the
+// metrics of its runs are dropped.
+func (r *NamespacedCleanerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	namespacedCleaner := &cleanyv1alpha1.NamespacedCleaner{}
+	if err := r.Get(ctx, req.NamespacedName, namespacedCleaner); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.CleanerManager.ForgetCleaner(manager.NamespacedTaskName(&cleanyv1alpha1.NamespacedCleaner{
+				ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}}))
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !namespacedCleaner.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	patch := client.MergeFrom(namespacedCleaner.DeepCopy())
+	var result ctrl.Result
+	err := validateNamespaced(namespacedCleaner)
+	if err != nil {
+		msg := err.Error()
+		namespacedCleaner.Status.FailureMessage = &msg
+		namespacedCleaner.Status.NextScheduleTime = nil
+		r.Recorder.Event(namespacedCleaner, corev1.EventTypeWarning, "InvalidSpec", msg)
+	} else {
+		cleaner := namespacedCleaner.AsCleaner()
+		result, err = reconcileSchedule(ctx, r.Client, r.CleanerManager, r.Recorder, namespacedCleaner, cleaner)
+		namespacedCleaner.Status = cleaner.Status
+	}
+	if err != nil {
+		logger.Error(err, "failed to schedule namespaced cleaner")
+	}
+
+	if err := r.Status().Patch(ctx, namespacedCleaner, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// validateNamespaced verifies the resource selectors of the NamespacedCleaner
+// do not select resources outside of its namespace.
+func validateNamespaced(namespacedCleaner *cleanyv1alpha1.NamespacedCleaner) error {
+	if namespacedCleaner.Spec.ServiceAccountRef != nil {
+		return fmt.Errorf("serviceAccountRef cannot be set, serviceAccountName is impersonated")
+	}
+	for i, selector := range namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors {
+		if selector.Namespace != "" && selector.Namespace != namespacedCleaner.Namespace {
+			return fmt.Errorf("resource selector %d selects namespace %s, not the NamespacedCleaner namespace",
+				i, selector.Namespace)
+		}
+		if selector.NamespaceSelector != "" {
+			return fmt.Errorf("resource selector %d cannot have a namespaceSelector", i)
+		}
+	}
+	return nil
+}
+
+// namespacedCleanersForLibrary returns a request for each NamespacedCleaner
+// using the ConfigMap as a lua library.
+func (r *NamespacedCleanerReconciler) namespacedCleanersForLibrary(ctx context.Context, obj client.Object,
+) []reconcile.Request {
+	cleaners := &cleanyv1alpha1.NamespacedCleanerList{}
+	if err := r.List(ctx, cleaners, client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{luaLibraryIndex: obj.GetName()}); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list namespaced cleaners using lua library",
+			"configMap", obj.GetName())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, len(cleaners.Items))
+	for i := range cleaners.Items {
+		requests[i] = reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cleaners.Items[i])}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NamespacedCleanerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &cleanyv1alpha1.NamespacedCleaner{},
+		luaLibraryIndex, func(obj client.Object) []string {
+			cleaner := obj.(*cleanyv1alpha1.NamespacedCleaner)
+			names := make([]string, len(cleaner.Spec.LuaLibraries))
+			for i := range cleaner.Spec.LuaLibraries {
+				names[i] = cleaner.Spec.LuaLibraries[i].Name
+			}
+			return names
+		})
+	if err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&cleanyv1alpha1.NamespacedCleaner{}).
+		// only the metadata of ConfigMaps is cached, their data is read
+		// when a Cleaner is reconciled
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.namespacedCleanersForLibrary),
+			builder.OnlyMetadata).
+		Complete(r)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleany
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/manager"
+)
+
+var _ = Describe("NamespacedCleaner Controller", func() {
+	Context("When reconciling a resource", func() {
+		const resourceName = "test-resource"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+		namespacedCleaner := &cleanyv1alpha1.NamespacedCleaner{}
+
+		BeforeEach(func() {
+			By("creating the custom resource for the Kind NamespacedCleaner")
+			err := k8sClient.Get(ctx, typeNamespacedName, namespacedCleaner)
+			if err != nil && errors.IsNotFound(err) {
+				resource := &cleanyv1alpha1.NamespacedCleaner{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      resourceName,
+						Namespace: "default",
+					},
+					Spec: cleanyv1alpha1.NamespacedCleanerSpec{
+						CleanerSpec: cleanyv1alpha1.CleanerSpec{
+							ResourcePolicySet: cleanyv1alpha1.ResourcePolicySet{
+								ResourceSelectors: []cleanyv1alpha1.ResourceSelector{
+									{Group: "", Version: "v1", Kind: "ConfigMap"},
+								},
+							},
+							Action:   cleanyv1alpha1.ActionScan,
+							Schedule: "0 3 * * *",
+						},
+						ServiceAccountName: "cleaner",
+					},
+				}
+				Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			resource := &cleanyv1alpha1.NamespacedCleaner{}
+			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Cleanup the specific resource instance NamespacedCleaner")
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+		})
+		It("should successfully reconcile the resource", func() {
+			By("Reconciling the created resource")
+			controllerReconciler := &NamespacedCleanerReconciler{
+				Client:         k8sClient,
+				Scheme:         k8sClient.Scheme(),
+				CleanerManager: manager.NewCleanerManager(nil, config.New()),
+				Recorder:       record.NewFakeRecorder(10),
+			}
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+			By("Checking the next run is scheduled")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, namespacedCleaner)).To(Succeed())
+			Expect(namespacedCleaner.Status.NextScheduleTime).NotTo(BeNil())
+			Expect(namespacedCleaner.Status.FailureMessage).To(BeNil())
+		})
+		It("should reject selecting another namespace", func() {
+			By("Selecting resources in another namespace")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, namespacedCleaner)).To(Succeed())
+			namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors[0].Namespace = "kube-system"
+			Expect(k8sClient.Update(ctx, namespacedCleaner)).To(Succeed())
+
+			controllerReconciler := &NamespacedCleanerReconciler{
+				Client:         k8sClient,
+				Scheme:         k8sClient.Scheme(),
+				CleanerManager: manager.NewCleanerManager(nil, config.New()),
+				Recorder:       record.NewFakeRecorder(10),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Checking the failure is reported and no run is scheduled")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, namespacedCleaner)).To(Succeed())
+			Expect(namespacedCleaner.Status.FailureMessage).NotTo(BeNil())
+			Expect(*namespacedCleaner.Status.FailureMessage).To(ContainSubstring("kube-system"))
+			Expect(namespacedCleaner.Status.NextScheduleTime).To(BeNil())
+		})
+	})
+})
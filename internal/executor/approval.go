@@ -0,0 +1,180 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+// defaultApprovalExpiry is how long a pending CleaningReport can be approved
+// for when the Cleaner does not set it
+const defaultApprovalExpiry = 24 * time.Hour
+
+// requestApproval records the resources the Cleaner would act on in a
+// pending CleaningReport instead of acting on them.
+func (e *Executor) requestApproval(ctx context.Context, resources []models.ResourceResult,
+	summary *models.RunSummary,
+) error {
+	expiry := e.cleaner.Spec.Approval.Expiry.Duration
+	if expiry <= 0 {
+		expiry = defaultApprovalExpiry
+	}
+
+	report, err := e.reportOnly(ctx, resources, e.action(), "awaiting approval", summary)
+	if err != nil {
+		return err
+	}
+	summary.PendingApproval = true
+
+	patch := client.MergeFrom(report.DeepCopy())
+	expirationTime := metav1.NewTime(time.Now().Add(expiry))
+	report.Status.Phase = cleanyv1alpha1.ApprovalPhasePending
+	report.Status.ExpirationTime = &expirationTime
+	if err := e.k8sClient.Status().Patch(ctx, report, patch); err != nil {
+		return err
+	}
+
+	return e.pruneReports(ctx)
+}
+
+// RunApproved takes the action listed in the approved CleaningReport
+// reportName on its resources, except those that changed or were removed
+// since the report was created, and records what was done in a new
+// CleaningReport. The report is read from the API server, as a stale copy
+// could have the action taken twice, and it is refused if its spec or
+// snapshots no longer match the digest recorded when it was created, or if
+// it expired.
+func (e *Executor) RunApproved(ctx context.Context, reportName string) (*models.RunSummary, error) {
+	summary := &models.RunSummary{DryRun: e.cleaner.Spec.DryRun}
+
+	approved := &cleanyv1alpha1.CleaningReport{}
+	if err := e.apiReader.Get(ctx, client.ObjectKey{Namespace: e.cleaner.Namespace, Name: reportName},
+		approved); err != nil {
+		return summary, err
+	}
+	if approved.Annotations[cleanyv1alpha1.ApprovedAnnotation] != "true" ||
+		(approved.Status.Phase != cleanyv1alpha1.ApprovalPhasePending &&
+			approved.Status.Phase != cleanyv1alpha1.ApprovalPhaseApproved) {
+		return summary, fmt.Errorf("CleaningReport %s is not approved", reportName)
+	}
+	resourceInfo, snapshots, err := LoadResources(ctx, e.apiReader, approved)
+	if err != nil {
+		return summary, err
+	}
+	if approved.Status.Digest == "" || approved.Status.Digest != reportDigest(&approved.Spec, resourceInfo, snapshots) {
+		return summary, e.refuseApproved(ctx, approved, cleanyv1alpha1.ApprovalPhaseFailed,
+			"the resources or action listed changed since approval was requested")
+	}
+	if expiration := approved.Status.ExpirationTime; expiration != nil && !time.Now().Before(expiration.Time) {
+		return summary, e.refuseApproved(ctx, approved, cleanyv1alpha1.ApprovalPhaseExpired,
+			"expired before the approved action could be taken")
+	}
+	summary.Matched = len(resourceInfo)
+
+	// Verify each resource is still the one that was approved
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(e.discoveryClient))
+	var resources []models.ResourceResult
+	var untouched []cleanyv1alpha1.ResourceInfo
+	for i := range resourceInfo {
+		info := resourceInfo[i].DeepCopy()
+		result, reason, err := e.current(ctx, mapper, info)
+		switch {
+		case err != nil:
+			summary.Failed++
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s %s: %v",
+				info.Resource.Kind, objectName(info.Resource.Namespace, info.Resource.Name), err))
+			info.Message = err.Error()
+			untouched = append(untouched, *info)
+		case reason != "":
+			summary.Skipped++
+			info.SkipReason = reason
+			untouched = append(untouched, *info)
+		default:
+			if result.Action == "" {
+				result.Action = approved.Spec.Action
+			}
+			resources = append(resources, *result)
+		}
+	}
+
+	// the resources approved are acted on one by one, never as a collection
+	err = e.act(ctx, resources, untouched, false, summary)
+
+	// Record the outcome on the approved report
+	patch := client.MergeFrom(approved.DeepCopy())
+	approved.Status.Phase = cleanyv1alpha1.ApprovalPhaseExecuted
+	approved.Status.ExecutionReport = summary.ReportName
+	approved.Status.Message = ""
+	if err != nil {
+		approved.Status.Phase = cleanyv1alpha1.ApprovalPhaseFailed
+		approved.Status.Message = err.Error()
+	}
+	if patchErr := e.k8sClient.Status().Patch(ctx, approved, patch); patchErr != nil && err == nil {
+		err = patchErr
+	}
+	if err != nil {
+		return summary, err
+	}
+
+	return summary, e.pruneReports(ctx)
+}
+
+// refuseApproved records on the approved report why its action is not
+// taken, and returns it as an error.
+func (e *Executor) refuseApproved(ctx context.Context, approved *cleanyv1alpha1.CleaningReport,
+	phase cleanyv1alpha1.ApprovalPhase, message string,
+) error {
+	patch := client.MergeFrom(approved.DeepCopy())
+	approved.Status.Phase = phase
+	approved.Status.Message = message
+	if err := e.k8sClient.Status().Patch(ctx, approved, patch); err != nil {
+		return err
+	}
+	return fmt.Errorf("CleaningReport %s: %s", approved.Name, message)
+}
+
+// current returns the resource described by info, or why it cannot be
+// acted on anymore: it was removed or changed since info was recorded.
+func (e *Executor) current(ctx context.Context, mapper meta.RESTMapper, info *cleanyv1alpha1.ResourceInfo,
+) (*models.ResourceResult, string, error) {
+	gv, err := schema.ParseGroupVersion(info.Resource.APIVersion)
+	if err != nil {
+		return nil, "", err
+	}
+	mapping, err := mapper.RESTMapping(gv.WithKind(info.Resource.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	obj, err := e.dynamicClient.Resource(mapping.Resource).Namespace(info.Resource.Namespace).
+		Get(ctx, info.Resource.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, "removed since the report was created", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if obj.GetUID() != info.Resource.UID || obj.GetResourceVersion() != info.Resource.ResourceVersion {
+		return nil, "changed since the report was created", nil
+	}
+
+	return &models.ResourceResult{
+		Resource: obj,
+		GVR:      mapping.Resource,
+		Message:  info.Message,
+		Action:   info.Action,
+		Severity: info.Severity,
+		Details:  info.Details,
+	}, "", nil
+}
@@ -0,0 +1,219 @@
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func TestApproval(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	var objects []runtime.Object
+	var resources []models.ResourceResult
+	for _, name := range []string{"unchanged", "changed", "removed"} {
+		obj := newObject("v1", "ConfigMap", "default", name)
+		obj.SetResourceVersion("1")
+		objects = append(objects, obj)
+		resources = append(resources, models.ResourceResult{Resource: obj.DeepCopy(), GVR: configMaps})
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme, objects...)
+	discovery := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{{Name: "configmaps", Kind: "ConfigMap", Namespaced: true}},
+	}}}}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build()
+
+	cleaner := newLibraryCleaner()
+	cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+	cleaner.Spec.Approval = &cleanyv1alpha1.Approval{Expiry: metav1.Duration{Duration: time.Hour}}
+	e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+		protection: NewProtection(config.New()), snapshotInlineLimit: config.New().SnapshotInlineLimit,
+		throttle: &throttle{}, k8sClient: k8sClient, apiReader: k8sClient, dynamicClient: dynamicClient,
+		discoveryClient: discovery, scheme: scheme, resourceHelper: &fakeResourceHelper{resources: resources}}
+
+	// the run only creates a pending report
+	summary, err := e.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !summary.PendingApproval || summary.Deleted != 0 {
+		t.Fatalf("expected the run to await approval, got %+v", summary)
+	}
+	pending := &cleanyv1alpha1.CleaningReport{}
+	pendingKey := client.ObjectKey{Namespace: "default", Name: summary.ReportName}
+	if err := k8sClient.Get(ctx, pendingKey, pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status.Phase != cleanyv1alpha1.ApprovalPhasePending || pending.Status.ExpirationTime == nil ||
+		pending.Status.Digest == "" ||
+		pending.Spec.Action != cleanyv1alpha1.ActionDelete || len(pending.Spec.ResourceInfo) != 3 {
+		t.Fatalf("expected a pending report of the deletions, got %+v", pending)
+	}
+
+	if _, err := e.RunApproved(ctx, pending.Name); err == nil {
+		t.Fatal("expected the action of a report not approved to be refused")
+	}
+
+	// the resources change after the report is created
+	changed := objects[1].DeepCopyObject().(client.Object)
+	changed.SetResourceVersion("2")
+	if err := dynamicClient.Tracker().Update(configMaps, changed, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dynamicClient.Tracker().Delete(configMaps, "default", "removed"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending.Annotations = map[string]string{cleanyv1alpha1.ApprovedAnnotation: "true"}
+	if err := k8sClient.Update(ctx, pending); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = e.RunApproved(ctx, pending.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Deleted != 1 || summary.Skipped != 2 || summary.Failed != 0 {
+		t.Errorf("expected only the unchanged resource to be deleted, got %+v", summary)
+	}
+	if _, err := dynamicClient.Tracker().Get(configMaps, "default", "unchanged"); err == nil {
+		t.Error("expected the unchanged resource to be deleted")
+	}
+
+	if err := k8sClient.Get(ctx, pendingKey, pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status.Phase != cleanyv1alpha1.ApprovalPhaseExecuted || pending.Status.ExecutionReport == "" ||
+		pending.Status.ExecutionReport != summary.ReportName {
+		t.Errorf("expected the approved report to be executed, got %+v", pending.Status)
+	}
+	executed := &cleanyv1alpha1.CleaningReport{}
+	if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: summary.ReportName},
+		executed); err != nil {
+		t.Fatal(err)
+	}
+	skipped := map[string]string{}
+	for _, info := range executed.Spec.ResourceInfo {
+		skipped[info.Resource.Name] = info.SkipReason
+	}
+	if skipped["unchanged"] != "" || skipped["changed"] == "" || skipped["removed"] == "" {
+		t.Errorf("expected changed and removed resources to be skipped, got %v", skipped)
+	}
+
+	if _, err := e.RunApproved(ctx, pending.Name); err == nil {
+		t.Error("expected an executed report to not be run again")
+	}
+}
+
+func TestApprovalRefused(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	listed := newObject("v1", "ConfigMap", "default", "listed")
+	other := newObject("v1", "ConfigMap", "default", "other")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme, listed, other)
+
+	// modify changes the spec of the report, modifyStatus its status
+	tests := []struct {
+		name         string
+		modify       func(report *cleanyv1alpha1.CleaningReport)
+		modifyStatus func(report *cleanyv1alpha1.CleaningReport)
+		phase        cleanyv1alpha1.ApprovalPhase
+	}{
+		{"resource added", func(report *cleanyv1alpha1.CleaningReport) {
+			report.Spec.ResourceInfo = append(report.Spec.ResourceInfo, cleanyv1alpha1.ResourceInfo{
+				Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default",
+					Name: "other", UID: other.GetUID()},
+			})
+		}, nil, cleanyv1alpha1.ApprovalPhaseFailed},
+		{"action changed", func(report *cleanyv1alpha1.CleaningReport) {
+			report.Spec.Action = cleanyv1alpha1.ActionTransform
+		}, nil, cleanyv1alpha1.ApprovalPhaseFailed},
+		{"expired", nil, func(report *cleanyv1alpha1.CleaningReport) {
+			expirationTime := metav1.NewTime(time.Now().Add(-time.Minute))
+			report.Status.ExpirationTime = &expirationTime
+		}, cleanyv1alpha1.ApprovalPhaseExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+				WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build()
+			cleaner := newLibraryCleaner()
+			cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+			cleaner.Spec.Approval = &cleanyv1alpha1.Approval{Expiry: metav1.Duration{Duration: time.Hour}}
+			e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+				protection: NewProtection(config.New()), snapshotInlineLimit: config.New().SnapshotInlineLimit,
+				throttle: &throttle{}, k8sClient: k8sClient, apiReader: k8sClient, dynamicClient: dynamicClient,
+				scheme: scheme, resourceHelper: &fakeResourceHelper{resources: []models.ResourceResult{
+					{Resource: listed.DeepCopy(), GVR: configMaps},
+				}}}
+
+			summary, err := e.Run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := &cleanyv1alpha1.CleaningReport{}
+			key := client.ObjectKey{Namespace: "default", Name: summary.ReportName}
+			if err := k8sClient.Get(ctx, key, report); err != nil {
+				t.Fatal(err)
+			}
+
+			// the report is changed along with its approval
+			if tt.modifyStatus != nil {
+				tt.modifyStatus(report)
+				if err := k8sClient.Status().Update(ctx, report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.modify != nil {
+				tt.modify(report)
+			}
+			report.Annotations = map[string]string{cleanyv1alpha1.ApprovedAnnotation: "true"}
+			if err := k8sClient.Update(ctx, report); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := e.RunApproved(ctx, report.Name); err == nil {
+				t.Fatal("expected the action to be refused")
+			}
+			for _, obj := range []string{"listed", "other"} {
+				if _, err := dynamicClient.Tracker().Get(configMaps, "default", obj); err != nil {
+					t.Errorf("expected %s to be left untouched, got %v", obj, err)
+				}
+			}
+			if err := k8sClient.Get(ctx, key, report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Status.Phase != tt.phase {
+				t.Errorf("expected phase %s, got %s: %s", tt.phase, report.Status.Phase, report.Status.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"context"
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor/models"
+	"github.com/wys1203/Cleany/internal/executor/resource"
+	"github.com/wys1203/Cleany/internal/metrics"
+)
+
+// collectionKey identifies the resources of a kind in a namespace
+type collectionKey struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+// collectionKinds are the kinds deleted with DeleteCollection requests.
+// The API server evaluates the label selector again when deleting, so the
+// resources created, or annotated as protected, after the run listed them
+// are deleted as well: this is only acceptable for Events, which are short
+// lived and recreated by their source.
+var collectionKinds = []schema.GroupKind{{Kind: "Event"}, {Group: "events.k8s.io", Kind: "Event"}}
+
+// collectionSelectors returns, by kind, the resource selectors whose
+// resources can be deleted with a DeleteCollection request for each
+// namespace: they select Events by labels only, and the Cleaner deletes
+// everything they select right away. Events created or protected after the
+// run listed them are deleted along with the others.
+func (e *Executor) collectionSelectors() map[schema.GroupKind]*cleanyv1alpha1.ResourceSelector {
+	spec := &e.cleaner.Spec
+	if e.action() != cleanyv1alpha1.ActionDelete || spec.DryRun || spec.Approval != nil || spec.Limits != nil ||
+		spec.Deletion != nil {
+		return nil
+	}
+	policySet := &spec.ResourcePolicySet
+	if policySet.AggregatedSelection != "" || policySet.AggregatedSelectionCEL != "" {
+		return nil
+	}
+
+	selectors := make(map[schema.GroupKind]*cleanyv1alpha1.ResourceSelector)
+	count := make(map[schema.GroupKind]int)
+	for i := range policySet.ResourceSelectors {
+		selector := &policySet.ResourceSelectors[i]
+		gk := schema.GroupKind{Group: selector.Group, Kind: selector.Kind}
+		count[gk]++
+		if slices.Contains(collectionKinds, gk) && selector.Evaluate == "" && selector.EvaluateCEL == "" {
+			selectors[gk] = selector
+		}
+	}
+	// a resource selected by several selectors cannot be told apart
+	for gk := range selectors {
+		if count[gk] > 1 {
+			delete(selectors, gk)
+		}
+	}
+	return selectors
+}
+
+// deleteCollections deletes the resources of the selectors returned by
+// collectionSelectors with a DeleteCollection request for each kind and
+// namespace. It returns what was done, along with the resources left to be
+// processed one by one: those of a namespace holding a protected resource,
+// to be skipped, or whose DeleteCollection request failed.
+func (e *Executor) deleteCollections(ctx context.Context, resources []models.ResourceResult,
+	summary *models.RunSummary,
+) ([]cleanyv1alpha1.ResourceInfo, []models.ResourceResult, error) {
+	selectors := e.collectionSelectors()
+	if len(selectors) == 0 {
+		return nil, resources, nil
+	}
+
+	var keys []collectionKey
+	collections := make(map[collectionKey][]models.ResourceResult)
+	protected := make(map[collectionKey]bool)
+	var remaining []models.ResourceResult
+	for i := range resources {
+		if _, ok := selectors[resources[i].Resource.GroupVersionKind().GroupKind()]; !ok {
+			remaining = append(remaining, resources[i])
+			continue
+		}
+		key := collectionKey{gvr: resources[i].GVR, namespace: resources[i].Resource.GetNamespace()}
+		if _, ok := collections[key]; !ok {
+			keys = append(keys, key)
+		}
+		collections[key] = append(collections[key], resources[i])
+		if e.protection.Reason(resources[i].Resource) != "" {
+			protected[key] = true
+		}
+	}
+
+	var resourceInfo []cleanyv1alpha1.ResourceInfo
+	for _, key := range keys {
+		collection := collections[key]
+		if protected[key] {
+			remaining = append(remaining, collection...)
+			continue
+		}
+
+		selector := selectors[collection[0].Resource.GroupVersionKind().GroupKind()]
+		listOptions := metav1.ListOptions{LabelSelector: resource.LabelFilter(selector)}
+		err := e.throttle.do(ctx, func() error {
+			return e.dynamicClient.Resource(key.gvr).Namespace(key.namespace).
+				DeleteCollection(ctx, metav1.DeleteOptions{}, listOptions)
+		})
+		if err != nil {
+			// e.g. the deletecollection verb is not allowed
+			remaining = append(remaining, collection...)
+			continue
+		}
+
+		for i := range collection {
+			info, err := newResourceInfo(&collection[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			resourceInfo = append(resourceInfo, *info)
+			e.recordObjectEvent(collection[i].Resource, cleanyv1alpha1.ActionDelete)
+			metrics.CountObject(metrics.ObjectsDeleted, collection[i].Resource.GroupVersionKind())
+		}
+		summary.Deleted += len(collection)
+	}
+	return resourceInfo, remaining, nil
+}
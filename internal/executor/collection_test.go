@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func TestDeleteCollections(t *testing.T) {
+	events := schema.GroupVersionResource{Version: "v1", Resource: "events"}
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	newResult := func(gvr schema.GroupVersionResource, kind, namespace, name string) models.ResourceResult {
+		return models.ResourceResult{Resource: newObject("v1", kind, namespace, name), GVR: gvr}
+	}
+	protected := newResult(events, "Event", "b", "protected")
+	protected.Resource.SetAnnotations(map[string]string{cleanyv1alpha1.ProtectAnnotation: "true"})
+	resources := []models.ResourceResult{
+		newResult(events, "Event", "a", "first"),
+		newResult(pods, "Pod", "a", "web"),
+		newResult(events, "Event", "a", "second"),
+		newResult(events, "Event", "b", "third"),
+		protected,
+		newResult(configMaps, "ConfigMap", "a", "settings"),
+	}
+	// the ConfigMap is protected after the run listed it
+	settings := resources[5].Resource.DeepCopy()
+	settings.SetAnnotations(map[string]string{cleanyv1alpha1.ProtectAnnotation: "true"})
+
+	newCleaner := func() *cleanyv1alpha1.Cleaner {
+		cleaner := newLibraryCleaner()
+		cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+		cleaner.Spec.ResourcePolicySet.ResourceSelectors = []cleanyv1alpha1.ResourceSelector{
+			{Kind: "Event", Version: "v1", LabelFilters: []libsveltosv1alpha1.LabelFilter{
+				{Key: "app", Operation: libsveltosv1alpha1.OperationEqual, Value: "web"}}},
+			{Kind: "Pod", Version: "v1", Evaluate: "function evaluate() return {matching = true} end"},
+			{Kind: "ConfigMap", Version: "v1", LabelFilters: []libsveltosv1alpha1.LabelFilter{
+				{Key: "app", Operation: libsveltosv1alpha1.OperationEqual, Value: "web"}}},
+		}
+		return cleaner
+	}
+	limited := newCleaner()
+	limited.Spec.Limits = &cleanyv1alpha1.Limits{}
+	ambiguous := newCleaner()
+	ambiguous.Spec.ResourcePolicySet.ResourceSelectors = append(ambiguous.Spec.ResourcePolicySet.ResourceSelectors,
+		cleanyv1alpha1.ResourceSelector{Kind: "Event", Version: "v1", Namespace: "b"})
+
+	tests := []struct {
+		name        string
+		cleaner     *cleanyv1alpha1.Cleaner
+		collections []string
+		remaining   int
+	}{
+		{"label selection", newCleaner(), []string{"a"}, 4},
+		{"limits", limited, nil, 6},
+		{"kind selected twice", ambiguous, nil, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{events: "EventList", configMaps: "ConfigMapList"}, settings)
+			e := &Executor{cleaner: tt.cleaner, protection: NewProtection(config.New()), throttle: &throttle{},
+				dynamicClient: dynamicClient}
+
+			summary := &models.RunSummary{}
+			recorded, remaining, err := e.deleteCollections(context.Background(), resources, summary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(remaining) != tt.remaining {
+				t.Errorf("expected %d resources left, got %d", tt.remaining, len(remaining))
+			}
+			if len(recorded) != summary.Deleted || len(recorded)+len(remaining) != len(resources) {
+				t.Errorf("expected the %d resources deleted to be recorded, got %d", summary.Deleted, len(recorded))
+			}
+
+			var collections []string
+			for _, action := range dynamicClient.Actions() {
+				if action, ok := action.(clienttesting.DeleteCollectionAction); ok {
+					collections = append(collections, action.GetNamespace())
+					if action.GetResource() != events {
+						t.Errorf("expected only Events to be deleted by collection, got %v", action.GetResource())
+					}
+					if selector := action.GetListRestrictions().Labels.String(); selector != "app=web" {
+						t.Errorf("expected label selector app=web, got %q", selector)
+					}
+				}
+			}
+			if !reflect.DeepEqual(collections, tt.collections) {
+				t.Errorf("expected collections deleted in %v, got %v", tt.collections, collections)
+			}
+			if _, err := dynamicClient.Tracker().Get(configMaps, "a", "settings"); err != nil {
+				t.Errorf("expected the ConfigMap protected after listing to be kept: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package executor
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+// maxObjectEvents is the number of Events recorded on the resources acted
+// on by a run, see ObjectEvents
+const maxObjectEvents = 50
+
+// recordObjectEvent records an Event on obj, deleted or transformed by the
+// run, if the Cleaner asks for it and the run did not record too many yet.
+func (e *Executor) recordObjectEvent(obj *unstructured.Unstructured, action cleanyv1alpha1.Action) {
+	if !e.cleaner.Spec.ObjectEvents || e.cleaner.Spec.DryRun {
+		return
+	}
+	e.objectEvents++
+	if e.objectEvents > maxObjectEvents {
+		return
+	}
+	if action == cleanyv1alpha1.ActionTransform {
+		e.recorder.Eventf(obj, corev1.EventTypeNormal, "TransformedByCleaner", "Transformed by %s", e.ownerName())
+		return
+	}
+	e.recorder.Eventf(obj, corev1.EventTypeNormal, "DeletedByCleaner", "Deleted by %s", e.ownerName())
+}
+
+// recordOmittedObjectEvents records a single Event on the owner for the
+// resources acted on beyond maxObjectEvents.
+func (e *Executor) recordOmittedObjectEvents() {
+	if omitted := e.objectEvents - maxObjectEvents; omitted > 0 {
+		e.recorder.Eventf(e.owner, corev1.EventTypeNormal, "ObjectEventsOmitted",
+			"%d more resources were deleted or transformed, without an Event on each", omitted)
+	}
+	e.objectEvents = 0
+}
+
+// ownerName returns the kind and name of the owner.
+func (e *Executor) ownerName() string {
+	kind := "Cleaner"
+	if _, ok := e.owner.(*cleanyv1alpha1.NamespacedCleaner); ok {
+		kind = "NamespacedCleaner"
+	}
+	return kind + " " + objectName(e.owner.GetNamespace(), e.owner.GetName())
+}
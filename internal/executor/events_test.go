@@ -0,0 +1,83 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func TestObjectEvents(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	var resources []models.ResourceResult
+	var objects []runtime.Object
+	for i := 0; i < maxObjectEvents+2; i++ {
+		obj := newObject("v1", "ConfigMap", "default", fmt.Sprintf("settings-%d", i))
+		resources = append(resources, models.ResourceResult{Resource: obj, GVR: gvr})
+		objects = append(objects, obj.DeepCopy())
+	}
+
+	tests := []struct {
+		name         string
+		objectEvents bool
+		dryRun       bool
+		events       []string
+	}{
+		{"disabled", false, false, nil},
+		{"dry run", true, true, nil},
+		{"enabled", true, false, []string{
+			"Normal DeletedByCleaner Deleted by Cleaner default/cleaner",
+			"Normal ObjectEventsOmitted 2 more resources were deleted or transformed, without an Event on each",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := newLibraryCleaner()
+			cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+			cleaner.Spec.ObjectEvents = tt.objectEvents
+			cleaner.Spec.DryRun = tt.dryRun
+			recorder := record.NewFakeRecorder(len(resources) + 1)
+			e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+				protection: NewProtection(config.New()), snapshotInlineLimit: config.New().SnapshotInlineLimit,
+				throttle: &throttle{}, recorder: recorder, k8sClient: fake.NewClientBuilder().WithScheme(scheme).
+						WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build(),
+				dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...), scheme: scheme}
+
+			if err := e.act(context.Background(), resources, nil, false, &models.RunSummary{}); err != nil {
+				t.Fatal(err)
+			}
+			close(recorder.Events)
+			count := make(map[string]int)
+			for event := range recorder.Events {
+				count[event]++
+			}
+			if len(tt.events) == 0 {
+				if len(count) != 0 {
+					t.Errorf("expected no Event, got %v", count)
+				}
+				return
+			}
+			if count[tt.events[0]] != maxObjectEvents || count[tt.events[1]] != 1 || len(count) != 2 {
+				t.Errorf("expected %d object Events and a single Event for the others, got %v", maxObjectEvents, count)
+			}
+		})
+	}
+}
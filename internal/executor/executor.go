@@ -2,83 +2,809 @@ package executor
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 
+	"golang.org/x/time/rate"
+	"gomodules.xyz/jsonpatch/v2"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
 	"github.com/wys1203/Cleany/internal/executor/resource"
+	"github.com/wys1203/Cleany/internal/metrics"
 )
 
 type Executor struct {
+	cleaner *cleanyv1alpha1.Cleaner
+
+	// owner is the Cleaner, or NamespacedCleaner, owning the reports
+	owner client.Object
+
+	// reportLabel is set on the reports to the name of owner
+	reportLabel string
+
+	luaLimits  resource.LuaLimits
+	luaModules resource.LuaModules
+
+	// protection prevents acting on protected resources
+	protection *Protection
+
+	// throttle paces the delete and update requests
+	throttle *throttle
+
+	// recorder records Events on the owner and, see ObjectEvents, on the
+	// resources acted on, objectEvents counting the latter
+	recorder     record.EventRecorder
+	objectEvents int
+
+	// snapshotInlineLimit is the size of the snapshots above which they
+	// are stored in Secrets rather than in the report
+	snapshotInlineLimit int
+
+	k8sClient       client.Client
+	apiReader       client.Reader
+	dynamicClient   dynamic.Interface
+	discoveryClient discovery.DiscoveryInterface
+	scheme          *runtime.Scheme
+
 	resourceHelper resource.IResourceHelper
 }
 
+// NewExecutor returns an Executor for the Cleaner identified by cleanerKey
+// or, if namespaced is set, for the NamespacedCleaner, which is run as its
+// AsCleaner view. The clients impersonate the ServiceAccount of the Cleaner,
+// if any. The delete and update requests are limited by limiter, shared by
+// all Executors, and by the rate limit of the Cleaner. Events are recorded
+// with recorder. apiReader reads the approved CleaningReports bypassing the
+// cache of k8sClient.
 func NewExecutor(
 	ctx context.Context,
-	cleanerName string,
-	config *rest.Config,
+	cleanerKey types.NamespacedName,
+	namespaced bool,
+	cfg *config.Config,
+	limiter *rate.Limiter,
+	recorder record.EventRecorder,
+	restConfig *rest.Config,
 	k8sClient client.Client,
+	apiReader client.Reader,
 	scheme *runtime.Scheme,
 ) (*Executor, error) {
 
 	// Get the cleaner instance
-	cleaner, err := getCleanerInstance(ctx, cleanerName, k8sClient)
-	if err != nil {
-		return nil, err
+	var cleaner *cleanyv1alpha1.Cleaner
+	var owner client.Object
+	reportLabel := cleanyv1alpha1.CleanerLabel
+	if namespaced {
+		namespacedCleaner, err := getNamespacedCleanerInstance(ctx, cleanerKey, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		cleaner = namespacedCleaner.AsCleaner()
+		owner = namespacedCleaner
+		reportLabel = cleanyv1alpha1.NamespacedCleanerLabel
+	} else {
+		var err error
+		cleaner, err = getCleanerInstance(ctx, cleanerKey, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		owner = cleaner
 	}
 
+	// Act with the permissions of the ServiceAccount of the cleaner
+	restConfig = CleanerRestConfig(restConfig, cleaner)
+
 	// Get the list of namespaces
 	namespaces, err := getNamespaceList(ctx, k8sClient)
 	if err != nil {
 		return nil, err
 	}
 
+	// Load the lua libraries of the cleaner
+	luaModules, _, err := LoadLuaLibraries(ctx, k8sClient, cleaner)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamicClient := dynamic.NewForConfigOrDie(restConfig)
+	discoveryClient := discovery.NewDiscoveryClientForConfigOrDie(restConfig)
+
 	// Create resource helper
 	resourceHelper := resource.NewResourceHelper(
-		cleaner.Spec.ResourcePolicySet.ResourceSelectors,
+		cleaner.Spec.ResourcePolicySet,
 		namespaces,
-		discovery.NewDiscoveryClientForConfigOrDie(config),
-		dynamic.NewForConfigOrDie(config),
+		discoveryClient,
+		dynamicClient,
+		listConcurrency(cfg),
+		luaLimits(cfg),
+		cfg.LuaMaxLookups,
+		luaModules,
 	)
 
 	return &Executor{
-		resourceHelper: resourceHelper,
+		cleaner:             cleaner,
+		owner:               owner,
+		reportLabel:         reportLabel,
+		luaLimits:           luaLimits(cfg),
+		luaModules:          luaModules,
+		protection:          NewProtection(cfg),
+		throttle:            newThrottle(limiter, cleaner),
+		recorder:            recorder,
+		snapshotInlineLimit: cfg.SnapshotInlineLimit,
+		k8sClient:           k8sClient,
+		apiReader:           apiReader,
+		dynamicClient:       dynamicClient,
+		discoveryClient:     discoveryClient,
+		scheme:              scheme,
+		resourceHelper:      resourceHelper,
 	}, nil
 }
 
-func (e *Executor) Run(ctx context.Context) error {
+// Run selects the matching resources, takes the Cleaner action on each of
+// them and records what was done in a CleaningReport.
+func (e *Executor) Run(ctx context.Context) (*models.RunSummary, error) {
+	summary := &models.RunSummary{DryRun: e.cleaner.Spec.DryRun}
+
 	// Fetch all resources matching the selector
-	resources, err := e.resourceHelper.FetchMatchingResources(ctx)
+	resources, listed, err := e.resourceHelper.FetchMatchingResources(ctx)
+	if err != nil {
+		return summary, err
+	}
+	summary.Matched = len(resources)
+	for i := range resources {
+		metrics.CountObject(metrics.ObjectsMatched, resources[i].Resource.GroupVersionKind())
+	}
+
+	// Only report the resources when acting on them would exceed the limits
+	if !e.cleaner.Spec.DryRun {
+		reason, err := e.exceededLimit(resources, listed)
+		if err != nil {
+			return summary, err
+		}
+		if reason != "" {
+			summary.LimitExceeded = reason
+			e.recorder.Event(e.owner, corev1.EventTypeWarning, "LimitExceeded", reason)
+			if _, err := e.reportOnly(ctx, resources, cleanyv1alpha1.ActionScan, reason, summary); err != nil {
+				return summary, err
+			}
+			return summary, e.pruneReports(ctx)
+		}
+	}
+
+	// Wait for the approval of what would be done
+	if e.cleaner.Spec.Approval != nil && len(resources) != 0 {
+		return summary, e.requestApproval(ctx, resources, summary)
+	}
+
+	if err := e.act(ctx, resources, nil, true, summary); err != nil {
+		return summary, err
+	}
+
+	return summary, e.pruneReports(ctx)
+}
+
+// act takes the action on each resource and records what was done, along
+// with the resources left untouched, in a CleaningReport. The report and the
+// snapshots of the resources are stored before any of them is acted on, and
+// the run is aborted if they cannot be. Whole collections are deleted at
+// once where the selection allows it, if collections is set.
+func (e *Executor) act(
+	ctx context.Context,
+	resources []models.ResourceResult,
+	untouched []cleanyv1alpha1.ResourceInfo,
+	collections bool,
+	summary *models.RunSummary,
+) (err error) {
+	if len(resources)+len(untouched) == 0 {
+		return nil
+	}
+
+	// compile the transform script once for all resources, the evaluate
+	// function can select the Transform action for some resources only
+	var transform *resource.LuaScript
+	if e.action() == cleanyv1alpha1.ActionTransform || e.cleaner.Spec.Transform != "" {
+		transform, err = resource.CompileLuaScript("transform", e.cleaner.Spec.Transform, e.luaLimits)
+		if err != nil {
+			return err
+		}
+		transform.UseModules(e.luaModules)
+		defer transform.Close()
+	}
+
+	// Record what the run is about to do
+	resourceInfo := make([]cleanyv1alpha1.ResourceInfo, 0, len(resources)+len(untouched))
+	for i := range resources {
+		info, err := newResourceInfo(&resources[i])
+		if err != nil {
+			return err
+		}
+		resourceInfo = append(resourceInfo, *info)
+	}
+	resourceInfo = append(resourceInfo, untouched...)
+	report, err := e.createReport(ctx, e.action(), "", resourceInfo, true)
+	if err != nil {
+		return fmt.Errorf("recording the run before acting: %w", err)
+	}
+	summary.ReportName = report.Name
+
+	// the outcome of each resource replaces what was recorded, at the
+	// same index, once the run is done or fails
+	indexes := make(map[corev1.ObjectReference][]int, len(resourceInfo))
+	for i := range resourceInfo {
+		indexes[resourceInfo[i].Resource] = append(indexes[resourceInfo[i].Resource], i)
+	}
+	outcome := func(info *cleanyv1alpha1.ResourceInfo) {
+		if i := indexes[info.Resource]; len(i) > 0 {
+			resourceInfo[i[0]] = *info
+			indexes[info.Resource] = i[1:]
+		}
+	}
+	defer func() {
+		if finishErr := e.finishReport(ctx, report, resourceInfo); err == nil {
+			err = finishErr
+		}
+	}()
+
+	if collections {
+		var recorded []cleanyv1alpha1.ResourceInfo
+		if recorded, resources, err = e.deleteCollections(ctx, resources, summary); err != nil {
+			return err
+		}
+		for i := range recorded {
+			outcome(&recorded[i])
+		}
+	}
+	stages, gc := e.deletionStages(resources)
+
+	// handle processes result, unless the previous stage is not gone, and
+	// records what was done
+	var deleted []*models.ResourceResult
+	gone := make(map[types.UID]bool)
+	var waitErr error
+	handle := func(result *models.ResourceResult) error {
+		if waitErr != nil {
+			info, err := newResourceInfo(result)
+			if err != nil {
+				return err
+			}
+			info.SkipReason = fmt.Sprintf("the previous stage is not gone: %v", waitErr)
+			summary.Skipped++
+			outcome(info)
+			return nil
+		}
+		info, err := e.process(ctx, result, transform, summary)
+		if err != nil {
+			summary.Failed++
+			metrics.CountObject(metrics.ObjectsFailed, result.Resource.GroupVersionKind())
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s %s: %v",
+				info.Resource.Kind, objectName(info.Resource.Namespace, info.Resource.Name), err))
+			info.Message = err.Error()
+		} else if info.SkipReason == "" && e.actionOf(result) == cleanyv1alpha1.ActionDelete {
+			deleted = append(deleted, result)
+			gone[result.Resource.GetUID()] = true
+		}
+		outcome(info)
+		return nil
+	}
+
+	// Process each resource, stage after stage
+	for s, stage := range stages {
+		if s > 0 && e.waitForStages() && waitErr == nil {
+			if waitErr = e.waitDeleted(ctx, deleted); waitErr != nil {
+				summary.Errors = append(summary.Errors, fmt.Sprintf("waiting for stage %d: %v", s, waitErr))
+			}
+		}
+		deleted = nil
+		for _, result := range stage {
+			if err := handle(result); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The resources left to the garbage collector are only reported as such
+	// once all their owners are deleted, and processed as the others when
+	// one of them is not
+	for len(gc) > 0 {
+		waiting := make(map[types.UID]bool, len(gc))
+		for _, c := range gc {
+			waiting[c.result.Resource.GetUID()] = true
+		}
+		var next []collected
+		for _, c := range gc {
+			switch ownersGone(c.result, gone, waiting) {
+			case ownersPending:
+				next = append(next, c)
+			case ownersDeleted:
+				info, err := newResourceInfo(c.result)
+				if err != nil {
+					return err
+				}
+				info.SkipReason = fmt.Sprintf("deleted with its owner %s by the garbage collector", c.owner)
+				summary.Skipped++
+				outcome(info)
+				gone[c.result.Resource.GetUID()] = true
+			default:
+				if err := handle(c.result); err != nil {
+					return err
+				}
+			}
+		}
+		if len(next) == len(gc) {
+			// they own each other
+			for _, c := range next {
+				if err := handle(c.result); err != nil {
+					return err
+				}
+			}
+			next = nil
+		}
+		gc = next
+	}
+	e.recordOmittedObjectEvents()
+	return nil
+}
+
+// action returns the action of the Cleaner.
+func (e *Executor) action() cleanyv1alpha1.Action {
+	if e.cleaner.Spec.Action == "" {
+		return cleanyv1alpha1.ActionDelete
+	}
+	return e.cleaner.Spec.Action
+}
+
+// actionOf returns the action taken on result, which the evaluate function
+// can override.
+func (e *Executor) actionOf(result *models.ResourceResult) cleanyv1alpha1.Action {
+	if result.Action != "" {
+		return result.Action
+	}
+	return e.action()
+}
+
+// waitForStages returns whether each deletion stage must be gone before
+// the next one is processed.
+func (e *Executor) waitForStages() bool {
+	return e.cleaner.Spec.Deletion != nil && e.cleaner.Spec.Deletion.WaitForStages && !e.cleaner.Spec.DryRun
+}
+
+// exceededLimit returns why deleting or transforming the selected resources
+// would exceed the Cleaner limits, given the number of resources listed
+// before evaluation, or an empty string if it would not.
+func (e *Executor) exceededLimit(resources []models.ResourceResult, listed int) (string, error) {
+	limits := e.cleaner.Spec.Limits
+	if limits == nil {
+		return "", nil
+	}
+
+	// resources left untouched do not count
+	count := 0
+	for i := range resources {
+		if e.actionOf(&resources[i]) != cleanyv1alpha1.ActionScan && e.protection.Reason(resources[i].Resource) == "" {
+			count++
+		}
+	}
+
+	if limits.MaxObjectsPerRun != nil && count > int(*limits.MaxObjectsPerRun) {
+		return fmt.Sprintf("%d resources to act on exceed maxObjectsPerRun %d", count, *limits.MaxObjectsPerRun), nil
+	}
+	if limits.MaxFractionOfSelected != "" {
+		fraction, err := strconv.ParseFloat(limits.MaxFractionOfSelected, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid maxFractionOfSelected: %w", err)
+		}
+		if float64(count) > fraction*float64(listed) {
+			return fmt.Sprintf("%d resources to act on out of %d listed exceed maxFractionOfSelected %s",
+				count, listed, limits.MaxFractionOfSelected), nil
+		}
+	}
+	return "", nil
+}
+
+// reportOnly records the selected resources in a CleaningReport, with a
+// message explaining why the action was not taken, and returns the report.
+func (e *Executor) reportOnly(ctx context.Context, resources []models.ResourceResult, action cleanyv1alpha1.Action,
+	message string, summary *models.RunSummary,
+) (*cleanyv1alpha1.CleaningReport, error) {
+	resourceInfo := make([]cleanyv1alpha1.ResourceInfo, 0, len(resources))
+	for i := range resources {
+		info, err := newResourceInfo(&resources[i])
+		if err != nil {
+			return nil, err
+		}
+		resourceInfo = append(resourceInfo, *info)
+	}
+
+	report, err := e.createReport(ctx, action, message, resourceInfo, false)
+	if err != nil {
+		return nil, err
+	}
+	summary.ReportName = report.Name
+	return report.CleaningReport, nil
+}
+
+// process takes the Cleaner action on a single resource.
+func (e *Executor) process(
+	ctx context.Context,
+	result *models.ResourceResult,
+	transform *resource.LuaScript,
+	summary *models.RunSummary,
+) (*cleanyv1alpha1.ResourceInfo, error) {
+	obj := result.Resource
+	info, err := newResourceInfo(result)
 	if err != nil {
+		return info, err
+	}
+
+	resourceInterface := e.dynamicClient.Resource(result.GVR).Namespace(obj.GetNamespace())
+
+	action := e.actionOf(result)
+
+	var dryRun []string
+	if e.cleaner.Spec.DryRun {
+		dryRun = []string{metav1.DryRunAll}
+	}
+
+	if action == cleanyv1alpha1.ActionScan {
+		return info, nil
+	}
+
+	if reason := e.protection.Reason(obj); reason != "" {
+		info.SkipReason = reason
+		summary.Skipped++
+		return info, nil
+	}
+
+	switch action {
+	case cleanyv1alpha1.ActionTransform:
+		if transform == nil {
+			return info, fmt.Errorf("the Cleaner has no transform function")
+		}
+		original, updated, err := e.update(ctx, resourceInterface, obj, transform, dryRun)
+		if err != nil {
+			return info, err
+		}
+		if e.cleaner.Spec.DryRun {
+			if info.Diff, err = diff(original, updated); err != nil {
+				return info, err
+			}
+		}
+		summary.Transformed++
+		if !e.cleaner.Spec.DryRun {
+			metrics.CountObject(metrics.ObjectsTransformed, obj.GroupVersionKind())
+		}
+	default:
+		err := e.retryRequest(ctx, func() error {
+			return e.throttle.do(ctx, func() error {
+				return resourceInterface.Delete(ctx, obj.GetName(), metav1.DeleteOptions{DryRun: dryRun})
+			})
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return info, err
+		}
+		summary.Deleted++
+		if !e.cleaner.Spec.DryRun {
+			metrics.CountObject(metrics.ObjectsDeleted, obj.GroupVersionKind())
+		}
+	}
+
+	e.recordObjectEvent(obj, action)
+	return info, nil
+}
+
+// update transforms obj and updates it. On a conflict, the current version
+// of obj is transformed for the next attempt. It returns the version that
+// was transformed along with the updated resource.
+func (e *Executor) update(
+	ctx context.Context,
+	resourceInterface dynamic.ResourceInterface,
+	obj *unstructured.Unstructured,
+	transform *resource.LuaScript,
+	dryRun []string,
+) (*unstructured.Unstructured, *unstructured.Unstructured, error) {
+	current := obj
+	var updated *unstructured.Unstructured
+	err := e.retryRequest(ctx, func() error {
+		r := &resource.UnstructuredResource{Unstructured: *current}
+		transformed, err := r.Transform(ctx, transform)
+		if err != nil {
+			return err
+		}
+		err = e.throttle.do(ctx, func() error {
+			updated, err = resourceInterface.Update(ctx, transformed, metav1.UpdateOptions{DryRun: dryRun})
+			return err
+		})
+		if apierrors.IsConflict(err) {
+			latest, getErr := resourceInterface.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			if latest.GetUID() != obj.GetUID() {
+				return fmt.Errorf("replaced since it was selected")
+			}
+			current = latest
+		}
 		return err
+	})
+	return current, updated, err
+}
+
+// newResourceInfo describes a selected resource for a CleaningReport.
+func newResourceInfo(result *models.ResourceResult) (*cleanyv1alpha1.ResourceInfo, error) {
+	obj := result.Resource
+	info := &cleanyv1alpha1.ResourceInfo{
+		Resource: corev1.ObjectReference{
+			APIVersion:      obj.GetAPIVersion(),
+			Kind:            obj.GetKind(),
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Message:  result.Message,
+		Action:   result.Action,
+		Severity: result.Severity,
+		Details:  result.Details,
 	}
 
-	// Process each resource
-	for _, resource := range resources {
-		fmt.Println(resource)
+	fullResource, err := json.Marshal(obj.Object)
+	if err != nil {
+		return info, err
+	}
+	info.FullResource = fullResource
+	return info, nil
+}
+
+// runReport is the CleaningReport of a run, along with the snapshots of the
+// resources it lists by index, wherever they are stored, and the Secrets
+// storing them
+type runReport struct {
+	*cleanyv1alpha1.CleaningReport
+	snapshots map[int][]byte
+	secrets   []*corev1.Secret
+}
+
+// createReport creates a CleaningReport, owned by the owner, listing the
+// resources the run selected with the action taken on them, and stores
+// their snapshots. If inProgress is set, the run has yet to act on them and
+// records the outcome with finishReport. The report is deleted if its
+// snapshots cannot be stored.
+func (e *Executor) createReport(ctx context.Context, action cleanyv1alpha1.Action, message string,
+	resourceInfo []cleanyv1alpha1.ResourceInfo, inProgress bool,
+) (*runReport, error) {
+	// snapshots too large for the report, and the resources beyond
+	// maxReportResources, are stored once it exists
+	snapshots := inlineSnapshots(resourceInfo)
+	all := slices.Clone(resourceInfo)
+	resourceInfo, stored, storedResources := e.takeSnapshots(resourceInfo)
+
+	report := &cleanyv1alpha1.CleaningReport{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: e.cleaner.Name + "-",
+			Namespace:    e.cleaner.Namespace,
+			Labels: map[string]string{
+				e.reportLabel: e.cleaner.Name,
+			},
+		},
+		Spec: cleanyv1alpha1.CleaningReportSpec{
+			ResourceInfo: resourceInfo,
+			Action:       action,
+			DryRun:       e.cleaner.Spec.DryRun,
+			Message:      message,
+
+			StoredResources: len(storedResources),
+		},
+	}
+
+	if err := controllerutil.SetOwnerReference(e.owner, report, e.scheme); err != nil {
+		return nil, err
+	}
+
+	if stored != nil {
+		report.Spec.Snapshots = cleanyv1alpha1.SnapshotStoreSecrets
+	}
+
+	if err := e.k8sClient.Create(ctx, report); err != nil {
+		return nil, err
+	}
+
+	var secrets []*corev1.Secret
+	if stored != nil {
+		var err error
+		if secrets, err = e.storeSnapshots(ctx, report, stored, storedResources); err != nil {
+			if deleteErr := e.k8sClient.Delete(ctx, report); deleteErr != nil {
+				err = errors.Join(err, deleteErr)
+			}
+			return nil, err
+		}
+	}
+
+	// the digest is only recorded once the snapshots are stored: a report
+	// without one is never acted on nor restored
+	patch := client.MergeFrom(report.DeepCopy())
+	report.Status.Digest = reportDigest(&report.Spec, all, snapshots)
+	report.Status.InProgress = inProgress
+	if err := e.k8sClient.Status().Patch(ctx, report, patch); err != nil {
+		return nil, err
 	}
 
+	return &runReport{CleaningReport: report, snapshots: snapshots, secrets: secrets}, nil
+}
+
+// finishReport records in report the outcome of the run on the resources it
+// lists, resourceInfo in the same order, and the digest of the outcome.
+func (e *Executor) finishReport(ctx context.Context, report *runReport,
+	resourceInfo []cleanyv1alpha1.ResourceInfo,
+) error {
+	// the snapshots and resources stay where they were stored
+	inline := len(report.Spec.ResourceInfo)
+	for i := range resourceInfo {
+		resourceInfo[i].FullResource = nil
+		if i < inline {
+			resourceInfo[i].FullResource = report.Spec.ResourceInfo[i].FullResource
+		}
+	}
+	if err := e.updateStoredResources(ctx, report.secrets, resourceInfo); err != nil {
+		return fmt.Errorf("recording the outcome of the run: %w", err)
+	}
+	// the spec can only be updated while the report is in progress, and
+	// must not have changed since it was created
+	patch := client.MergeFromWithOptions(report.CleaningReport.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	report.Spec.ResourceInfo = resourceInfo[:inline]
+	if err := e.k8sClient.Patch(ctx, report.CleaningReport, patch); err != nil {
+		return fmt.Errorf("recording the outcome of the run: %w", err)
+	}
+
+	statusPatch := client.MergeFrom(report.CleaningReport.DeepCopy())
+	report.Status.Digest = reportDigest(&report.Spec, resourceInfo, report.snapshots)
+	report.Status.InProgress = false
+	return e.k8sClient.Status().Patch(ctx, report.CleaningReport, statusPatch)
+}
+
+// pruneReports deletes the oldest CleaningReports of the owner beyond the
+// ReportsHistoryLimit of the Cleaner.
+func (e *Executor) pruneReports(ctx context.Context) error {
+	limit := e.cleaner.Spec.ReportsHistoryLimit
+	if limit == nil {
+		return nil
+	}
+
+	reports := &cleanyv1alpha1.CleaningReportList{}
+	if err := e.k8sClient.List(ctx, reports, client.InNamespace(e.cleaner.Namespace),
+		client.MatchingLabels{e.reportLabel: e.cleaner.Name}); err != nil {
+		return err
+	}
+
+	excess := len(reports.Items) - int(*limit)
+	if excess <= 0 {
+		return nil
+	}
+
+	sort.Slice(reports.Items, func(i, j int) bool {
+		ti, tj := reports.Items[i].CreationTimestamp, reports.Items[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return reports.Items[i].Name < reports.Items[j].Name
+	})
+	for i := range reports.Items[:excess] {
+		if err := e.k8sClient.Delete(ctx, &reports.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting CleaningReport %s: %w", reports.Items[i].Name, err)
+		}
+	}
 	return nil
+}
+
+// diff returns the JSON patch from original to updated, ignoring the fields
+// maintained by the API server.
+func diff(original, updated *unstructured.Unstructured) (string, error) {
+	marshal := func(obj *unstructured.Unstructured) ([]byte, error) {
+		obj = obj.DeepCopy()
+		obj.SetManagedFields(nil)
+		obj.SetResourceVersion("")
+		return json.Marshal(obj.Object)
+	}
+	from, err := marshal(original)
+	if err != nil {
+		return "", err
+	}
+	to, err := marshal(updated)
+	if err != nil {
+		return "", err
+	}
+	patch, err := jsonpatch.CreatePatch(from, to)
+	if err != nil {
+		return "", err
+	}
+	if len(patch) == 0 {
+		return "", nil
+	}
+	sort.Sort(jsonpatch.ByPath(patch))
+	data, err := json.Marshal(patch)
+	return string(data), err
+}
+
+func luaLimits(cfg *config.Config) resource.LuaLimits {
+	return resource.LuaLimits{
+		CallTimeout:   cfg.LuaCallTimeout,
+		MaxStackSize:  cfg.LuaMaxStackSize,
+		MaxCallDepth:  cfg.LuaMaxCallDepth,
+		MaxStringSize: cfg.LuaMaxStringSize,
+		MaxTableSize:  cfg.LuaMaxTableSize,
+		MaxResultSize: cfg.LuaMaxResultSize,
+	}
+}
 
+func listConcurrency(cfg *config.Config) resource.ListConcurrency {
+	perResource := make(map[schema.GroupResource]int, len(cfg.ListConcurrencyPerResource))
+	for name, concurrency := range cfg.ListConcurrencyPerResource {
+		perResource[schema.ParseGroupResource(name)] = concurrency
+	}
+	return resource.ListConcurrency{
+		Default:     cfg.ListConcurrency,
+		PerResource: perResource,
+	}
 }
 
-func getCleanerInstance(ctx context.Context, cleanerName string, k8sClient client.Client) (*cleanyv1alpha1.Cleaner, error) {
+func getCleanerInstance(ctx context.Context, cleanerKey types.NamespacedName, k8sClient client.Client) (*cleanyv1alpha1.Cleaner, error) {
 	cleaner := new(cleanyv1alpha1.Cleaner)
-	err := k8sClient.Get(ctx, types.NamespacedName{Name: cleanerName}, cleaner)
+	err := k8sClient.Get(ctx, cleanerKey, cleaner)
+	if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	return cleaner, err
+}
+
+func getNamespacedCleanerInstance(ctx context.Context, cleanerKey types.NamespacedName, k8sClient client.Client,
+) (*cleanyv1alpha1.NamespacedCleaner, error) {
+	cleaner := new(cleanyv1alpha1.NamespacedCleaner)
+	err := k8sClient.Get(ctx, cleanerKey, cleaner)
 	if apierrors.IsNotFound(err) {
 		err = nil
 	}
 	return cleaner, err
 }
 
+// CleanerRestConfig returns restConfig impersonating the ServiceAccount of
+// the Cleaner, if any.
+func CleanerRestConfig(restConfig *rest.Config, cleaner *cleanyv1alpha1.Cleaner) *rest.Config {
+	ref := cleaner.Spec.ServiceAccountRef
+	if ref == nil {
+		return restConfig
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cleaner.Namespace
+	}
+	return impersonate(restConfig, namespace, ref.Name)
+}
+
+// impersonate returns a copy of restConfig impersonating the ServiceAccount.
+func impersonate(restConfig *rest.Config, namespace, name string) *rest.Config {
+	impersonated := rest.CopyConfig(restConfig)
+	impersonated.Impersonate = rest.ImpersonationConfig{UserName: serviceaccount.MakeUsername(namespace, name)}
+	return impersonated
+}
+
 func getNamespaceList(ctx context.Context, k8sClient client.Client) ([]corev1.Namespace, error) {
 	namespaceList := new(corev1.NamespaceList)
 	if err := k8sClient.List(ctx, namespaceList); err != nil {
@@ -93,3 +819,10 @@ func getNamespaceList(ctx context.Context, k8sClient client.Client) ([]corev1.Na
 	}
 	return result, nil
 }
+
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
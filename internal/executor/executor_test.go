@@ -0,0 +1,191 @@
+package executor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func newReport(name, cleaner string, age time.Duration) *cleanyv1alpha1.CleaningReport {
+	return &cleanyv1alpha1.CleaningReport{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            map[string]string{cleanyv1alpha1.CleanerLabel: cleaner},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+	}
+}
+
+func TestPruneReports(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newReport("oldest", "cleaner", 3*time.Hour),
+		newReport("old", "cleaner", 2*time.Hour),
+		newReport("recent", "cleaner", time.Hour),
+		newReport("other", "other", 4*time.Hour),
+	).Build()
+
+	cleaner := newLibraryCleaner()
+	e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel, k8sClient: k8sClient}
+	if err := e.pruneReports(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reports := &cleanyv1alpha1.CleaningReportList{}
+	if err := k8sClient.List(context.Background(), reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports.Items) != 4 {
+		t.Errorf("expected all reports to be kept without limit, got %d", len(reports.Items))
+	}
+
+	cleaner.Spec.ReportsHistoryLimit = ptr.To[int32](1)
+	if err := e.pruneReports(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := k8sClient.List(context.Background(), reports, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i := range reports.Items {
+		names = append(names, reports.Items[i].Name)
+	}
+	if len(names) != 2 || names[0] != "other" || names[1] != "recent" {
+		t.Errorf("expected the recent report and the report of the other cleaner to be kept, got %v", names)
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	restConfig := &rest.Config{Host: "https://cluster", BearerToken: "operator"}
+	impersonated := impersonate(restConfig, "team-a", "cleaner")
+	if impersonated.Impersonate.UserName != "system:serviceaccount:team-a:cleaner" {
+		t.Errorf("unexpected impersonated user %q", impersonated.Impersonate.UserName)
+	}
+	if impersonated.Host != restConfig.Host || impersonated.BearerToken != restConfig.BearerToken {
+		t.Errorf("expected the operator credentials to be kept, got %+v", impersonated)
+	}
+	if restConfig.Impersonate.UserName != "" {
+		t.Errorf("expected the operator config to be left unchanged")
+	}
+}
+
+// fakeResourceHelper returns fixed resources
+type fakeResourceHelper struct {
+	resources []models.ResourceResult
+	listed    int
+}
+
+func (h *fakeResourceHelper) FetchMatchingResources(context.Context) ([]models.ResourceResult, int, error) {
+	return h.resources, h.listed, nil
+}
+
+func TestRunLimitExceeded(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	var resources []models.ResourceResult
+	for _, name := range []string{"a", "b", "c"} {
+		resources = append(resources, models.ResourceResult{Resource: newObject("v1", "ConfigMap", "default", name)})
+	}
+	// scanned and protected resources do not count
+	resources = append(resources,
+		models.ResourceResult{Resource: newObject("v1", "ConfigMap", "default", "d"), Action: cleanyv1alpha1.ActionScan},
+		models.ResourceResult{Resource: newObject("v1", "ConfigMap", "kube-system", "e")})
+
+	tests := []struct {
+		name   string
+		limits cleanyv1alpha1.Limits
+		listed int
+		reason string
+	}{
+		{"max objects", cleanyv1alpha1.Limits{MaxObjectsPerRun: ptr.To[int32](2)}, 10, "maxObjectsPerRun"},
+		{"max fraction", cleanyv1alpha1.Limits{MaxFractionOfSelected: "0.2"}, 10, "maxFractionOfSelected"},
+		{"within limits", cleanyv1alpha1.Limits{MaxObjectsPerRun: ptr.To[int32](3), MaxFractionOfSelected: "0.3"},
+			10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+				WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build()
+			cleaner := newLibraryCleaner()
+			cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+			cleaner.Spec.Limits = &tt.limits
+			recorder := record.NewFakeRecorder(10)
+			e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+				protection: NewProtection(config.New()), snapshotInlineLimit: config.New().SnapshotInlineLimit,
+				throttle: &throttle{}, recorder: recorder, k8sClient: k8sClient, scheme: scheme,
+				resourceHelper: &fakeResourceHelper{resources: resources, listed: tt.listed}}
+
+			if tt.reason == "" {
+				reason, err := e.exceededLimit(resources, tt.listed)
+				if err != nil || reason != "" {
+					t.Errorf("expected run within limits, got %q %v", reason, err)
+				}
+				return
+			}
+
+			summary, err := e.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(summary.LimitExceeded, tt.reason) || summary.Deleted != 0 {
+				t.Errorf("expected the run to be aborted by %s, got %+v", tt.reason, summary)
+			}
+			if event := <-recorder.Events; !strings.HasPrefix(event, "Warning LimitExceeded") {
+				t.Errorf("expected a LimitExceeded Event, got %q", event)
+			}
+			report := &cleanyv1alpha1.CleaningReport{}
+			if err := k8sClient.Get(context.Background(),
+				client.ObjectKey{Namespace: "default", Name: summary.ReportName}, report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Spec.Action != cleanyv1alpha1.ActionScan || report.Spec.Message != summary.LimitExceeded ||
+				len(report.Spec.ResourceInfo) != len(resources) {
+				t.Errorf("expected a scan report of all selected resources, got %+v", report.Spec)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	original := newObject("v1", "ConfigMap", "default", "settings")
+	original.SetResourceVersion("1")
+	original.SetLabels(map[string]string{"app": "web", "stale": "true"})
+
+	updated := original.DeepCopy()
+	updated.SetResourceVersion("2")
+	updated.SetLabels(map[string]string{"app": "api"})
+	updated.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "cleany"}})
+
+	patch, err := diff(original, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"op":"replace","path":"/metadata/labels/app","value":"api"},` +
+		`{"op":"remove","path":"/metadata/labels/stale"}]`
+	if patch != expected {
+		t.Errorf("expected %s, got %s", expected, patch)
+	}
+
+	if patch, err := diff(original, original.DeepCopy()); err != nil || patch != "" {
+		t.Errorf("expected no diff, got %q %v", patch, err)
+	}
+}
@@ -0,0 +1,80 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor/resource"
+)
+
+// luaModuleSuffix is trimmed from the ConfigMap keys to get module names
+const luaModuleSuffix = ".lua"
+
+// LoadLuaLibraries reads and compiles the lua libraries referenced by the
+// Cleaner. It returns their modules, along with the version of each library.
+func LoadLuaLibraries(ctx context.Context, k8sClient client.Client, cleaner *cleanyv1alpha1.Cleaner,
+) (resource.LuaModules, []cleanyv1alpha1.LuaLibraryStatus, error) {
+	if len(cleaner.Spec.LuaLibraries) == 0 {
+		return nil, nil, nil
+	}
+
+	sources := make(map[string]string)
+	libraries := make(map[string]string)
+	statuses := make([]cleanyv1alpha1.LuaLibraryStatus, 0, len(cleaner.Spec.LuaLibraries))
+	for _, ref := range cleaner.Spec.LuaLibraries {
+		configMap := &corev1.ConfigMap{}
+		key := types.NamespacedName{Namespace: cleaner.Namespace, Name: ref.Name}
+		if err := k8sClient.Get(ctx, key, configMap); err != nil {
+			return nil, nil, fmt.Errorf("lua library %s: %w", ref.Name, err)
+		}
+
+		for key, source := range configMap.Data {
+			name := strings.TrimSuffix(key, luaModuleSuffix)
+			if library, ok := libraries[name]; ok {
+				return nil, nil, fmt.Errorf("lua module %s is defined by both lua libraries %s and %s",
+					name, library, ref.Name)
+			}
+			libraries[name] = ref.Name
+			sources[name] = source
+		}
+
+		statuses = append(statuses, cleanyv1alpha1.LuaLibraryStatus{
+			Name:            ref.Name,
+			ResourceVersion: configMap.ResourceVersion,
+			Hash:            libraryHash(configMap.Data),
+		})
+	}
+
+	modules, err := resource.CompileLuaModules(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	return modules, statuses, nil
+}
+
+// libraryHash returns the SHA-256 of data, independent of the map order.
+func libraryHash(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(data[key]))
+		h.Write([]byte{0})
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+func newLibrary(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       data,
+	}
+}
+
+func newLibraryCleaner(libraries ...string) *cleanyv1alpha1.Cleaner {
+	cleaner := &cleanyv1alpha1.Cleaner{ObjectMeta: metav1.ObjectMeta{Name: "cleaner", Namespace: "default"}}
+	for _, name := range libraries {
+		cleaner.Spec.LuaLibraries = append(cleaner.Spec.LuaLibraries, cleanyv1alpha1.LuaLibraryReference{Name: name})
+	}
+	return cleaner
+}
+
+func TestLoadLuaLibraries(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newLibrary("common", map[string]string{"labels.lua": "return {}", "time": "return {}"}),
+		newLibrary("other", map[string]string{"pvc.lua": "return {}"}),
+		newLibrary("conflict", map[string]string{"labels": "return {}"}),
+		newLibrary("broken", map[string]string{"broken.lua": "function ("}),
+	).Build()
+
+	modules, statuses, err := LoadLuaLibraries(context.Background(), k8sClient, newLibraryCleaner("common", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"labels", "time", "pvc"} {
+		if _, ok := modules[name]; !ok {
+			t.Errorf("expected module %s", name)
+		}
+	}
+	if len(statuses) != 2 || statuses[0].Name != "common" || !strings.HasPrefix(statuses[0].Hash, "sha256:") ||
+		statuses[0].ResourceVersion == "" {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+	if statuses[0].Hash == statuses[1].Hash {
+		t.Error("expected libraries with different content to have different hashes")
+	}
+
+	for _, libraries := range [][]string{{"missing"}, {"common", "conflict"}, {"broken"}} {
+		if _, _, err := LoadLuaLibraries(context.Background(), k8sClient, newLibraryCleaner(libraries...)); err == nil {
+			t.Errorf("expected error loading %v", libraries)
+		}
+	}
+
+	if modules, _, err := LoadLuaLibraries(context.Background(), k8sClient, newLibraryCleaner()); err != nil || modules != nil {
+		t.Errorf("expected no modules, got %v %v", modules, err)
+	}
+}
+
+func TestLibraryHash(t *testing.T) {
+	data := map[string]string{"a": "1", "b": "2"}
+	if libraryHash(data) != libraryHash(map[string]string{"b": "2", "a": "1"}) {
+		t.Error("expected hash to not depend on map order")
+	}
+	if libraryHash(data) == libraryHash(map[string]string{"a": "12"}) {
+		t.Error("expected entries to be delimited")
+	}
+}
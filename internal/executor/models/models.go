@@ -1,12 +1,67 @@
 package models
 
-import "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
 
 type ResourceResult struct {
 	// Resource identify a Kubernetes resource
 	Resource *unstructured.Unstructured `json:"resource,omitempty"`
 
+	// GVR is the group, version and resource used to act on Resource
+	GVR schema.GroupVersionResource `json:"gvr,omitempty"`
+
 	// Message is an optional field.
 	// +optional
 	Message string `json:"message,omitempty"`
+
+	// Action overrides the Cleaner action for this resource, if set
+	// +optional
+	Action cleanyv1alpha1.Action `json:"action,omitempty"`
+
+	// Severity ranks the resource, if set
+	// +optional
+	Severity cleanyv1alpha1.Severity `json:"severity,omitempty"`
+
+	// Details are arbitrary key/values reported for the resource
+	// +optional
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// RunSummary summarizes what an executor run did
+type RunSummary struct {
+	// Matched is the number of resources selected
+	Matched int
+
+	// DryRun is set when the deletions and transformations were dry runs
+	DryRun bool
+
+	// Deleted is the number of resources deleted
+	Deleted int
+
+	// Transformed is the number of resources updated
+	Transformed int
+
+	// Failed is the number of resources the action failed on
+	Failed int
+
+	// Skipped is the number of protected resources left untouched
+	Skipped int
+
+	// LimitExceeded explains why no action was taken, when the run
+	// exceeded the Cleaner limits
+	LimitExceeded string
+
+	// PendingApproval is set when the run created a CleaningReport
+	// awaiting approval instead of acting
+	PendingApproval bool
+
+	// Errors contains the per resource failures
+	Errors []string
+
+	// ReportName is the name of the CleaningReport created, if any
+	ReportName string
 }
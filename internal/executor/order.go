@@ -0,0 +1,156 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+// stagePollInterval is how often the resources of a stage are checked
+// while waiting for them to be gone
+var stagePollInterval = time.Second
+
+// collected is a resource left to the garbage collector, as all its owners
+// are to be deleted by the run
+type collected struct {
+	result *models.ResourceResult
+	owner  string
+}
+
+// deletionStages splits resources in stages processed one after the other,
+// following the kind order of the Cleaner, and returns apart the resources
+// left to the garbage collector.
+func (e *Executor) deletionStages(resources []models.ResourceResult) ([][]*models.ResourceResult, []collected) {
+	// the resources that will be gone at the end of the run
+	deleted := make(map[types.UID]*models.ResourceResult)
+	for i := range resources {
+		if e.actionOf(&resources[i]) == cleanyv1alpha1.ActionDelete &&
+			e.protection.Reason(resources[i].Resource) == "" {
+			deleted[resources[i].Resource.GetUID()] = &resources[i]
+		}
+	}
+
+	var kindOrder []schema.GroupKind
+	if e.cleaner.Spec.Deletion != nil {
+		for _, kind := range e.cleaner.Spec.Deletion.KindOrder {
+			kindOrder = append(kindOrder, schema.ParseGroupKind(kind))
+		}
+	}
+	stage := func(result *models.ResourceResult) int {
+		gk := result.Resource.GroupVersionKind().GroupKind()
+		if i := slices.Index(kindOrder, gk); i >= 0 {
+			return i
+		}
+		if gk == (schema.GroupKind{Kind: "Namespace"}) {
+			return len(kindOrder) + 1
+		}
+		return len(kindOrder)
+	}
+
+	var ordered []*models.ResourceResult
+	var gc []collected
+	for i := range resources {
+		if owner := deletedOwner(&resources[i], deleted); owner != nil {
+			gc = append(gc, collected{result: &resources[i], owner: fmt.Sprintf("%s %s", owner.Resource.GetKind(),
+				objectName(owner.Resource.GetNamespace(), owner.Resource.GetName()))})
+			continue
+		}
+		ordered = append(ordered, &resources[i])
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return stage(ordered[i]) < stage(ordered[j])
+	})
+
+	var stages [][]*models.ResourceResult
+	for i, result := range ordered {
+		if i == 0 || stage(result) != stage(ordered[i-1]) {
+			stages = append(stages, nil)
+		}
+		stages[len(stages)-1] = append(stages[len(stages)-1], result)
+	}
+	return stages, gc
+}
+
+// deletedOwner returns an owner of result deleted by the run, if result is
+// deleted along with all its owners.
+func deletedOwner(result *models.ResourceResult, deleted map[types.UID]*models.ResourceResult,
+) *models.ResourceResult {
+	if _, ok := deleted[result.Resource.GetUID()]; !ok {
+		return nil
+	}
+	owners := result.Resource.GetOwnerReferences()
+	if len(owners) == 0 {
+		return nil
+	}
+	for i := range owners {
+		if _, ok := deleted[owners[i].UID]; !ok {
+			return nil
+		}
+	}
+	return deleted[owners[0].UID]
+}
+
+// ownersState is whether the owners of a resource left to the garbage
+// collector were deleted by the run
+type ownersState int
+
+const (
+	// ownersDeleted is when all the owners were deleted
+	ownersDeleted ownersState = iota
+
+	// ownersPending is when some owners are themselves left to the garbage
+	// collector, and the others were deleted
+	ownersPending
+
+	// ownersKept is when an owner could not be deleted
+	ownersKept
+)
+
+// ownersGone returns whether the owners of result are in gone, the
+// resources deleted by the run, or in waiting, those left to the garbage
+// collector not decided yet.
+func ownersGone(result *models.ResourceResult, gone, waiting map[types.UID]bool) ownersState {
+	state := ownersDeleted
+	for _, owner := range result.Resource.GetOwnerReferences() {
+		switch {
+		case gone[owner.UID]:
+		case waiting[owner.UID]:
+			state = ownersPending
+		default:
+			return ownersKept
+		}
+	}
+	return state
+}
+
+// waitDeleted waits until the resources are gone, or ctx is done.
+func (e *Executor) waitDeleted(ctx context.Context, resources []*models.ResourceResult) error {
+	return wait.PollUntilContextCancel(ctx, stagePollInterval, true, func(ctx context.Context) (bool, error) {
+		for _, result := range resources {
+			obj := result.Resource
+			current, err := e.dynamicClient.Resource(result.GVR).Namespace(obj.GetNamespace()).
+				Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			if current.GetUID() == obj.GetUID() {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,165 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func newOwnedResult(apiVersion, kind, resource, name string, owners ...*unstructured.Unstructured,
+) models.ResourceResult {
+	namespace := "default"
+	if kind == "Namespace" {
+		namespace = ""
+	}
+	obj := newObject(apiVersion, kind, namespace, name)
+	obj.SetUID(types.UID(name))
+	for _, owner := range owners {
+		obj.SetOwnerReferences(append(obj.GetOwnerReferences(), metav1.OwnerReference{
+			APIVersion: owner.GetAPIVersion(), Kind: owner.GetKind(), Name: owner.GetName(), UID: owner.GetUID(),
+		}))
+	}
+	gv := schema.FromAPIVersionAndKind(apiVersion, kind).GroupVersion()
+	return models.ResourceResult{Resource: obj, GVR: gv.WithResource(resource)}
+}
+
+func newOrderedResources() []models.ResourceResult {
+	other := newObject("apps/v1", "ReplicaSet", "default", "other")
+	other.SetUID("other")
+	deployment := newOwnedResult("apps/v1", "Deployment", "deployments", "deployment")
+	replicaSet := newOwnedResult("apps/v1", "ReplicaSet", "replicasets", "replicaset", deployment.Resource)
+	return []models.ResourceResult{
+		newOwnedResult("v1", "Namespace", "namespaces", "namespace"),
+		newOwnedResult("v1", "Pod", "pods", "pod", replicaSet.Resource),
+		newOwnedResult("v1", "ConfigMap", "configmaps", "configmap"),
+		replicaSet,
+		newOwnedResult("v1", "Pod", "pods", "unowned", other),
+		newOwnedResult("v1", "Pod", "pods", "shared", deployment.Resource, other),
+		deployment,
+	}
+}
+
+func TestDeletionStages(t *testing.T) {
+	cleaner := newLibraryCleaner()
+	cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+	cleaner.Spec.Deletion = &cleanyv1alpha1.DeletionPolicy{KindOrder: []string{"Deployment.apps"}}
+	e := &Executor{cleaner: cleaner, protection: NewProtection(config.New())}
+
+	stages, gc := e.deletionStages(newOrderedResources())
+	var names [][]string
+	for _, stage := range stages {
+		var stageNames []string
+		for _, result := range stage {
+			stageNames = append(stageNames, result.Resource.GetName())
+		}
+		names = append(names, stageNames)
+	}
+	expected := [][]string{{"deployment"}, {"configmap", "unowned", "shared"}, {"namespace"}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected stages %v, got %v", expected, names)
+	}
+
+	owners := map[string]string{}
+	for _, c := range gc {
+		owners[c.result.Resource.GetName()] = c.owner
+	}
+	expectedOwners := map[string]string{"pod": "ReplicaSet default/replicaset", "replicaset": "Deployment default/deployment"}
+	if !reflect.DeepEqual(owners, expectedOwners) {
+		t.Errorf("expected %v to be left to the garbage collector, got %v", expectedOwners, owners)
+	}
+}
+
+func TestActInStages(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// failing is the resource whose deletion fails
+		failing  string
+		expected models.RunSummary
+	}{
+		{
+			name:     "owners deleted",
+			expected: models.RunSummary{Deleted: 5, Skipped: 2},
+		},
+		{
+			// the replica set is deleted as its owner is not, and the pod
+			// left to the garbage collector with it
+			name:     "owner not deleted",
+			failing:  "deployment",
+			expected: models.RunSummary{Deleted: 5, Skipped: 1, Failed: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources := newOrderedResources()
+			var objects []runtime.Object
+			for i := range resources {
+				objects = append(objects, resources[i].Resource.DeepCopy())
+			}
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), nil, objects...)
+			dynamicClient.PrependReactor("delete", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				if action.(clienttesting.DeleteAction).GetName() == tt.failing {
+					return true, nil, fmt.Errorf("denied")
+				}
+				return false, nil, nil
+			})
+			k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+				WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build()
+
+			cleaner := newLibraryCleaner()
+			cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+			cleaner.Spec.Deletion = &cleanyv1alpha1.DeletionPolicy{KindOrder: []string{"Deployment.apps"},
+				WaitForStages: true}
+			e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+				protection: NewProtection(config.New()), snapshotInlineLimit: config.New().SnapshotInlineLimit,
+				throttle: &throttle{}, k8sClient: k8sClient, dynamicClient: dynamicClient, scheme: scheme}
+
+			summary := &models.RunSummary{}
+			if err := e.act(context.Background(), resources, nil, false, summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Deleted != tt.expected.Deleted || summary.Skipped != tt.expected.Skipped ||
+				summary.Failed != tt.expected.Failed {
+				t.Errorf("expected %+v, got %+v", tt.expected, summary)
+			}
+
+			var deleted []string
+			for _, action := range dynamicClient.Actions() {
+				if action, ok := action.(clienttesting.DeleteAction); ok && action.GetName() != tt.failing {
+					deleted = append(deleted, action.GetName())
+				}
+			}
+			expected := []string{"configmap", "unowned", "shared", "namespace"}
+			if tt.failing == "" {
+				expected = append([]string{"deployment"}, expected...)
+			} else {
+				expected = append(expected, "replicaset")
+			}
+			if !reflect.DeepEqual(deleted, expected) {
+				t.Errorf("expected deletions %v, got %v", expected, deleted)
+			}
+		})
+	}
+}
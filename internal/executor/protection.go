@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+)
+
+// Protection is the guardrail policy checked before deleting or transforming
+// a resource, whatever the Cleaner selecting it.
+type Protection struct {
+	// Namespaces are the namespaces whose resources, and the namespaces
+	// themselves, are protected
+	Namespaces []string
+
+	// Kinds are the protected kinds
+	Kinds []schema.GroupKind
+}
+
+// NewProtection returns the Protection configured in cfg.
+func NewProtection(cfg *config.Config) *Protection {
+	kinds := make([]schema.GroupKind, len(cfg.ProtectedKinds))
+	for i, kind := range cfg.ProtectedKinds {
+		kinds[i] = schema.ParseGroupKind(kind)
+	}
+	return &Protection{
+		Namespaces: cfg.ProtectedNamespaces,
+		Kinds:      kinds,
+	}
+}
+
+// Reason returns why obj must not be deleted nor transformed, or an empty
+// string if it is not protected.
+func (p *Protection) Reason(obj *unstructured.Unstructured) string {
+	if obj.GetAnnotations()[cleanyv1alpha1.ProtectAnnotation] == "true" {
+		return fmt.Sprintf("protected by the %s annotation", cleanyv1alpha1.ProtectAnnotation)
+	}
+
+	gk := obj.GroupVersionKind().GroupKind()
+	if slices.Contains(p.Kinds, gk) {
+		return fmt.Sprintf("kind %s is protected", gk)
+	}
+
+	if namespace := obj.GetNamespace(); namespace != "" && slices.Contains(p.Namespaces, namespace) {
+		return fmt.Sprintf("namespace %s is protected", namespace)
+	}
+	if gk == (schema.GroupKind{Kind: "Namespace"}) && slices.Contains(p.Namespaces, obj.GetName()) {
+		return fmt.Sprintf("namespace %s is protected", obj.GetName())
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+)
+
+func newObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestProtectionReason(t *testing.T) {
+	protection := NewProtection(config.New())
+
+	annotated := newObject("v1", "ConfigMap", "default", "settings")
+	annotated.SetAnnotations(map[string]string{cleanyv1alpha1.ProtectAnnotation: "true"})
+	notAnnotated := newObject("v1", "ConfigMap", "default", "settings")
+	notAnnotated.SetAnnotations(map[string]string{cleanyv1alpha1.ProtectAnnotation: "false"})
+
+	tests := []struct {
+		name   string
+		obj    *unstructured.Unstructured
+		reason string
+	}{
+		{"unprotected", newObject("v1", "Pod", "default", "web"), ""},
+		{"annotation", annotated, "annotation"},
+		{"annotation not true", notAnnotated, ""},
+		{"namespace", newObject("v1", "Pod", "kube-system", "coredns"), "namespace kube-system"},
+		{"namespace itself", newObject("v1", "Namespace", "", "kube-public"), "namespace kube-public"},
+		{"other namespace", newObject("v1", "Namespace", "", "dev"), ""},
+		{"kind", newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "cleaners.cleany.wys1203.com"),
+			"kind CustomResourceDefinition.apiextensions.k8s.io"},
+		{"same kind other group", newObject("example.com/v1", "CustomResourceDefinition", "", "crd"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := protection.Reason(tt.obj)
+			if tt.reason == "" && reason != "" {
+				t.Errorf("expected no protection, got %q", reason)
+			}
+			if tt.reason != "" && !strings.Contains(reason, tt.reason) {
+				t.Errorf("expected reason about %s, got %q", tt.reason, reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/traits"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+const aggregatedResourcesError = `lua script output field "resources" is not an array of {resource = obj, message = "..."}`
+
+// AggregatedSelection invokes the lua function "evaluate" defined in script
+// with all the resources selected so far, also set as global "resources".
+// The function returns a table whose "resources" field lists the resources
+// to keep, each as a table with the object in "resource" and an optional
+// "message" replacing the one set by the resource selector.
+func AggregatedSelection(ctx context.Context, script *LuaScript, results []models.ResourceResult) ([]models.ResourceResult, error) {
+	objects := make([]interface{}, len(results))
+	selected := make(map[string]*models.ResourceResult, len(results))
+	for i := range results {
+		objects[i] = results[i].Resource.Object
+		selected[resourceKey(results[i].Resource)] = &results[i]
+	}
+
+	goResult, err := script.call(ctx, "evaluate", "resources", objects)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := aggregatedEntries(goResult)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]models.ResourceResult, 0, len(entries))
+	for _, entry := range entries {
+		resource, _ := entry["resource"].(map[string]interface{})
+		result, err := selectedResult(selected, resource)
+		if err != nil {
+			return nil, err
+		}
+		if message, ok := entry["message"].(string); ok && message != "" {
+			result.Message = message
+		}
+		kept = append(kept, *result)
+	}
+	return kept, nil
+}
+
+// AggregatedSelectionCEL evaluates program with all the resources selected
+// so far and returns the resources in the list it evaluates to.
+func AggregatedSelectionCEL(ctx context.Context, program *CELProgram, results []models.ResourceResult) ([]models.ResourceResult, error) {
+	objects := make([]interface{}, len(results))
+	selected := make(map[string]*models.ResourceResult, len(results))
+	for i := range results {
+		objects[i] = results[i].Resource.Object
+		selected[resourceKey(results[i].Resource)] = &results[i]
+	}
+
+	val, err := program.eval(ctx, map[string]interface{}{celResourcesVar: objects})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := val.(traits.Lister)
+	if !ok {
+		return nil, fmt.Errorf("CEL expression %q evaluated to %v, not a list", program.expression, val)
+	}
+
+	kept := make([]models.ResourceResult, 0)
+	for it := list.Iterator(); it.HasNext() == types.True; {
+		element, err := it.Next().ConvertToNative(reflect.TypeOf(map[string]interface{}{}))
+		if err != nil {
+			return nil, fmt.Errorf("CEL expression %q: %w", program.expression, err)
+		}
+		result, err := selectedResult(selected, element.(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, *result)
+	}
+	return kept, nil
+}
+
+// selectedResult returns the selected result for resource, as returned by
+// an aggregated selection.
+func selectedResult(selected map[string]*models.ResourceResult, resource map[string]interface{}) (*models.ResourceResult, error) {
+	obj := &unstructured.Unstructured{Object: resource}
+	result, ok := selected[resourceKey(obj)]
+	if !ok {
+		return nil, fmt.Errorf("aggregated selection returned %s %s, which was not selected",
+			obj.GetKind(), objectName(&UnstructuredResource{Unstructured: *obj}))
+	}
+	return result, nil
+}
+
+// aggregatedEntries returns the "resources" field of the table returned by
+// an aggregated selection.
+func aggregatedEntries(goResult interface{}) ([]map[string]interface{}, error) {
+	content, ok := goResult.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s", luaMapError)
+	}
+
+	var list []interface{}
+	switch resources := content["resources"].(type) {
+	case nil:
+	case []interface{}:
+		list = resources
+	case map[string]interface{}:
+		// an empty table built by the script
+		if len(resources) != 0 {
+			return nil, fmt.Errorf("%s", aggregatedResourcesError)
+		}
+	default:
+		return nil, fmt.Errorf("%s", aggregatedResourcesError)
+	}
+
+	entries := make([]map[string]interface{}, len(list))
+	for i := range list {
+		entry, ok := list[i].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s", aggregatedResourcesError)
+		}
+		if _, ok := entry["resource"].(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s", aggregatedResourcesError)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// resourceKey identifies an object among the selected resources.
+func resourceKey(obj *unstructured.Unstructured) string {
+	return obj.GetAPIVersion() + "/" + obj.GetKind() + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
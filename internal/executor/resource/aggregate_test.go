@@ -0,0 +1,104 @@
+package resource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func TestAggregatedSelection(t *testing.T) {
+	script, err := CompileLuaScript("aggregatedSelection", `
+function evaluate()
+  local hs = {resources = {}}
+  for _, pod in ipairs(resources) do
+    if pod.metadata.name ~= "pod-1" then
+      table.insert(hs.resources, {resource = pod, message = "kept"})
+    end
+  end
+  return hs
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	results := make([]models.ResourceResult, 3)
+	for i := range results {
+		results[i] = models.ResourceResult{Resource: &newPod(i).Unstructured, Message: "selected"}
+	}
+
+	kept, err := AggregatedSelection(context.Background(), script, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 {
+		t.Fatalf("expected 2 resources, got %d", len(kept))
+	}
+	for _, result := range kept {
+		if result.Resource.GetName() == "pod-1" || result.Message != "kept" {
+			t.Errorf("unexpected result %s %q", result.Resource.GetName(), result.Message)
+		}
+	}
+}
+
+func TestAggregatedSelectionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"not a table", `function evaluate() return {resources = "all"} end`},
+		{"not an entry", `function evaluate() return {resources = {"pod-0"}} end`},
+		{"not selected", `function evaluate()
+  return {resources = {{resource = {apiVersion = "v1", kind = "Pod", metadata = {name = "other"}}}}}
+end`},
+	}
+
+	results := []models.ResourceResult{{Resource: &newPod(0).Unstructured}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := CompileLuaScript("aggregatedSelection", tt.script, DefaultLuaLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer script.Close()
+
+			if _, err := AggregatedSelection(context.Background(), script, results); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestAggregatedSelectionCEL(t *testing.T) {
+	program, err := CompileAggregatedCEL(`resources.filter(r, r.metadata.name != "pod-1")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([]models.ResourceResult, 3)
+	for i := range results {
+		results[i] = models.ResourceResult{Resource: &newPod(i).Unstructured, Message: "selected"}
+	}
+
+	kept, err := AggregatedSelectionCEL(context.Background(), program, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 {
+		t.Fatalf("expected 2 resources, got %d", len(kept))
+	}
+	for _, result := range kept {
+		if result.Resource.GetName() == "pod-1" || result.Message != "selected" {
+			t.Errorf("unexpected result %s %q", result.Resource.GetName(), result.Message)
+		}
+	}
+
+	program, err = CompileAggregatedCEL(`[{"apiVersion": dyn("v1"), "kind": dyn("Pod"), "metadata": dyn({"name": "other"})}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AggregatedSelectionCEL(context.Background(), program, results); err == nil {
+		t.Error("expected error for resource not selected")
+	}
+}
@@ -0,0 +1,136 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"k8s.io/apimachinery/pkg/util/version"
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+	apiservercel "k8s.io/apiserver/pkg/cel"
+	"k8s.io/apiserver/pkg/cel/common"
+	"k8s.io/apiserver/pkg/cel/environment"
+	"k8s.io/apiserver/pkg/cel/openapi"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+const (
+	// celObjectVar holds the resource in EvaluateCEL expressions
+	celObjectVar = "object"
+
+	// celResourcesVar holds the selected resources in AggregatedSelectionCEL
+	// expressions
+	celResourcesVar = "resources"
+)
+
+// CELProgram is a compiled CEL expression. Expressions have the Kubernetes
+// CEL libraries (quantities, regular expressions, URLs, lists...) available,
+// as in ValidatingAdmissionPolicies, and their cost is bounded by the same
+// per call limit.
+type CELProgram struct {
+	expression string
+	program    cel.Program
+
+	// schema, if set, is used to convert objects to the declared type
+	schema *spec.Schema
+}
+
+// CompileCEL compiles expression, which must evaluate to a bool, with the
+// resource available as "object". When schema is not nil, object is typed
+// after it, so field names and types are checked at compile time; otherwise
+// object is dynamic and only the expression itself is checked.
+func CompileCEL(expression string, schema *spec.Schema) (*CELProgram, error) {
+	objectType := cel.DynType
+	var declTypes []*apiservercel.DeclType
+	if schema != nil {
+		// not a resource root, so that the whole metadata is typed rather
+		// than only its name
+		declType := common.SchemaDeclType(&openapi.Schema{Schema: schema}, false)
+		if declType == nil {
+			return nil, fmt.Errorf("cannot use schema to type check CEL expression")
+		}
+		declType = declType.MaybeAssignTypeName("__object__")
+		objectType = declType.CelType()
+		declTypes = append(declTypes, declType)
+	}
+
+	return compileCEL(expression, cel.BoolType, schema, declTypes, cel.Variable(celObjectVar, objectType))
+}
+
+// CompileAggregatedCEL compiles expression, which must evaluate to the list
+// of resources to keep, with the selected resources available as "resources".
+func CompileAggregatedCEL(expression string) (*CELProgram, error) {
+	return compileCEL(expression, cel.ListType(cel.DynType), nil, nil,
+		cel.Variable(celResourcesVar, cel.ListType(cel.DynType)))
+}
+
+func compileCEL(expression string, outputType *cel.Type, schema *spec.Schema,
+	declTypes []*apiservercel.DeclType, variables ...cel.EnvOption) (*CELProgram, error) {
+	envSet, err := environment.MustBaseEnvSet(environment.DefaultCompatibilityVersion(), true).Extend(
+		environment.VersionedOptions{
+			IntroducedVersion: version.MajorMinor(1, 0),
+			EnvOptions:        variables,
+			DeclTypes:         declTypes,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	env, err := envSet.Env(environment.NewExpressions)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !outputType.IsAssignableType(ast.OutputType()) && !ast.OutputType().IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("CEL expression must evaluate to %s, not %s", outputType, ast.OutputType())
+	}
+
+	program, err := env.Program(ast,
+		cel.CostLimit(celconfig.PerCallLimit),
+		cel.InterruptCheckFrequency(celconfig.CheckFrequency),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &CELProgram{expression: expression, program: program, schema: schema}, nil
+}
+
+// MatchCEL evaluates program with the resource. A nil program matches every
+// resource.
+func (r *UnstructuredResource) MatchCEL(ctx context.Context, program *CELProgram) (bool, error) {
+	if program == nil {
+		return true, nil
+	}
+
+	var object interface{} = r.UnstructuredContent()
+	if program.schema != nil {
+		object = common.UnstructuredToVal(r.UnstructuredContent(), &openapi.Schema{Schema: program.schema})
+	}
+
+	val, err := program.eval(ctx, map[string]interface{}{celObjectVar: object})
+	if err != nil {
+		return false, err
+	}
+	match, ok := val.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("CEL expression %q evaluated to %v, not a bool", program.expression, val)
+	}
+	return match, nil
+}
+
+func (p *CELProgram) eval(ctx context.Context, activation map[string]interface{}) (ref.Val, error) {
+	val, _, err := p.program.ContextEval(ctx, activation)
+	if err != nil {
+		return nil, fmt.Errorf("CEL expression %q: %w", p.expression, err)
+	}
+	if types.IsError(val) {
+		return nil, fmt.Errorf("CEL expression %q: %v", p.expression, val)
+	}
+	return val, nil
+}
@@ -0,0 +1,111 @@
+package resource
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// podSchema is a subset of the Pod schema.
+func podSchema() *spec.Schema {
+	str := *spec.StringProperty()
+	containers := spec.ArrayProperty(&spec.Schema{SchemaProps: spec.SchemaProps{
+		Type: []string{"object"},
+		Properties: map[string]spec.Schema{
+			"name":  str,
+			"image": str,
+		},
+	}})
+	return &spec.Schema{SchemaProps: spec.SchemaProps{
+		Type: []string{"object"},
+		Properties: map[string]spec.Schema{
+			"apiVersion": str,
+			"kind":       str,
+			"metadata": {SchemaProps: spec.SchemaProps{
+				Type: []string{"object"},
+				Properties: map[string]spec.Schema{
+					"name":   str,
+					"labels": *spec.MapProperty(&str),
+				},
+			}},
+			"spec": {SchemaProps: spec.SchemaProps{
+				Type:       []string{"object"},
+				Properties: map[string]spec.Schema{"containers": *containers},
+			}},
+		},
+	}}
+}
+
+func TestMatchCEL(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		schema     *spec.Schema
+		want       bool
+	}{
+		{"label", `object.metadata.labels["app"] == "web"`, nil, true},
+		{"missing label", `has(object.metadata.labels.tier)`, nil, false},
+		{"containers", `object.spec.containers.exists(c, c.image.startsWith("nginx:"))`, nil, true},
+		{"typed", `object.spec.containers.all(c, c.image != "busybox")`, podSchema(), true},
+		{"typed metadata", `object.metadata.name == "pod-0" && object.metadata.labels["app"] == "web"`, podSchema(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program, err := CompileCEL(tt.expression, tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			match, err := newPod(0).MatchCEL(context.Background(), program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, match)
+			}
+		})
+	}
+
+	if match, err := newPod(0).MatchCEL(context.Background(), nil); err != nil || !match {
+		t.Errorf("expected nil program to match, got %t %v", match, err)
+	}
+}
+
+func TestCompileCELErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		schema     *spec.Schema
+		want       string
+	}{
+		{"syntax", `object.metadata.name ==`, nil, "Syntax error"},
+		{"not a bool", `object.metadata.name + "x"`, nil, "must evaluate to bool"},
+		{"unknown field", `object.spec.volumes.size() > 0`, podSchema(), "undefined field 'volumes'"},
+		{"wrong type", `object.spec.containers[0].image > 1`, podSchema(), "no matching overload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileCEL(tt.expression, tt.schema)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, err := CompileAggregatedCEL(`resources.size() > 0`); err == nil {
+		t.Error("expected error for aggregated selection not evaluating to a list")
+	}
+}
+
+func TestMatchCELRuntimeError(t *testing.T) {
+	program, err := CompileCEL(`object.status.phase == "Running"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPod(0).MatchCEL(context.Background(), program); err == nil {
+		t.Error("expected error for missing field")
+	}
+}
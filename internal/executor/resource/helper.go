@@ -3,16 +3,19 @@ package resource
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 	"golang.org/x/exp/maps"
+	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/restmapper"
@@ -23,93 +26,305 @@ import (
 
 // A interface for resource result helper
 type IResourceHelper interface {
-	// FetchMatchingResources fetches all resources matching the selector
-	FetchMatchingResources(ctx context.Context) ([]models.ResourceResult, error)
+	// FetchMatchingResources fetches all resources matching the selector,
+	// and returns them with the number of resources listed before evaluation
+	FetchMatchingResources(ctx context.Context) ([]models.ResourceResult, int, error)
+}
+
+// ListConcurrency is the number of namespaces listed concurrently for a
+// resource selector.
+type ListConcurrency struct {
+	// Default applies to the resources missing from PerResource
+	Default int
+
+	// PerResource overrides Default for the resources it holds
+	PerResource map[schema.GroupResource]int
+}
+
+// For returns the number of namespaces listed concurrently for resource.
+func (c ListConcurrency) For(resource schema.GroupResource) int {
+	if concurrency, ok := c.PerResource[resource]; ok {
+		return concurrency
+	}
+	return c.Default
 }
 
 type ResourceHelper struct {
-	resourceSelectors []cleanyv1alpha1.ResourceSelector
+	resourcePolicySet cleanyv1alpha1.ResourcePolicySet
 	namespaces        []corev1.Namespace
 
 	discoveryClient *discovery.DiscoveryClient
 	dynamicClient   *dynamic.DynamicClient
 
-	wg *sync.WaitGroup
+	// listConcurrency is the number of namespaces listed concurrently
+	// for each resource selector, by resource
+	listConcurrency ListConcurrency
+
+	// luaLimits bounds each call to the evaluate scripts
+	luaLimits LuaLimits
+
+	// maxLookups is the maximum number of API calls made by the scripts
+	// of a run, when the policy set allows lookups
+	maxLookups int
+
+	// luaModules can be loaded by the scripts with require
+	luaModules LuaModules
 }
 
 func NewResourceHelper(
-	resourceSelectors []cleanyv1alpha1.ResourceSelector,
+	resourcePolicySet cleanyv1alpha1.ResourcePolicySet,
 	namespaces []corev1.Namespace,
 	discoveryClient *discovery.DiscoveryClient,
 	dynamicClient *dynamic.DynamicClient,
+	listConcurrency ListConcurrency,
+	luaLimits LuaLimits,
+	maxLookups int,
+	luaModules LuaModules,
 ) IResourceHelper {
 	return &ResourceHelper{
-		resourceSelectors: resourceSelectors,
+		resourcePolicySet: resourcePolicySet,
 		namespaces:        namespaces,
 		discoveryClient:   discoveryClient,
 		dynamicClient:     dynamicClient,
-		wg:                &sync.WaitGroup{},
+		listConcurrency:   listConcurrency,
+		luaLimits:         luaLimits,
+		maxLookups:        maxLookups,
+		luaModules:        luaModules,
 	}
 }
 
-func (r *ResourceHelper) FetchMatchingResources(ctx context.Context) ([]models.ResourceResult, error) {
+func (r *ResourceHelper) FetchMatchingResources(ctx context.Context) ([]models.ResourceResult, int, error) {
 
 	// scan all resources group
 	groupResources, err := restmapper.GetAPIGroupResources(r.discoveryClient)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// init rest mapper
 	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
 
+	// lookups are shared by all scripts of the run
+	var lookups *Lookups
+	if r.resourcePolicySet.AllowLookups {
+		lookups = NewLookups(r.dynamicClient, mapper, r.maxLookups)
+	}
+
 	var resourceResults []models.ResourceResult
+	var listed int
+	var mu sync.Mutex
 
-	for _, resourceSelector := range r.resourceSelectors {
+	g, gctx := errgroup.WithContext(ctx)
+	for _, resourceSelector := range r.resourcePolicySet.ResourceSelectors {
+		g.Go(func() error {
+			mapping, err := restMapping(&resourceSelector, mapper)
+			if err != nil {
+				return err
+			}
+			if mapping == nil {
+				// kind is not served by the cluster
+				return nil
+			}
 
-		r.wg.Add(1)
-		go func(resourceSelector cleanyv1alpha1.ResourceSelector) {
-			defer r.wg.Done()
+			evaluateCEL, err := r.compileCEL(&resourceSelector)
+			if err != nil {
+				return selectorError(&resourceSelector, err)
+			}
+
+			// compile the evaluate script once for all resources
+			var evaluate *LuaScript
+			if resourceSelector.Evaluate != "" {
+				evaluate, err = r.compileLua(resourceSelector.Kind+" evaluate", resourceSelector.Evaluate, lookups)
+				if err != nil {
+					return selectorError(&resourceSelector, err)
+				}
+				defer evaluate.Close()
+			}
 
 			// fetch resources
-			resources, err := r.fetch(ctx, &resourceSelector, mapper)
+			resources, err := r.fetch(gctx, &resourceSelector, mapping)
 			if err != nil {
-				return
+				return err
 			}
+			mu.Lock()
+			listed += len(resources)
+			mu.Unlock()
 
-			// match resources with selector evaluate
+			// match resources with selector evaluateCEL and evaluate
 			for _, resource := range resources {
-				match, message, err := resource.Match(resourceSelector.Evaluate)
+				match, err := resource.MatchCEL(gctx, evaluateCEL)
+				if err != nil {
+					return selectorError(&resourceSelector, fmt.Errorf("%s %s: %w",
+						resource.GetKind(), objectName(&resource), err))
+				}
+				if !match {
+					continue
+				}
+				result, err := resource.Evaluate(gctx, evaluate)
 				if err != nil {
-					return
+					return selectorError(&resourceSelector, fmt.Errorf("%s %s: %w",
+						resource.GetKind(), objectName(&resource), err))
 				}
-				if match {
+				if result.Matching {
+					mu.Lock()
 					resourceResults = append(resourceResults, models.ResourceResult{
 						Resource: &resource.Unstructured,
-						Message:  message,
+						GVR:      mapping.Resource,
+						Message:  result.Message,
+						Action:   result.Action,
+						Severity: result.Severity,
+						Details:  result.Details,
 					})
+					mu.Unlock()
 				}
 			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, 0, err
+	}
+
+	if r.resourcePolicySet.AggregatedSelectionCEL != "" && len(resourceResults) != 0 {
+		aggregatedSelectionCEL, err := CompileAggregatedCEL(r.resourcePolicySet.AggregatedSelectionCEL)
+		if err != nil {
+			return nil, 0, fmt.Errorf("aggregatedSelectionCEL: %w", err)
+		}
+		resourceResults, err = AggregatedSelectionCEL(ctx, aggregatedSelectionCEL, resourceResults)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 
-		}(resourceSelector)
+	if r.resourcePolicySet.AggregatedSelection == "" || len(resourceResults) == 0 {
+		return resourceResults, listed, nil
+	}
+
+	aggregatedSelection, err := r.compileLua("aggregatedSelection", r.resourcePolicySet.AggregatedSelection, lookups)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer aggregatedSelection.Close()
+
+	resourceResults, err = AggregatedSelection(ctx, aggregatedSelection, resourceResults)
+	return resourceResults, listed, err
+}
 
+func (r *ResourceHelper) fetch(ctx context.Context, resourceSelector *cleanyv1alpha1.ResourceSelector, mapping *meta.RESTMapping) ([]UnstructuredResource, error) {
+	namespaces, err := namespaceFilter(resourceSelector, r.namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	options := constructListOptions(LabelFilter(resourceSelector))
+	resourceInterface := r.dynamicClient.Resource(mapping.Resource)
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		if namespaces != nil {
+			// cluster scoped resources are in none of the selected namespaces
+			return nil, nil
+		}
+		return collectWithOptions(ctx, resourceInterface, &options)
 	}
+	if namespaces == nil {
+		resources, err := collectWithOptions(ctx, resourceInterface, &options)
+		if err != nil {
+			return nil, err
+		}
+		return slices.DeleteFunc(resources, func(resource UnstructuredResource) bool {
+			return r.excludedNamespace(resourceSelector, resource.GetNamespace())
+		}), nil
+	}
+	namespaces = slices.DeleteFunc(namespaces, func(namespace string) bool {
+		return r.excludedNamespace(resourceSelector, namespace)
+	})
 
-	r.wg.Wait()
+	// list the selected namespaces, listConcurrency at a time
+	var result []UnstructuredResource
+	var mu sync.Mutex
 
-	return resourceResults, nil
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(r.listConcurrency.For(mapping.Resource.GroupResource()))
+	for _, namespace := range namespaces {
+		g.Go(func() error {
+			resources, err := collectWithOptions(gctx, resourceInterface.Namespace(namespace), &options)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			result = append(result, resources...)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (r *ResourceHelper) fetch(ctx context.Context, resourceSelector *cleanyv1alpha1.ResourceSelector, mapper meta.RESTMapper) ([]UnstructuredResource, error) {
-	resourceId, err := constructGVR(resourceSelector, mapper)
+// compileLua compiles a script with access to the lua modules and, if not
+// nil, to lookups.
+func (r *ResourceHelper) compileLua(name, source string, lookups *Lookups) (*LuaScript, error) {
+	script, err := CompileLuaScript(name, source, r.luaLimits)
 	if err != nil {
 		return nil, err
 	}
-	options := constructListOptions(labelFilter(resourceSelector), namespaceFilter(resourceSelector, r.namespaces))
-	return collectWithOptions(ctx, &resourceId, &options, r.dynamicClient)
+	if lookups != nil {
+		script.EnableLookups(lookups)
+	}
+	script.UseModules(r.luaModules)
+	return script, nil
+}
+
+// compileCEL compiles the evaluateCEL expression of resourceSelector, type
+// checked against the schema of the kind when the cluster publishes it.
+// It returns nil if the selector has no such expression.
+func (r *ResourceHelper) compileCEL(resourceSelector *cleanyv1alpha1.ResourceSelector) (*CELProgram, error) {
+	if resourceSelector.EvaluateCEL == "" {
+		return nil, nil
+	}
+
+	gvk := schema.GroupVersionKind{
+		Group:   resourceSelector.Group,
+		Version: resourceSelector.Version,
+		Kind:    resourceSelector.Kind,
+	}
+	schemaResolver := &resolver.ClientDiscoveryResolver{Discovery: r.discoveryClient}
+	s, err := schemaResolver.ResolveSchema(gvk)
+	if err != nil {
+		// fall back to a dynamically typed object
+		s = nil
+	}
+
+	program, err := CompileCEL(resourceSelector.EvaluateCEL, s)
+	if err != nil {
+		return nil, fmt.Errorf("evaluateCEL: %w", err)
+	}
+	return program, nil
+}
+
+// selectorError identifies the resource selector err was hit on.
+func selectorError(resourceSelector *cleanyv1alpha1.ResourceSelector, err error) error {
+	gvk := schema.GroupVersionKind{
+		Group:   resourceSelector.Group,
+		Version: resourceSelector.Version,
+		Kind:    resourceSelector.Kind,
+	}
+	return fmt.Errorf("resource selector %s: %w", gvk, err)
+}
+
+func objectName(resource *UnstructuredResource) string {
+	if resource.GetNamespace() == "" {
+		return resource.GetName()
+	}
+	return resource.GetNamespace() + "/" + resource.GetName()
 }
 
-func constructGVR(resourceSelector *cleanyv1alpha1.ResourceSelector, mapper meta.RESTMapper) (schema.GroupVersionResource, error) {
+// restMapping returns the REST mapping of the kind selected by resourceSelector,
+// or nil if the cluster does not serve it.
+func restMapping(resourceSelector *cleanyv1alpha1.ResourceSelector, mapper meta.RESTMapper) (*meta.RESTMapping, error) {
 	gvk := schema.GroupVersionKind{
 		Group:   resourceSelector.Group,
 		Version: resourceSelector.Version,
@@ -119,21 +334,35 @@ func constructGVR(resourceSelector *cleanyv1alpha1.ResourceSelector, mapper meta
 	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
 	if err != nil {
 		if meta.IsNoMatchError(err) {
-			return schema.GroupVersionResource{}, nil
+			return nil, nil
 		}
-		return schema.GroupVersionResource{}, err
+		return nil, err
 	}
 
-	resourceId := schema.GroupVersionResource{
-		Group:    gvk.Group,
-		Version:  gvk.Version,
-		Resource: mapping.Resource.Resource,
-	}
+	return mapping, nil
+}
+
+// systemNamespaces are the namespaces of the Kubernetes components, excluded
+// from the resources selected unless ExcludeSystemNamespaces is false
+var systemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
 
-	return resourceId, nil
+// excludedNamespace returns whether resources in namespace are excluded by
+// the policy set. A namespace named by resourceSelector is never excluded.
+func (r *ResourceHelper) excludedNamespace(resourceSelector *cleanyv1alpha1.ResourceSelector, namespace string) bool {
+	if namespace == "" || namespace == resourceSelector.Namespace {
+		return false
+	}
+	if slices.Contains(r.resourcePolicySet.ExcludedNamespaces, namespace) {
+		return true
+	}
+	// resolved on each run, so that opting out takes effect on the next one
+	exclude := r.resourcePolicySet.ExcludeSystemNamespaces
+	return (exclude == nil || *exclude) && slices.Contains(systemNamespaces, namespace)
 }
 
-func labelFilter(resourceSelector *cleanyv1alpha1.ResourceSelector) string {
+// LabelFilter returns the label selector of the LabelFilters of
+// resourceSelector.
+func LabelFilter(resourceSelector *cleanyv1alpha1.ResourceSelector) string {
 	filters := make([]string, 0)
 	for _, f := range resourceSelector.LabelFilters {
 		if f.Operation == libsveltosv1alpha1.OperationEqual {
@@ -145,12 +374,18 @@ func labelFilter(resourceSelector *cleanyv1alpha1.ResourceSelector) string {
 	return strings.Join(filters, ",")
 }
 
-func namespaceFilter(resourceSelector *cleanyv1alpha1.ResourceSelector, namespaces []corev1.Namespace) string {
+// namespaceFilter returns the namespaces selected by resourceSelector.
+// A nil slice means resources are not filtered by namespace.
+func namespaceFilter(resourceSelector *cleanyv1alpha1.ResourceSelector, namespaces []corev1.Namespace) ([]string, error) {
+	if resourceSelector.Namespace == "" && resourceSelector.NamespaceSelector == "" {
+		return nil, nil
+	}
+
 	matchingNamespaces := make(map[string]struct{})
 	if resourceSelector.NamespaceSelector != "" {
 		parsedSelector, err := labels.Parse(resourceSelector.NamespaceSelector)
 		if err != nil {
-			return ""
+			return nil, fmt.Errorf("invalid namespaceSelector %q: %w", resourceSelector.NamespaceSelector, err)
 		}
 		for _, ns := range namespaces {
 			if parsedSelector.Matches(labels.Set(ns.Labels)) {
@@ -161,22 +396,20 @@ func namespaceFilter(resourceSelector *cleanyv1alpha1.ResourceSelector, namespac
 	if resourceSelector.Namespace != "" {
 		matchingNamespaces[resourceSelector.Namespace] = struct{}{}
 	}
-	return strings.Join(maps.Keys(matchingNamespaces), ",")
+	return maps.Keys(matchingNamespaces), nil
 }
 
-func constructListOptions(labelFilter string, namespaceFilter string) metav1.ListOptions {
+func constructListOptions(labelFilter string) metav1.ListOptions {
 	return metav1.ListOptions{
 		LabelSelector: labelFilter,
-		FieldSelector: fmt.Sprintf("metadata.namespace in (%s)", namespaceFilter),
 	}
 }
 
 func collectWithOptions(ctx context.Context,
-	resourceId *schema.GroupVersionResource,
+	resourceInterface dynamic.ResourceInterface,
 	options *metav1.ListOptions,
-	dynamicClient *dynamic.DynamicClient,
 ) ([]UnstructuredResource, error) {
-	list, err := dynamicClient.Resource(*resourceId).List(ctx, *options)
+	list, err := resourceInterface.List(ctx, *options)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,41 @@
+package resource
+
+import (
+	"testing"
+
+	"k8s.io/utils/ptr"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+func TestExcludedNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		exclude   *bool
+		excluded  []string
+		selector  string
+		namespace string
+		expected  bool
+	}{
+		{"system namespace by default", nil, nil, "", "kube-system", true},
+		{"system namespace excluded", ptr.To(true), nil, "", "kube-public", true},
+		{"system namespace opted out", ptr.To(false), nil, "", "kube-system", false},
+		{"system namespace selected", nil, nil, "kube-system", "kube-system", false},
+		{"namespace listed", ptr.To(false), []string{"staging"}, "", "staging", true},
+		{"namespace listed and selected", nil, []string{"staging"}, "staging", "staging", false},
+		{"other namespace", nil, []string{"staging"}, "", "default", false},
+		{"cluster-scoped", nil, nil, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ResourceHelper{resourcePolicySet: cleanyv1alpha1.ResourcePolicySet{
+				ExcludedNamespaces:      tt.excluded,
+				ExcludeSystemNamespaces: tt.exclude,
+			}}
+			selector := &cleanyv1alpha1.ResourceSelector{Namespace: tt.selector}
+			if excluded := r.excludedNamespace(selector, tt.namespace); excluded != tt.expected {
+				t.Errorf("expected excluded %t, got %t", tt.expected, excluded)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package resource
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// k8sLibName is the name of the global table holding the helpers below.
+const k8sLibName = "k8s"
+
+// now is replaced in tests.
+var now = time.Now
+
+// k8sFuncs are the helpers available to every script as k8s.<name>.
+// Functions parsing or decoding their input return nil and an error message
+// when it is invalid, and raise an error when arguments have the wrong type
+// or their result would exceed the LuaLimits of the script.
+//
+// Objects:
+//
+//	k8s.age(obj)                  seconds since metadata.creationTimestamp, or nil
+//	k8s.parseTime(str)            RFC 3339 time as seconds since epoch
+//	k8s.hasLabel(obj, key[, val]) whether obj has the label (with that value)
+//	k8s.hasAnnotation(obj, key[, val])
+//	k8s.ownerRefs(obj[, kind])    array of ownerReferences (of that kind)
+//	k8s.condition(obj, type)      the status.conditions entry of that type, or nil
+//	k8s.parseQuantity(str)        quantity such as "500Mi" or "250m" as a number
+//
+// Encoding:
+//
+//	k8s.jsonEncode(v), k8s.jsonDecode(str)
+//	k8s.yamlEncode(v), k8s.yamlDecode(str)
+//	k8s.array(...)                an array, which stays an array even when empty
+//	k8s.object()                  an empty object
+//
+// Regular expressions (Go RE2 syntax):
+//
+//	k8s.regexMatch(pattern, str)         whether str matches pattern
+//	k8s.regexFind(pattern, str)          array of the match and its submatches, or nil
+//	k8s.regexReplace(pattern, str, repl) str with matches replaced, repl may use $1
+//
+// Strings:
+//
+//	k8s.split(str, sep), k8s.join(array, sep), k8s.trim(str)
+//	k8s.hasPrefix(str, prefix), k8s.hasSuffix(str, suffix), k8s.contains(str, substr)
+var k8sFuncs = map[string]lua.LGFunction{
+	"age":           k8sAge,
+	"parseTime":     k8sParseTime,
+	"hasLabel":      k8sHasMetadataEntry("labels"),
+	"hasAnnotation": k8sHasMetadataEntry("annotations"),
+	"ownerRefs":     k8sOwnerRefs,
+	"condition":     k8sCondition,
+	"parseQuantity": k8sParseQuantity,
+	"jsonEncode":    k8sJSONEncode,
+	"jsonDecode":    k8sJSONDecode,
+	"yamlEncode":    k8sYAMLEncode,
+	"yamlDecode":    k8sYAMLDecode,
+	"array":         k8sArray,
+	"object":        k8sObject,
+	"regexMatch":    k8sRegexMatch,
+	"regexFind":     k8sRegexFind,
+	"regexReplace":  k8sRegexReplace,
+	"split":         k8sSplit,
+	"join":          k8sJoin,
+	"trim":          k8sTrim,
+	"hasPrefix":     k8sStringPredicate(strings.HasPrefix),
+	"hasSuffix":     k8sStringPredicate(strings.HasSuffix),
+	"contains":      k8sStringPredicate(strings.Contains),
+}
+
+// openK8sLib sets the global k8s table. Requires openConversion.
+func openK8sLib(l *lua.LState) {
+	l.SetGlobal(k8sLibName, l.SetFuncs(l.NewTable(), k8sFuncs))
+}
+
+// pushError pushes nil and msg, the lua convention for a failed call.
+func pushError(l *lua.LState, msg string) int {
+	l.Push(lua.LNil)
+	l.Push(lua.LString(msg))
+	return 2
+}
+
+// field returns the value at path in tbl, or nil.
+func field(tbl *lua.LTable, path ...string) lua.LValue {
+	var lv lua.LValue = tbl
+	for _, key := range path {
+		t, ok := lv.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		lv = t.RawGetString(key)
+	}
+	return lv
+}
+
+func k8sAge(l *lua.LState) int {
+	obj := l.CheckTable(1)
+	created, ok := field(obj, "metadata", "creationTimestamp").(lua.LString)
+	if !ok {
+		l.Push(lua.LNil)
+		return 1
+	}
+	t, err := time.Parse(time.RFC3339, string(created))
+	if err != nil {
+		return pushError(l, err.Error())
+	}
+	l.Push(lua.LNumber(now().Sub(t).Seconds()))
+	return 1
+}
+
+func k8sParseTime(l *lua.LState) int {
+	t, err := time.Parse(time.RFC3339, l.CheckString(1))
+	if err != nil {
+		return pushError(l, err.Error())
+	}
+	l.Push(lua.LNumber(t.Unix()))
+	return 1
+}
+
+func k8sHasMetadataEntry(entries string) lua.LGFunction {
+	return func(l *lua.LState) int {
+		obj := l.CheckTable(1)
+		key := l.CheckString(2)
+		value, ok := field(obj, "metadata", entries, key).(lua.LString)
+		if l.GetTop() >= 3 {
+			ok = ok && string(value) == l.CheckString(3)
+		}
+		l.Push(lua.LBool(ok))
+		return 1
+	}
+}
+
+func k8sOwnerRefs(l *lua.LState) int {
+	obj := l.CheckTable(1)
+	kind := l.OptString(2, "")
+
+	result := make([]interface{}, 0)
+	if refs, ok := field(obj, "metadata", "ownerReferences").(*lua.LTable); ok {
+		refs.ForEach(func(_, ref lua.LValue) {
+			refTable, ok := ref.(*lua.LTable)
+			if !ok {
+				return
+			}
+			if kind != "" && refTable.RawGetString("kind").String() != kind {
+				return
+			}
+			result = append(result, ref)
+		})
+	}
+	l.Push(sliceToTable(l, result))
+	return 1
+}
+
+func k8sCondition(l *lua.LState) int {
+	obj := l.CheckTable(1)
+	conditionType := l.CheckString(2)
+
+	conditions, ok := field(obj, "status", "conditions").(*lua.LTable)
+	if ok {
+		for i := 1; i <= conditions.Len(); i++ {
+			condition, ok := conditions.RawGetInt(i).(*lua.LTable)
+			if ok && condition.RawGetString("type").String() == conditionType {
+				l.Push(condition)
+				return 1
+			}
+		}
+	}
+	l.Push(lua.LNil)
+	return 1
+}
+
+func k8sParseQuantity(l *lua.LState) int {
+	q, err := apiresource.ParseQuantity(l.CheckString(1))
+	if err != nil {
+		return pushError(l, err.Error())
+	}
+	l.Push(lua.LNumber(q.AsApproximateFloat64()))
+	return 1
+}
+
+func k8sJSONEncode(l *lua.LState) int {
+	return encode(l, "k8s.jsonEncode", json.Marshal)
+}
+
+func k8sJSONDecode(l *lua.LState) int {
+	return decode(l, "k8s.jsonDecode", []byte(checkDocument(l, "k8s.jsonDecode")))
+}
+
+func k8sYAMLEncode(l *lua.LState) int {
+	return encode(l, "k8s.yamlEncode", func(v interface{}) ([]byte, error) {
+		return yaml.Marshal(v)
+	})
+}
+
+func k8sYAMLDecode(l *lua.LState) int {
+	data, err := yaml.YAMLToJSON([]byte(checkDocument(l, "k8s.yamlDecode")))
+	if err != nil {
+		return pushError(l, err.Error())
+	}
+	return decode(l, "k8s.yamlDecode", data)
+}
+
+// encode pushes the document marshal encodes the first argument to, unless
+// either is larger than the maximum string size.
+func encode(l *lua.LState, name string, marshal func(interface{}) ([]byte, error)) int {
+	maxSize := limitsOf(l).MaxStringSize
+	v, err := toBoundedGoValue(l, l.CheckAny(1), maxSize)
+	if err != nil {
+		l.RaiseError("%s: %v", name, err)
+		return 0
+	}
+	data, err := marshal(v)
+	if err != nil {
+		return pushError(l, err.Error())
+	}
+	if len(data) > maxSize {
+		l.RaiseError("%s: result exceeds the maximum string size of %d bytes", name, maxSize)
+		return 0
+	}
+	l.Push(lua.LString(data))
+	return 1
+}
+
+// checkDocument returns the document passed as first argument, unless it is
+// larger than the maximum string size.
+func checkDocument(l *lua.LState, name string) string {
+	document := l.CheckString(1)
+	if maxSize := limitsOf(l).MaxStringSize; len(document) > maxSize {
+		l.RaiseError("%s: document exceeds the maximum string size of %d bytes", name, maxSize)
+	}
+	return document
+}
+
+// decode pushes the lua value of the JSON document data, unless it holds
+// more values than the maximum table size.
+func decode(l *lua.LState, name string, data []byte) int {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return pushError(l, err.Error())
+	}
+	if maxSize := limitsOf(l).MaxTableSize; countValues(v) > maxSize {
+		l.RaiseError("%s: document exceeds the maximum table size of %d values", name, maxSize)
+		return 0
+	}
+	l.Push(toLuaValue(l, toUnstructuredNumbers(v)))
+	return 1
+}
+
+// countValues returns the number of values in v, v included.
+func countValues(v interface{}) int {
+	count := 1
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, element := range v {
+			count += countValues(element)
+		}
+	case []interface{}:
+		for _, element := range v {
+			count += countValues(element)
+		}
+	}
+	return count
+}
+
+// toUnstructuredNumbers converts integral float64 values decoded from JSON to
+// int64, as the unstructured decoder does.
+func toUnstructuredNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = toUnstructuredNumbers(v[key])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = toUnstructuredNumbers(v[i])
+		}
+	}
+	return v
+}
+
+func k8sArray(l *lua.LState) int {
+	elements := make([]interface{}, l.GetTop())
+	for i := range elements {
+		elements[i] = l.Get(i + 1)
+	}
+	l.Push(sliceToTable(l, elements))
+	return 1
+}
+
+func k8sObject(l *lua.LState) int {
+	l.Push(mapToTable(l, map[string]interface{}{}))
+	return 1
+}
+
+func compileRegex(l *lua.LState) *regexp.Regexp {
+	re, err := regexp.Compile(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, err.Error())
+	}
+	return re
+}
+
+func k8sRegexMatch(l *lua.LState) int {
+	re := compileRegex(l)
+	l.Push(lua.LBool(re.MatchString(l.CheckString(2))))
+	return 1
+}
+
+func k8sRegexFind(l *lua.LState) int {
+	re := compileRegex(l)
+	matches := re.FindStringSubmatch(l.CheckString(2))
+	if matches == nil {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(toLuaValue(l, matches))
+	return 1
+}
+
+// k8sRegexReplace replaces the matches one at a time, as ReplaceAllString
+// does, so as to stop once the result exceeds the maximum string size.
+func k8sRegexReplace(l *lua.LState) int {
+	re := compileRegex(l)
+	str, repl := l.CheckString(2), l.CheckString(3)
+	maxSize := limitsOf(l).MaxStringSize
+	var result []byte
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(str, -1) {
+		result = append(result, str[last:match[0]]...)
+		result = re.ExpandString(result, repl, str, match)
+		last = match[1]
+		if len(result) > maxSize {
+			break
+		}
+	}
+	result = append(result, str[last:]...)
+	if len(result) > maxSize {
+		l.RaiseError("k8s.regexReplace: result exceeds the maximum string size of %d bytes", maxSize)
+		return 0
+	}
+	l.Push(lua.LString(result))
+	return 1
+}
+
+func k8sSplit(l *lua.LState) int {
+	maxSize := limitsOf(l).MaxTableSize
+	parts := strings.SplitN(l.CheckString(1), l.CheckString(2), maxSize+1)
+	if len(parts) > maxSize {
+		l.RaiseError("k8s.split: result exceeds the maximum table size of %d values", maxSize)
+		return 0
+	}
+	l.Push(toLuaValue(l, parts))
+	return 1
+}
+
+func k8sJoin(l *lua.LState) int {
+	tbl := l.CheckTable(1)
+	sep := l.OptString(2, "")
+	maxSize := limitsOf(l).MaxStringSize
+	elements := make([]string, 0, tbl.Len())
+	size := 0
+	for i := 1; i <= tbl.Len(); i++ {
+		element := lua.LVAsString(tbl.RawGetInt(i))
+		if size += len(element) + len(sep); size > maxSize+len(sep) {
+			l.RaiseError("k8s.join: result exceeds the maximum string size of %d bytes", maxSize)
+			return 0
+		}
+		elements = append(elements, element)
+	}
+	l.Push(lua.LString(strings.Join(elements, sep)))
+	return 1
+}
+
+func k8sTrim(l *lua.LState) int {
+	l.Push(lua.LString(strings.TrimSpace(l.CheckString(1))))
+	return 1
+}
+
+func k8sStringPredicate(fn func(s, substr string) bool) lua.LGFunction {
+	return func(l *lua.LState) int {
+		l.Push(lua.LBool(fn(l.CheckString(1), l.CheckString(2))))
+		return 1
+	}
+}
@@ -0,0 +1,130 @@
+package resource
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const k8sLibTestObject = `
+obj = {
+  metadata = {
+    name = "web",
+    creationTimestamp = "2024-05-01T10:00:00Z",
+    labels = {app = "web"},
+    annotations = {["cleany.wys1203.com/keep"] = "true"},
+    ownerReferences = {
+      {kind = "ReplicaSet", name = "web-1"},
+      {kind = "Deployment", name = "web"},
+    },
+  },
+  status = {
+    conditions = {
+      {type = "Initialized", status = "True"},
+      {type = "Ready", status = "False", reason = "CrashLoopBackOff"},
+    },
+  },
+}
+`
+
+func TestK8sLib(t *testing.T) {
+	defer func(n func() time.Time) { now = n }(now)
+	now = func() time.Time { return time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{`k8s.age(obj)`, int64(3600)},
+		{`k8s.age({metadata = {}})`, nil},
+		{`k8s.parseTime("2024-05-01T10:00:00Z")`, int64(1714557600)},
+		{`k8s.hasLabel(obj, "app")`, true},
+		{`k8s.hasLabel(obj, "app", "web")`, true},
+		{`k8s.hasLabel(obj, "app", "api")`, false},
+		{`k8s.hasLabel({}, "app")`, false},
+		{`k8s.hasAnnotation(obj, "cleany.wys1203.com/keep", "true")`, true},
+		{`#k8s.ownerRefs(obj)`, int64(2)},
+		{`k8s.ownerRefs(obj, "Deployment")[1].name`, "web"},
+		{`k8s.ownerRefs({}, "Deployment")`, []interface{}{}},
+		{`k8s.condition(obj, "Ready").reason`, "CrashLoopBackOff"},
+		{`k8s.condition(obj, "Scheduled")`, nil},
+		{`k8s.parseQuantity("512Mi")`, int64(512 * 1024 * 1024)},
+		{`k8s.parseQuantity("250m")`, 0.25},
+		{`k8s.jsonEncode({name = "web", ports = {80, 443}, empty = k8s.array(), unset = null})`,
+			`{"empty":[],"name":"web","ports":[80,443],"unset":null}`},
+		{`k8s.jsonDecode('{"replicas": 3, "ratio": 0.5, "items": [], "spec": {}}')`,
+			map[string]interface{}{"replicas": int64(3), "ratio": 0.5, "items": []interface{}{}, "spec": map[string]interface{}{}}},
+		{`k8s.jsonDecode('{"a": null}').a == null`, true},
+		{`k8s.yamlEncode({name = "web", ports = {80}})`, "name: web\nports:\n- 80\n"},
+		{`k8s.yamlDecode("name: web\nports:\n- 80\n")`,
+			map[string]interface{}{"name": "web", "ports": []interface{}{int64(80)}}},
+		{`k8s.object()`, map[string]interface{}{}},
+		{`k8s.array("a", 1)`, []interface{}{"a", int64(1)}},
+		{`k8s.regexMatch("^web-[0-9]+$", "web-12")`, true},
+		{`k8s.regexMatch("^web-[0-9]+$", "web-a")`, false},
+		{`k8s.regexFind("^(.*):(v[0-9.]+)$", "nginx:v1.25")`, []interface{}{"nginx:v1.25", "nginx", "v1.25"}},
+		{`k8s.regexFind("^v", "nginx")`, nil},
+		{`k8s.regexReplace(":(.*)$", "nginx:1.25", ":$1-alpine")`, "nginx:1.25-alpine"},
+		{`k8s.regexReplace("a*", "baaac", "-")`, "-b-c-"},
+		{`k8s.regexReplace("(?P<name>[a-z]+)-([0-9]+)", "web-1 db-22", "${2}_$name")`, "1_web 22_db"},
+		{`k8s.split("a,b,c", ",")`, []interface{}{"a", "b", "c"}},
+		{`k8s.join({"a", "b", 3}, "-")`, "a-b-3"},
+		{`k8s.trim("  web \n")`, "web"},
+		{`k8s.hasPrefix("kube-system", "kube-")`, true},
+		{`k8s.hasSuffix("web.yaml", ".json")`, false},
+		{`k8s.contains("nginx:1.25", ":")`, true},
+	}
+
+	l := newSandboxedState(DefaultLuaLimits)
+	defer l.Close()
+	if err := l.DoString(k8sLibTestObject); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if err := l.DoString("result = " + tt.expr); err != nil {
+				t.Fatal(err)
+			}
+			if got := toGoValue(l, l.GetGlobal("result")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestK8sLibErrors(t *testing.T) {
+	l := newSandboxedState(DefaultLuaLimits)
+	defer l.Close()
+
+	// invalid input returns nil and a message
+	for _, expr := range []string{
+		`k8s.parseTime("yesterday")`,
+		`k8s.age({metadata = {creationTimestamp = "yesterday"}})`,
+		`k8s.parseQuantity("lots")`,
+		`k8s.jsonDecode("{")`,
+		`k8s.yamlDecode("a: [")`,
+	} {
+		if err := l.DoString("result, message = " + expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if result, message := l.GetGlobal("result"), l.GetGlobal("message").String(); result.String() != "nil" || message == "" {
+			t.Errorf("%s: expected nil and a message, got %v %q", expr, result, message)
+		}
+	}
+
+	// invalid arguments raise an error
+	for _, expr := range []string{
+		`k8s.age("web")`,
+		`k8s.hasLabel(obj)`,
+		`k8s.regexMatch("(", "web")`,
+	} {
+		err := l.DoString("result = " + expr)
+		if err == nil {
+			t.Errorf("%s: expected error", expr)
+		} else if !strings.Contains(err.Error(), "argument") {
+			t.Errorf("%s: expected argument error, got %v", expr, err)
+		}
+	}
+}
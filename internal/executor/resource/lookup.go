@@ -0,0 +1,182 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Lookups gives scripts read-only access to the cluster through
+// k8s.get and k8s.list:
+//
+//	k8s.get(group, version, kind, namespace, name)     the object, or nil if it does not exist
+//	k8s.list(group, version, kind, namespace[, labels]) array of objects, namespace "" for all
+//
+// Results are memoized for the lifetime of the Lookups, which is a single
+// run, and at most maxCalls distinct calls reach the API server.
+// Failed calls raise an error rather than returning nil, so a script cannot
+// mistake an unreachable object for a missing one.
+// Lookups is safe for concurrent use.
+type Lookups struct {
+	dynamicClient dynamic.Interface
+	mapper        meta.RESTMapper
+	maxCalls      int
+
+	mu    sync.Mutex
+	calls int
+	cache map[string]interface{}
+}
+
+// NewLookups returns Lookups allowing at most maxCalls API calls.
+func NewLookups(dynamicClient dynamic.Interface, mapper meta.RESTMapper, maxCalls int) *Lookups {
+	return &Lookups{
+		dynamicClient: dynamicClient,
+		mapper:        mapper,
+		maxCalls:      maxCalls,
+		cache:         make(map[string]interface{}),
+	}
+}
+
+// open adds k8s.get and k8s.list to the k8s table. Requires openK8sLib.
+func (lk *Lookups) open(l *lua.LState) {
+	lib, ok := l.GetGlobal(k8sLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	l.SetFuncs(lib, map[string]lua.LGFunction{
+		"get":  lk.luaGet,
+		"list": lk.luaList,
+	})
+}
+
+func (lk *Lookups) luaGet(l *lua.LState) int {
+	gvk := checkGVK(l)
+	namespace := l.CheckString(4)
+	name := l.CheckString(5)
+
+	obj, err := lk.get(l.Context(), gvk, namespace, name)
+	if err != nil {
+		l.RaiseError("k8s.get: %v", err)
+		return 0
+	}
+	if obj == nil {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(mapToTable(l, obj))
+	return 1
+}
+
+func (lk *Lookups) luaList(l *lua.LState) int {
+	gvk := checkGVK(l)
+	namespace := l.CheckString(4)
+	labelSelector := l.OptString(5, "")
+
+	items, err := lk.list(l.Context(), gvk, namespace, labelSelector)
+	if err != nil {
+		l.RaiseError("k8s.list: %v", err)
+		return 0
+	}
+	l.Push(sliceToTable(l, items))
+	return 1
+}
+
+func checkGVK(l *lua.LState) schema.GroupVersionKind {
+	return schema.GroupVersionKind{
+		Group:   l.CheckString(1),
+		Version: l.CheckString(2),
+		Kind:    l.CheckString(3),
+	}
+}
+
+// get returns the content of the object, or nil if it does not exist.
+func (lk *Lookups) get(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) (map[string]interface{}, error) {
+	key := strings.Join([]string{"get", gvk.String(), namespace, name}, "/")
+	result, err := lk.memoize(key, func() (interface{}, error) {
+		resourceInterface, err := lk.resourceInterface(gvk, namespace)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := resourceInterface.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return map[string]interface{}(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return obj.Object, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(map[string]interface{}), nil
+}
+
+// list returns the content of the objects matching labelSelector.
+func (lk *Lookups) list(ctx context.Context, gvk schema.GroupVersionKind, namespace, labelSelector string) ([]interface{}, error) {
+	key := strings.Join([]string{"list", gvk.String(), namespace, labelSelector}, "/")
+	result, err := lk.memoize(key, func() (interface{}, error) {
+		resourceInterface, err := lk.resourceInterface(gvk, namespace)
+		if err != nil {
+			return nil, err
+		}
+		list, err := resourceInterface.List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, len(list.Items))
+		for i := range list.Items {
+			items[i] = list.Items[i].Object
+		}
+		return items, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]interface{}), nil
+}
+
+// memoize returns the cached result for key, or calls fetch and caches its
+// result. Failed calls are not cached but count towards maxCalls.
+func (lk *Lookups) memoize(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	lk.mu.Lock()
+	if result, ok := lk.cache[key]; ok {
+		lk.mu.Unlock()
+		return result, nil
+	}
+	if lk.calls >= lk.maxCalls {
+		lk.mu.Unlock()
+		return nil, fmt.Errorf("lookup limit of %d calls per run exceeded", lk.maxCalls)
+	}
+	lk.calls++
+	lk.mu.Unlock()
+
+	result, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.cache[key] = result
+	return result, nil
+}
+
+func (lk *Lookups) resourceInterface(gvk schema.GroupVersionKind, namespace string) (dynamic.ResourceInterface, error) {
+	mapping, err := lk.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && namespace != "" {
+		return lk.dynamicClient.Resource(mapping.Resource).Namespace(namespace), nil
+	}
+	return lk.dynamicClient.Resource(mapping.Resource), nil
+}
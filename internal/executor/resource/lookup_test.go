@@ -0,0 +1,148 @@
+package resource
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var podGVK = schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+
+const pvcEvaluate = `
+function evaluate()
+  for _, pod in ipairs(k8s.list("", "v1", "Pod", obj.metadata.namespace)) do
+    for _, volume in ipairs(pod.spec.volumes or {}) do
+      if volume.persistentVolumeClaim ~= nil and volume.persistentVolumeClaim.claimName == obj.metadata.name then
+        return {matching = false}
+      end
+    end
+  end
+  return {matching = true, message = "not mounted by any pod"}
+end
+`
+
+func newPVC(name string) *UnstructuredResource {
+	return &UnstructuredResource{Unstructured: unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+	}}}
+}
+
+// newTestLookups returns Lookups backed by a fake client serving pods, and
+// the number of API calls made so far.
+func newTestLookups(maxCalls int, objects ...runtime.Object) (*Lookups, func() int) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(podGVK, meta.RESTScopeNamespace)
+
+	scheme := runtime.NewScheme()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme,
+		map[schema.GroupVersionResource]string{{Version: "v1", Resource: "pods"}: "PodList"}, objects...)
+	calls := 0
+	client.PrependReactor("*", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		return false, nil, nil
+	})
+	return NewLookups(client, mapper, maxCalls), func() int { return calls }
+}
+
+func TestLookups(t *testing.T) {
+	web := newPod(0)
+	web.Object["spec"] = map[string]interface{}{
+		"volumes": []interface{}{
+			map[string]interface{}{"name": "data", "persistentVolumeClaim": map[string]interface{}{"claimName": "data"}},
+		},
+	}
+	lookups, calls := newTestLookups(10, &web.Unstructured)
+
+	script, err := CompileLuaScript("evaluate", pvcEvaluate, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script.EnableLookups(lookups)
+	defer script.Close()
+
+	if match, _, err := newPVC("data").Match(context.Background(), script); err != nil || match {
+		t.Errorf("expected mounted claim not to match, got %t %v", match, err)
+	}
+	match, message, err := newPVC("orphan").Match(context.Background(), script)
+	if err != nil || !match || message != "not mounted by any pod" {
+		t.Errorf("expected orphan claim to match, got %t %q %v", match, message, err)
+	}
+	if n := calls(); n != 1 {
+		t.Errorf("expected list to be memoized, got %d calls", n)
+	}
+}
+
+func TestLookupsGet(t *testing.T) {
+	lookups, _ := newTestLookups(10, &newPod(0).Unstructured)
+
+	script, err := CompileLuaScript("evaluate", `
+function evaluate()
+  local pod = k8s.get("", "v1", "Pod", "default", "pod-0")
+  local missing = k8s.get("", "v1", "Pod", "default", "pod-1")
+  return {matching = pod ~= nil and pod.metadata.name == "pod-0" and missing == nil}
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script.EnableLookups(lookups)
+	defer script.Close()
+
+	if match, _, err := newPod(0).Match(context.Background(), script); err != nil || !match {
+		t.Errorf("expected match, got %t %v", match, err)
+	}
+}
+
+func TestLookupsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxCalls int
+		script   string
+		want     string
+	}{
+		{"limit", 1, `function evaluate()
+  k8s.get("", "v1", "Pod", "default", "a")
+  k8s.get("", "v1", "Pod", "default", "a")
+  k8s.get("", "v1", "Pod", "default", "b")
+  return {}
+end`, "lookup limit of 1 calls per run exceeded"},
+		{"unknown kind", 10, `function evaluate() k8s.list("", "v1", "Widget", "") return {} end`, "Widget"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups, _ := newTestLookups(tt.maxCalls)
+			script, err := CompileLuaScript("evaluate", tt.script, DefaultLuaLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			script.EnableLookups(lookups)
+			defer script.Close()
+
+			_, _, err = newPod(0).Match(context.Background(), script)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLookupsDisabled(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", `function evaluate() k8s.get("", "v1", "Pod", "default", "a") return {} end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	if _, _, err := newPod(0).Match(context.Background(), script); err == nil {
+		t.Error("expected k8s.get to be unavailable")
+	}
+}
@@ -0,0 +1,421 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/wys1203/Cleany/internal/metrics"
+)
+
+// ErrLuaTimeout is returned when a lua call exceeds LuaLimits.CallTimeout.
+var ErrLuaTimeout = errors.New("lua call exceeded its time budget")
+
+// LuaLimits bounds the time, stack and memory a single lua call can use.
+// gopher-lua does not account for allocations, so memory is bounded where
+// values are built in Go: by the functions available to scripts, which
+// refuse to build strings larger than MaxStringSize or tables with more than
+// MaxTableSize values, and by the conversion of the value returned, refused
+// when larger than MaxResultSize. Strings built with .. or string.gsub and
+// tables filled by assignment are only bounded by CallTimeout.
+type LuaLimits struct {
+	// CallTimeout is the maximum duration of a single call
+	CallTimeout time.Duration
+
+	// MaxStackSize is the maximum number of values on the lua stack
+	MaxStackSize int
+
+	// MaxCallDepth is the maximum depth of nested function calls
+	MaxCallDepth int
+
+	// MaxStringSize is the maximum size, in bytes, of a string built by
+	// string.rep, table.concat, k8s.join, k8s.regexReplace, k8s.jsonEncode
+	// and k8s.yamlEncode, and of a document decoded by k8s.jsonDecode and
+	// k8s.yamlDecode
+	MaxStringSize int
+
+	// MaxTableSize is the maximum number of values in a table built by
+	// k8s.split, k8s.jsonDecode and k8s.yamlDecode, or grown by
+	// table.insert
+	MaxTableSize int
+
+	// MaxResultSize is the maximum size, in bytes, of the value returned
+	// by a call once converted to Go, counting the length of strings and 8
+	// bytes for any other value
+	MaxResultSize int
+}
+
+// DefaultLuaLimits are the limits used when none is configured.
+var DefaultLuaLimits = LuaLimits{
+	CallTimeout:   time.Second,
+	MaxStackSize:  256 * 1024,
+	MaxCallDepth:  200,
+	MaxStringSize: 1024 * 1024,
+	MaxTableSize:  100 * 1024,
+	MaxResultSize: 4 * 1024 * 1024,
+}
+
+// sandboxedOsFuncs are the only functions kept in the os library.
+var sandboxedOsFuncs = []string{"clock", "date", "difftime", "time"}
+
+// removedBaseFuncs are base functions not available to scripts, as they
+// can load code from the filesystem or outside the script.
+var removedBaseFuncs = []string{"dofile", "loadfile", "load", "loadstring", "module", "require", "collectgarbage"}
+
+// LuaScript is a lua script compiled once and executed on a pool of LStates,
+// so the script is neither parsed nor loaded again for every object.
+// A LuaScript is safe for concurrent use: each caller gets its own LState.
+//
+// Scripts run in a sandbox: only the base, table, string and math libraries
+// and a subset of os are available, along with the k8s helpers, and each call
+// is bounded in time and stack by LuaLimits.
+//
+// The global variables are reset after each call to their values once the
+// script was loaded, so a call does not see the globals set by the calls made
+// before on the same LState. The tables they hold are shared by the calls
+// though, and must not be used to keep state from one object to the next.
+type LuaScript struct {
+	name   string
+	proto  *lua.FunctionProto
+	limits LuaLimits
+
+	// lookups, if set, is made available to the script as k8s.get and k8s.list
+	lookups *Lookups
+
+	// modules can be loaded by the script with require
+	modules LuaModules
+
+	mu     sync.Mutex
+	states []*lua.LState
+}
+
+// CompileLuaScript compiles source. The name is used in error messages.
+func CompileLuaScript(name, source string, limits LuaLimits) (*LuaScript, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	return &LuaScript{name: name, proto: proto, limits: limits}, nil
+}
+
+// EnableLookups gives the script read-only access to the cluster through
+// lookups. Must be called before the script is first invoked.
+func (s *LuaScript) EnableLookups(lookups *Lookups) {
+	s.lookups = lookups
+}
+
+// UseModules lets the script load modules with require. Must be called
+// before the script is first invoked.
+func (s *LuaScript) UseModules(modules LuaModules) {
+	s.modules = modules
+}
+
+// Validate loads the script, which runs its top level statements and the
+// modules they require, and reports any error, including any of functions
+// not being defined as a global function by the script.
+func (s *LuaScript) Validate(ctx context.Context, functions ...string) error {
+	l, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.put(l)
+
+	for _, fn := range functions {
+		if _, ok := l.GetGlobal(fn).(*lua.LFunction); !ok {
+			return fmt.Errorf("%s: function %s is not defined", s.name, fn)
+		}
+	}
+	return nil
+}
+
+// Close releases all idle LStates.
+func (s *LuaScript) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.states {
+		l.Close()
+	}
+	s.states = nil
+}
+
+// call invokes the global function fn defined by the script with arg, which
+// is also set as the global named global, and returns the value it returns
+// converted to Go. The call is aborted when ctx is done or the time budget
+// is exhausted.
+func (s *LuaScript) call(ctx context.Context, fn, global string, arg interface{}) (interface{}, error) {
+	defer metrics.ObserveSince(metrics.LuaDuration.WithLabelValues(fn), time.Now())
+
+	l, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, s.limits.CallTimeout)
+	defer cancel()
+
+	luaArg := toLuaValue(l, arg)
+	l.SetContext(callCtx)
+	l.SetGlobal(global, luaArg)
+	err = l.CallByParam(lua.P{
+		Fn:      l.GetGlobal(fn), // name of Lua function
+		NRet:    1,               // number of returned values
+		Protect: true,            // return err or panic
+	}, luaArg)
+	l.RemoveContext()
+	if err != nil {
+		// do not reuse a state left in an unknown condition
+		l.Close()
+		return nil, s.callError(ctx, callCtx, err)
+	}
+
+	lv := l.Get(-1)
+	l.Pop(1)
+	if _, ok := lv.(*lua.LTable); !ok {
+		s.put(l)
+		return nil, fmt.Errorf("%s", luaTableError)
+	}
+	result, err := toBoundedGoValue(l, lv, s.limits.MaxResultSize)
+	s.put(l)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s returned %w", s.name, fn, err)
+	}
+
+	return result, nil
+}
+
+// callError reports a call aborted by its time budget as ErrLuaTimeout.
+func (s *LuaScript) callError(ctx, callCtx context.Context, err error) error {
+	if ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w (%s)", s.name, ErrLuaTimeout, s.limits.CallTimeout)
+	}
+	return err
+}
+
+// get returns an idle LState, or a new one with the script loaded.
+func (s *LuaScript) get(ctx context.Context) (*lua.LState, error) {
+	s.mu.Lock()
+	if n := len(s.states); n > 0 {
+		l := s.states[n-1]
+		s.states = s.states[:n-1]
+		s.mu.Unlock()
+		return l, nil
+	}
+	s.mu.Unlock()
+
+	l := newSandboxedState(s.limits)
+	if s.lookups != nil {
+		s.lookups.open(l)
+	}
+	if s.modules != nil {
+		s.modules.open(l)
+	}
+
+	// loading the script runs its top level statements, which are
+	// subject to the same budget as any call
+	loadCtx, cancel := context.WithTimeout(ctx, s.limits.CallTimeout)
+	defer cancel()
+
+	l.SetContext(loadCtx)
+	l.Push(l.NewFunctionFromProto(s.proto))
+	err := l.PCall(0, lua.MultRet, nil)
+	l.RemoveContext()
+	if err != nil {
+		l.Close()
+		return nil, s.callError(ctx, loadCtx, err)
+	}
+	saveGlobals(l)
+	return l, nil
+}
+
+// put resets the globals of an LState and returns it to the pool.
+func (s *LuaScript) put(l *lua.LState) {
+	resetGlobals(l)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states = append(s.states, l)
+}
+
+// globalsKey is the registry key of the globals of an LState, as they were
+// once the script was loaded
+const globalsKey = "cleany.globals"
+
+// saveGlobals records the globals of l, to be restored by resetGlobals.
+func saveGlobals(l *lua.LState) {
+	saved := l.NewTable()
+	l.G.Global.ForEach(func(key, value lua.LValue) {
+		saved.RawSet(key, value)
+	})
+	l.G.Registry.RawSetString(globalsKey, saved)
+}
+
+// resetGlobals restores the globals of l recorded by saveGlobals: globals set
+// since are removed and globals changed are set back.
+func resetGlobals(l *lua.LState) {
+	saved, ok := l.G.Registry.RawGetString(globalsKey).(*lua.LTable)
+	if !ok {
+		return
+	}
+	var added []lua.LValue
+	l.G.Global.ForEach(func(key, _ lua.LValue) {
+		if saved.RawGet(key) == lua.LNil {
+			added = append(added, key)
+		}
+	})
+	for _, key := range added {
+		l.G.Global.RawSet(key, lua.LNil)
+	}
+	saved.ForEach(func(key, value lua.LValue) {
+		l.G.Global.RawSet(key, value)
+	})
+}
+
+// newSandboxedState returns an LState with a restricted standard library and
+// stack sizes bounded by limits.
+func newSandboxedState(limits LuaLimits) *lua.LState {
+	l := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       limits.MaxCallDepth,
+		RegistryMaxSize:     limits.MaxStackSize,
+		MinimizeStackMemory: true,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		l.Push(l.NewFunction(lib.open))
+		l.Push(lua.LString(lib.name))
+		l.Call(1, 0)
+	}
+
+	openConversion(l)
+	openK8sLib(l)
+	setLimits(l, limits)
+
+	for _, name := range removedBaseFuncs {
+		l.SetGlobal(name, lua.LNil)
+	}
+
+	// keep only the os functions reading the clock
+	osLib := l.NewTable()
+	if fullOsLib, ok := l.GetGlobal(lua.OsLibName).(*lua.LTable); ok {
+		for _, name := range sandboxedOsFuncs {
+			osLib.RawSetString(name, fullOsLib.RawGetString(name))
+		}
+	}
+	l.SetGlobal(lua.OsLibName, osLib)
+
+	// bound the strings string.rep and table.concat can build, and the
+	// tables table.insert can grow
+	if stringLib, ok := l.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		stringLib.RawSetString("rep", l.NewFunction(stringRep(limits.MaxStringSize)))
+	}
+	if tableLib, ok := l.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		if concat, ok := tableLib.RawGetString("concat").(*lua.LFunction); ok {
+			tableLib.RawSetString("concat", l.NewFunction(tableConcat(concat.GFunction, limits.MaxStringSize)))
+		}
+		if insert, ok := tableLib.RawGetString("insert").(*lua.LFunction); ok {
+			tableLib.RawSetString("insert", l.NewFunction(tableInsert(insert.GFunction, limits.MaxTableSize)))
+		}
+	}
+
+	return l
+}
+
+// limitsRegistryKey is the registry key of the LuaLimits of an LState
+const limitsRegistryKey = "cleany.limits"
+
+// setLimits records limits in the registry of l, for the functions
+// available to scripts.
+func setLimits(l *lua.LState, limits LuaLimits) {
+	ud := l.NewUserData()
+	ud.Value = limits
+	l.G.Registry.RawSetString(limitsRegistryKey, ud)
+}
+
+// limitsOf returns the LuaLimits of l recorded by setLimits.
+func limitsOf(l *lua.LState) LuaLimits {
+	if ud, ok := l.G.Registry.RawGetString(limitsRegistryKey).(*lua.LUserData); ok {
+		if limits, ok := ud.Value.(LuaLimits); ok {
+			return limits
+		}
+	}
+	return DefaultLuaLimits
+}
+
+// stringRep is string.rep refusing to build strings bigger than maxSize.
+func stringRep(maxSize int) lua.LGFunction {
+	return func(l *lua.LState) int {
+		str := l.CheckString(1)
+		n := l.CheckInt(2)
+		if n <= 0 || str == "" {
+			l.Push(lua.LString(""))
+			return 1
+		}
+		if len(str) > maxSize/n {
+			l.RaiseError("string.rep: result exceeds the maximum string size of %d bytes", maxSize)
+			return 0
+		}
+		l.Push(lua.LString(strings.Repeat(str, n)))
+		return 1
+	}
+}
+
+// tableConcat is table.concat, implemented by concat, refusing to build
+// strings bigger than maxSize.
+func tableConcat(concat lua.LGFunction, maxSize int) lua.LGFunction {
+	return func(l *lua.LState) int {
+		tbl := l.CheckTable(1)
+		sep := l.OptString(2, "")
+		i := l.OptInt(3, 1)
+		j := l.OptInt(4, tbl.Len())
+		size := 0
+		for k := i; k <= j; k++ {
+			value := tbl.RawGetInt(k)
+			if value == lua.LNil {
+				// left to concat to report
+				break
+			}
+			size += len(lua.LVAsString(value))
+			if k > i {
+				size += len(sep)
+			}
+			if size > maxSize {
+				l.RaiseError("table.concat: result exceeds the maximum string size of %d bytes", maxSize)
+				return 0
+			}
+		}
+		return concat(l)
+	}
+}
+
+// tableInsert is table.insert, implemented by insert, refusing to grow
+// tables beyond maxSize values.
+func tableInsert(insert lua.LGFunction, maxSize int) lua.LGFunction {
+	return func(l *lua.LState) int {
+		if tbl := l.CheckTable(1); tbl.Len() >= maxSize {
+			l.RaiseError("table.insert: table exceeds the maximum table size of %d values", maxSize)
+			return 0
+		}
+		return insert(l)
+	}
+}
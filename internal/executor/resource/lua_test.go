@@ -0,0 +1,485 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+const benchEvaluate = `
+function evaluate()
+  hs = {}
+  hs.matching = false
+  if obj.metadata.labels ~= nil and obj.metadata.labels["app"] == "web" then
+    for _, c in ipairs(obj.spec.containers) do
+      if c.image == "nginx:1.25" then
+        hs.matching = true
+        hs.message = "outdated image"
+      end
+    end
+  end
+  return hs
+end
+`
+
+func newPod(i int) *UnstructuredResource {
+	return &UnstructuredResource{Unstructured: unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":      fmt.Sprintf("pod-%d", i),
+			"namespace": "default",
+			"labels":    map[string]interface{}{"app": "web"},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "web", "image": "nginx:1.25"},
+				map[string]interface{}{"name": "sidecar", "image": "envoy:1.30"},
+			},
+		},
+	}}}
+}
+
+func TestMatch(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", benchEvaluate, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	match, message, err := newPod(0).Match(context.Background(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match || message != "outdated image" {
+		t.Errorf("expected match with message, got %t %q", match, message)
+	}
+
+	match, _, err = (&UnstructuredResource{}).Match(context.Background(), nil)
+	if err != nil || !match {
+		t.Errorf("expected nil script to match, got %t %v", match, err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", `
+function evaluate()
+  return {
+    matching = true,
+    message = "outdated image",
+    action = "Scan",
+    severity = "High",
+    details = {image = obj.spec.containers[1].image, containers = #obj.spec.containers, ports = {80, 443}},
+  }
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	result, err := newPod(0).Evaluate(context.Background(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &EvaluateResult{
+		Matching: true,
+		Message:  "outdated image",
+		Action:   cleanyv1alpha1.ActionScan,
+		Severity: cleanyv1alpha1.SeverityHigh,
+		Details:  map[string]string{"image": "nginx:1.25", "containers": "2", "ports": "[80,443]"},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("unexpected result:\n got: %+v\nwant: %+v", result, want)
+	}
+
+	for _, output := range []string{
+		`{matching = true, action = "Archive"}`,
+		`{matching = true, severity = "Urgent"}`,
+		`{matching = true, details = {"a", "b"}}`,
+	} {
+		script, err := CompileLuaScript("evaluate", "function evaluate() return "+output+" end", DefaultLuaLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer script.Close()
+		if _, err := newPod(0).Evaluate(context.Background(), script); err == nil {
+			t.Errorf("expected error for %s", output)
+		}
+	}
+}
+
+func TestMatchReusesStates(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", benchEvaluate, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := newPod(i).Match(context.Background(), script); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(script.states); n != 1 {
+		t.Errorf("expected a single pooled state, got %d", n)
+	}
+}
+
+func TestMatchResetsGlobals(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", `
+threshold = 1
+function evaluate()
+  local first = seen == nil and threshold == 1
+  seen = true
+  threshold = threshold + 1
+  return {matching = first}
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	for i := 0; i < 3; i++ {
+		match, _, err := newPod(i).Match(context.Background(), script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !match {
+			t.Errorf("call %d saw the globals of a previous call", i)
+		}
+	}
+	if n := len(script.states); n != 1 {
+		t.Errorf("expected a single pooled state, got %d", n)
+	}
+}
+
+func TestMatchConcurrent(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", benchEvaluate, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if match, _, err := newPod(j).Match(context.Background(), script); err != nil || !match {
+					t.Errorf("unexpected result %t %v", match, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMatchErrors(t *testing.T) {
+	if _, err := CompileLuaScript("evaluate", "function evaluate(", DefaultLuaLimits); err == nil {
+		t.Error("expected syntax error")
+	}
+
+	script, err := CompileLuaScript("evaluate", `function evaluate() return 1 end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+	if _, _, err := newPod(0).Match(context.Background(), script); err == nil {
+		t.Error("expected error for non table result")
+	}
+
+	script, err = CompileLuaScript("evaluate", `function evaluate() error("boom") end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+	if _, _, err := newPod(0).Match(context.Background(), script); err == nil {
+		t.Error("expected runtime error")
+	}
+	if n := len(script.states); n != 0 {
+		t.Errorf("expected failed state to be discarded, got %d pooled", n)
+	}
+}
+
+func TestValidateFunctions(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", `
+evaluate = 42
+function transform() return obj end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	if err := script.Validate(context.Background(), "transform"); err != nil {
+		t.Errorf("expected transform to be defined, got %v", err)
+	}
+	for _, fn := range []string{"evaluate", "missing"} {
+		if err := script.Validate(context.Background(), fn); err == nil ||
+			!strings.Contains(err.Error(), fn) {
+			t.Errorf("expected error naming %s, got %v", fn, err)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	script, err := CompileLuaScript("transform", `
+function transform()
+  obj.metadata.labels["app"] = "api"
+  return obj
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	transformed, err := newPod(0).Transform(context.Background(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app := transformed.GetLabels()["app"]; app != "api" {
+		t.Errorf("expected label app=api, got %q", app)
+	}
+}
+
+// matchFreshState reproduces matching with a new LState, loading the script,
+// for every object. It is the baseline for BenchmarkMatch.
+func matchFreshState(r *UnstructuredResource, source string) (bool, error) {
+	l := lua.NewState()
+	defer l.Close()
+	openConversion(l)
+
+	obj := mapToTable(l, r.UnstructuredContent())
+	if err := l.DoString(source); err != nil {
+		return false, err
+	}
+	l.SetGlobal("obj", obj)
+	if err := l.CallByParam(lua.P{Fn: l.GetGlobal("evaluate"), NRet: 1, Protect: true}, obj); err != nil {
+		return false, err
+	}
+	tbl, ok := l.Get(-1).(*lua.LTable)
+	if !ok {
+		return false, fmt.Errorf("%s", luaTableError)
+	}
+	return lua.LVAsBool(tbl.RawGetString("matching")), nil
+}
+
+func BenchmarkMatchFreshState(b *testing.B) {
+	pod := newPod(0)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := matchFreshState(pod, benchEvaluate); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	pod := newPod(0)
+	script, err := CompileLuaScript("evaluate", benchEvaluate, DefaultLuaLimits)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer script.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := pod.Match(context.Background(), script); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatchParallel(b *testing.B) {
+	script, err := CompileLuaScript("evaluate", benchEvaluate, DefaultLuaLimits)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer script.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		pod := newPod(0)
+		for pb.Next() {
+			if _, _, err := pod.Match(context.Background(), script); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSandbox(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"os.execute", `function evaluate() os.execute("ls") return {} end`},
+		{"os.getenv", `function evaluate() os.getenv("HOME") return {} end`},
+		{"io", `function evaluate() io.open("/etc/passwd") return {} end`},
+		{"loadfile", `function evaluate() loadfile("/etc/passwd") return {} end`},
+		{"dofile", `function evaluate() dofile("/etc/passwd") return {} end`},
+		{"require", `function evaluate() require("os") return {} end`},
+		{"load", `function evaluate() load("return 1") return {} end`},
+		{"string.rep", `function evaluate() local s = string.rep("x", 1024 * 1024 * 1024) return {} end`},
+		{"recursion", `function f(n) return f(n + 1) + 1 end
+function evaluate() f(1) return {} end`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := CompileLuaScript("evaluate", tt.script, DefaultLuaLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer script.Close()
+
+			if _, _, err := newPod(0).Match(context.Background(), script); err == nil {
+				t.Error("expected sandbox violation")
+			}
+		})
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	limits := DefaultLuaLimits
+	limits.MaxStringSize = 1024
+	limits.MaxTableSize = 100
+	limits.MaxResultSize = 4096
+
+	tests := []struct {
+		name    string
+		script  string
+		limited bool
+	}{
+		{"result", `return {data = string.rep("x", 1000), more = string.rep("y", 1000),
+  others = {string.rep("z", 1000), string.rep("z", 1000), string.rep("z", 1000)}}`, true},
+		{"result within", `return {data = string.rep("x", 1000)}`, false},
+		{"cyclic result", `local t = {} t.self = t return t`, true},
+		{"table.concat", `local t = {} for i = 1, 30 do t[i] = string.rep("x", 50) end
+return {s = table.concat(t)}`, true},
+		{"table.concat within", `return {s = table.concat({"a", "b"}, ",")}`, false},
+		{"table.insert", `local t = {} for i = 1, 101 do table.insert(t, i) end return {}`, true},
+		{"table.insert within", `local t = {} for i = 1, 100 do table.insert(t, i) end return {}`, false},
+		{"k8s.join", `local t = {} for i = 1, 30 do t[i] = string.rep("x", 50) end
+return {s = k8s.join(t, ",")}`, true},
+		{"k8s.join within", `return {s = k8s.join({string.rep("x", 512), string.rep("y", 511)}, ",")}`, false},
+		{"k8s.regexReplace", `return {s = k8s.regexReplace("(.)", string.rep("x", 100), "$1$1$1$1$1$1$1$1$1$1$1")}`, true},
+		{"k8s.regexReplace within", `return {s = k8s.regexReplace("(.)", string.rep("x", 100), "$1$1")}`, false},
+		{"k8s.split", `return {s = k8s.split(string.rep("x", 101), "")}`, true},
+		{"k8s.split within", `return {s = k8s.split(string.rep("x", 100), "")}`, false},
+		{"k8s.jsonDecode", `return {v = k8s.jsonDecode("[" .. string.rep("[],", 100) .. "[]]")}`, true},
+		{"k8s.jsonDecode document", `return {v = k8s.jsonDecode('"' .. string.rep("x", 1024) .. '"')}`, true},
+		{"k8s.jsonDecode within", `return {v = k8s.jsonDecode("[" .. string.rep("[],", 98) .. "[]]")}`, false},
+		{"k8s.yamlDecode", `return {v = k8s.yamlDecode("[" .. string.rep("a,", 100) .. "a]")}`, true},
+		{"k8s.jsonEncode", `local t = {} for i = 1, 30 do t[i] = string.rep("x", 50) end
+return {s = k8s.jsonEncode(t)}`, true},
+		{"k8s.jsonEncode within", `return {s = k8s.jsonEncode({a = 1})}`, false},
+		{"k8s.yamlEncode", `local t = {} for i = 1, 30 do t[i] = string.rep("x", 50) end
+return {s = k8s.yamlEncode(t)}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := CompileLuaScript("transform", "function transform()\n"+tt.script+"\nend", limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer script.Close()
+
+			_, err = script.call(context.Background(), "transform", "obj", map[string]interface{}{})
+			switch {
+			case tt.limited && (err == nil || !strings.Contains(err.Error(), "exceed")):
+				t.Errorf("expected the limit to be exceeded, got %v", err)
+			case !tt.limited && err != nil:
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSandboxAllowsClock(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", `
+function evaluate()
+  return {matching = os.time() > 0 and os.clock() >= 0 and os.date("%Y") ~= ""}
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	match, _, err := newPod(0).Match(context.Background(), script)
+	if err != nil || !match {
+		t.Errorf("expected match, got %t %v", match, err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	limits := DefaultLuaLimits
+	limits.CallTimeout = 50 * time.Millisecond
+
+	script, err := CompileLuaScript("evaluate", `function evaluate() while true do end end`, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	start := time.Now()
+	_, _, err = newPod(0).Match(context.Background(), script)
+	if !errors.Is(err, ErrLuaTimeout) {
+		t.Fatalf("expected ErrLuaTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("call was not interrupted in time: %s", elapsed)
+	}
+
+	// top level statements are bounded as well
+	script, err = CompileLuaScript("evaluate", `while true do end`, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+	if _, _, err = newPod(0).Match(context.Background(), script); !errors.Is(err, ErrLuaTimeout) {
+		t.Fatalf("expected ErrLuaTimeout, got %v", err)
+	}
+
+	// strings built with .. are only bounded by the time budget
+	script, err = CompileLuaScript("evaluate",
+		`function evaluate() local s = "" while true do s = s .. "x" end end`, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+	if _, _, err = newPod(0).Match(context.Background(), script); !errors.Is(err, ErrLuaTimeout) {
+		t.Fatalf("expected ErrLuaTimeout, got %v", err)
+	}
+}
+
+func TestCallCancelled(t *testing.T) {
+	script, err := CompileLuaScript("evaluate", `function evaluate() while true do end end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err = newPod(0).Match(ctx, script)
+	if err == nil || errors.Is(err, ErrLuaTimeout) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "context") {
+		t.Errorf("expected context error, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package resource
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// loadedModulesKey is the registry key of the table caching, for an LState,
+// the values returned by the modules already loaded.
+const loadedModulesKey = "cleany.loaded"
+
+// LuaModules are compiled lua modules, by name, that scripts can load with
+// require. Unlike the standard require, only these modules can be loaded.
+type LuaModules map[string]*lua.FunctionProto
+
+// CompileLuaModules compiles the source of each module.
+func CompileLuaModules(sources map[string]string) (LuaModules, error) {
+	modules := make(LuaModules, len(sources))
+	for name, source := range sources {
+		chunk, err := parse.Parse(strings.NewReader(source), name)
+		if err != nil {
+			return nil, fmt.Errorf("lua module %s: %w", name, err)
+		}
+		proto, err := lua.Compile(chunk, name)
+		if err != nil {
+			return nil, fmt.Errorf("lua module %s: %w", name, err)
+		}
+		modules[name] = proto
+	}
+	return modules, nil
+}
+
+// open sets the global require to a function loading modules.
+func (modules LuaModules) open(l *lua.LState) {
+	l.Get(lua.RegistryIndex).(*lua.LTable).RawSetString(loadedModulesKey, l.NewTable())
+	l.SetGlobal("require", l.NewFunction(modules.require))
+}
+
+// require runs the module once per LState and returns the value it returns,
+// or true if it returns nothing.
+func (modules LuaModules) require(l *lua.LState) int {
+	name := l.CheckString(1)
+	loaded := l.Get(lua.RegistryIndex).(*lua.LTable).RawGetString(loadedModulesKey).(*lua.LTable)
+	if value := loaded.RawGetString(name); value != lua.LNil {
+		l.Push(value)
+		return 1
+	}
+
+	proto, ok := modules[name]
+	if !ok {
+		l.RaiseError("module %q not found in the lua libraries", name)
+		return 0
+	}
+	l.Push(l.NewFunctionFromProto(proto))
+	l.Call(0, 1)
+	value := l.Get(-1)
+	l.Pop(1)
+	if value == lua.LNil {
+		value = lua.LTrue
+	}
+	loaded.RawSetString(name, value)
+	l.Push(value)
+	return 1
+}
@@ -0,0 +1,79 @@
+package resource
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	modules, err := CompileLuaModules(map[string]string{
+		"labels": `
+local M = {}
+loads = (loads or 0) + 1
+function M.app(obj)
+  return obj.metadata.labels["app"]
+end
+return M`,
+		"noreturn": `answer = 42`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := CompileLuaScript("evaluate", `
+local labels = require("labels")
+function evaluate()
+  local again = require("labels")
+  return {matching = again == labels and labels.app(obj) == "web" and loads == 1 and require("noreturn") == true and answer == 42}
+end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script.UseModules(modules)
+	defer script.Close()
+
+	if err := script.Validate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	match, _, err := newPod(0).Match(context.Background(), script)
+	if err != nil || !match {
+		t.Errorf("expected match, got %t %v", match, err)
+	}
+}
+
+func TestRequireErrors(t *testing.T) {
+	if _, err := CompileLuaModules(map[string]string{"broken": "function ("}); err == nil ||
+		!strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected syntax error naming the module, got %v", err)
+	}
+
+	modules, err := CompileLuaModules(map[string]string{"failing": `error("module failed")`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"unknown", `require("missing")`, `module "missing" not found`},
+		{"failing", `require("failing")`, "module failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := CompileLuaScript("evaluate", tt.script, DefaultLuaLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			script.UseModules(modules)
+			defer script.Close()
+
+			err = script.Validate(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package resource
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
-	lua "github.com/yuin/gopher-lua"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
 )
 
 type UnstructuredResource struct {
@@ -13,68 +15,133 @@ type UnstructuredResource struct {
 }
 
 type evaluateStatus struct {
-	Matching bool   `json:"matching"`
-	Message  string `json:"message"`
+	Matching bool                    `json:"matching"`
+	Message  string                  `json:"message"`
+	Action   cleanyv1alpha1.Action   `json:"action"`
+	Severity cleanyv1alpha1.Severity `json:"severity"`
+	Details  map[string]interface{}  `json:"details"`
+}
+
+// EvaluateResult is the outcome of the evaluate function for a resource.
+type EvaluateResult struct {
+	// Matching is true if the resource is selected
+	Matching bool
+
+	// Message is an optional message about the resource
+	Message string
+
+	// Action, if set, overrides the Cleaner action for the resource
+	Action cleanyv1alpha1.Action
+
+	// Severity, if set, ranks the resource
+	Severity cleanyv1alpha1.Severity
+
+	// Details are arbitrary key/values about the resource
+	Details map[string]string
 }
 
 const (
 	luaTableError = "lua script output is not a lua table"
 	luaBoolError  = "lua script output is not a lua bool"
+	luaMapError   = "lua script output is not a lua table with string keys"
 )
 
-func (r *UnstructuredResource) Match(script string) (bool, string, error) {
-	if script == "" {
-		return true, "", nil
+var (
+	validActions = map[cleanyv1alpha1.Action]bool{
+		cleanyv1alpha1.ActionDelete:    true,
+		cleanyv1alpha1.ActionTransform: true,
+		cleanyv1alpha1.ActionScan:      true,
 	}
+	validSeverities = map[cleanyv1alpha1.Severity]bool{
+		cleanyv1alpha1.SeverityInfo:     true,
+		cleanyv1alpha1.SeverityLow:      true,
+		cleanyv1alpha1.SeverityMedium:   true,
+		cleanyv1alpha1.SeverityHigh:     true,
+		cleanyv1alpha1.SeverityCritical: true,
+	}
+)
 
-	l := lua.NewState()
-	defer l.Close()
-
-	obj := mapToTable(r.UnstructuredContent())
-
-	if err := l.DoString(script); err != nil {
-		// logger.Info(fmt.Sprintf("doString failed: %v", err))
+// Match invokes the lua function "evaluate" defined in script with the
+// resource. A nil script matches every resource.
+func (r *UnstructuredResource) Match(ctx context.Context, script *LuaScript) (bool, string, error) {
+	result, err := r.Evaluate(ctx, script)
+	if err != nil {
 		return false, "", err
 	}
+	return result.Matching, result.Message, nil
+}
 
-	l.SetGlobal("obj", obj)
-
-	if err := l.CallByParam(lua.P{
-		Fn:      l.GetGlobal("evaluate"), // name of Lua function
-		NRet:    1,                       // number of returned values
-		Protect: true,                    // return err or panic
-	}, obj); err != nil {
-		// logger.Info(fmt.Sprintf("failed to evaluate health for resource: %v", err))
-		return false, "", err
+// Evaluate invokes the lua function "evaluate" defined in script with the
+// resource. Besides "matching" and "message", the function can return an
+// "action" overriding the Cleaner action for the resource, a "severity" and
+// "details", a table of key/values. A nil script matches every resource.
+func (r *UnstructuredResource) Evaluate(ctx context.Context, script *LuaScript) (*EvaluateResult, error) {
+	if script == nil {
+		return &EvaluateResult{Matching: true}, nil
 	}
 
-	lv := l.Get(-1)
-	tbl, ok := lv.(*lua.LTable)
-	if !ok {
-		// logger.Info(luaTableError)
-		return false, "", fmt.Errorf("%s", luaTableError)
+	goResult, err := script.call(ctx, "evaluate", "obj", r.UnstructuredContent())
+	if err != nil {
+		return nil, err
 	}
 
-	goResult := toGoValue(tbl)
-	var resultJson []byte
 	resultJson, err := json.Marshal(goResult)
 	if err != nil {
-		// logger.Info(fmt.Sprintf("failed to marshal result: %v", err))
-		return false, "", err
+		return nil, err
+	}
+
+	var status evaluateStatus
+	if err := json.Unmarshal(resultJson, &status); err != nil {
+		return nil, fmt.Errorf("invalid evaluate output: %w", err)
 	}
 
-	var result evaluateStatus
-	err = json.Unmarshal(resultJson, &result)
+	if status.Action != "" && !validActions[status.Action] {
+		return nil, fmt.Errorf("invalid action %q returned by evaluate", status.Action)
+	}
+	if status.Severity != "" && !validSeverities[status.Severity] {
+		return nil, fmt.Errorf("invalid severity %q returned by evaluate", status.Severity)
+	}
+
+	result := &EvaluateResult{
+		Matching: status.Matching,
+		Message:  status.Message,
+		Action:   status.Action,
+		Severity: status.Severity,
+	}
+	if len(status.Details) != 0 {
+		result.Details = make(map[string]string, len(status.Details))
+		for key, value := range status.Details {
+			result.Details[key] = detailString(value)
+		}
+	}
+	return result, nil
+}
+
+// detailString returns a detail value as a string, JSON encoded unless it
+// already is a string.
+func detailString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
 	if err != nil {
-		// logger.Info(fmt.Sprintf("failed to marshal result: %v", err))
-		return false, "", err
+		return fmt.Sprint(value)
 	}
+	return string(data)
+}
 
-	if result.Message != "" {
-		// logger.Info(fmt.Sprintf("message: %s", result.Message))
+// Transform invokes the lua function "transform" defined in script with the
+// resource and returns the object it returns.
+func (r *UnstructuredResource) Transform(ctx context.Context, script *LuaScript) (*unstructured.Unstructured, error) {
+	goResult, err := script.call(ctx, "transform", "obj", r.UnstructuredContent())
+	if err != nil {
+		return nil, err
 	}
 
-	// logger.V(logs.LogDebug).Info(fmt.Sprintf("is a match: %t", result.Matching))
+	content, ok := goResult.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s", luaMapError)
+	}
 
-	return result.Matching, result.Message, nil
+	return &unstructured.Unstructured{Object: content}, nil
 }
@@ -1,102 +1,155 @@
 package resource
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
 	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-// mapToTable converts a Go map to a lua table
-// credit to: https://github.com/yuin/gopher-lua/issues/160#issuecomment-447608033
-func mapToTable(m map[string]interface{}) *lua.LTable {
-	// Main table pointer
-	resultTable := &lua.LTable{}
-
-	// Loop map
-	for key, element := range m {
-		switch element := element.(type) {
-		case float64:
-			resultTable.RawSetString(key, lua.LNumber(element))
-		case int64:
-			resultTable.RawSetString(key, lua.LNumber(element))
-		case string:
-			resultTable.RawSetString(key, lua.LString(element))
-		case bool:
-			resultTable.RawSetString(key, lua.LBool(element))
-		case []byte:
-			resultTable.RawSetString(key, lua.LString(string(element)))
-		case map[string]interface{}:
-
-			// Get table from map
-			tble := mapToTable(element)
-
-			resultTable.RawSetString(key, tble)
-
-		case time.Time:
-			resultTable.RawSetString(key, lua.LNumber(element.Unix()))
-
-		case []map[string]interface{}:
-
-			// Create slice table
-			sliceTable := &lua.LTable{}
-
-			// Loop element
-			for _, s := range element {
-				// Get table from map
-				tble := mapToTable(s)
-
-				sliceTable.Append(tble)
-			}
-
-			// Set slice table
-			resultTable.RawSetString(key, sliceTable)
-
-		case []interface{}:
-
-			// Create slice table
-			sliceTable := &lua.LTable{}
-
-			// Loop interface slice
-			for _, s := range element {
-				// Switch interface type
-				switch s := s.(type) {
-				case map[string]interface{}:
-
-					// Convert map to table
-					t := mapToTable(s)
-
-					// Append result
-					sliceTable.Append(t)
+// Go values are converted to lua and back so that an object survives a round
+// trip unchanged:
+//   - integers are returned as int64 and other numbers as float64, like the
+//     JSON decoder used for unstructured objects does. Lua has a single
+//     number type, so a whole float64 such as 1.0 comes back as the int64 1:
+//     both encode to the same JSON, so the object stored by the API server is
+//     unchanged. Integers beyond ±2^53 cannot be represented by a lua number
+//     and lose precision.
+//   - tables converted from a slice or a map carry a metatable recording it,
+//     so an empty array is not confused with an empty object.
+//   - JSON null is the global value "null", which can also be used by
+//     scripts to set a field to null.
+const (
+	arrayTypeName  = "cleany.array"
+	objectTypeName = "cleany.object"
+
+	nullGlobal      = "null"
+	nullRegistryKey = "cleany.null"
+
+	// maxExactInteger is the largest integer a lua number represents exactly
+	maxExactInteger = 1 << 53
+)
 
-				case float64:
+// jsonNull is the value of the userdata standing for JSON null.
+type jsonNull struct{}
 
-					// Append result as number
-					sliceTable.Append(lua.LNumber(s))
+// openConversion registers the metatables and the null value used by the
+// conversion functions. Must be called once on every LState.
+func openConversion(l *lua.LState) {
+	l.NewTypeMetatable(arrayTypeName)
+	l.NewTypeMetatable(objectTypeName)
 
-				case string:
+	null := l.NewUserData()
+	null.Value = jsonNull{}
+	l.Get(lua.RegistryIndex).(*lua.LTable).RawSetString(nullRegistryKey, null)
+	l.SetGlobal(nullGlobal, null)
+}
 
-					// Append result as string
-					sliceTable.Append(lua.LString(s))
+// mapToTable converts a Go map to a lua table.
+func mapToTable(l *lua.LState, m map[string]interface{}) *lua.LTable {
+	tbl := l.CreateTable(0, len(m))
+	for key, element := range m {
+		tbl.RawSetString(key, toLuaValue(l, element))
+	}
+	l.SetMetatable(tbl, l.GetTypeMetatable(objectTypeName))
+	return tbl
+}
 
-				case bool:
+// sliceToTable converts a Go slice to a lua table.
+func sliceToTable(l *lua.LState, s []interface{}) *lua.LTable {
+	tbl := l.CreateTable(len(s), 0)
+	for _, element := range s {
+		tbl.Append(toLuaValue(l, element))
+	}
+	l.SetMetatable(tbl, l.GetTypeMetatable(arrayTypeName))
+	return tbl
+}
 
-					// Append result as bool
-					sliceTable.Append(lua.LBool(s))
-				}
-			}
+// toLuaValue converts a Go value, as found in unstructured objects or
+// decoded JSON, to a lua value.
+func toLuaValue(l *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return luaNull(l)
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(string(v))
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return lua.LString(v.String())
+		}
+		return lua.LNumber(f)
+	case time.Time:
+		return lua.LNumber(v.Unix())
+	case map[string]interface{}:
+		return mapToTable(l, v)
+	case []interface{}:
+		return sliceToTable(l, v)
+	case []map[string]interface{}:
+		s := make([]interface{}, len(v))
+		for i := range v {
+			s[i] = v[i]
+		}
+		return sliceToTable(l, s)
+	case lua.LValue:
+		return v
+	}
 
-			// Append to main table
-			resultTable.RawSetString(key, sliceTable)
+	// other numbers, slices and maps
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return lua.LNumber(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return luaNull(l)
 		}
+		s := make([]interface{}, rv.Len())
+		for i := range s {
+			s[i] = rv.Index(i).Interface()
+		}
+		return sliceToTable(l, s)
+	case reflect.Map:
+		if rv.IsNil() {
+			return luaNull(l)
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = iter.Value().Interface()
+		}
+		return mapToTable(l, m)
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return luaNull(l)
+		}
+		return toLuaValue(l, rv.Elem().Interface())
 	}
 
-	return resultTable
+	return lua.LString(fmt.Sprint(v))
 }
 
-// toGoValue converts the given LValue to a Go object.
-// Credit to: https://github.com/yuin/gluamapper/blob/master/gluamapper.go
-func toGoValue(lv lua.LValue) interface{} {
+// toGoValue converts the given LValue to a Go object, using the same types
+// as the JSON decoder of unstructured objects. Values with no JSON
+// representation, such as functions, are converted to nil.
+func toGoValue(l *lua.LState, lv lua.LValue) interface{} {
 	switch v := lv.(type) {
 	case *lua.LNilType:
 		return nil
@@ -105,24 +158,98 @@ func toGoValue(lv lua.LValue) interface{} {
 	case lua.LString:
 		return string(v)
 	case lua.LNumber:
-		return float64(v)
+		// whole numbers are integers, even when converted from a float64
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) <= maxExactInteger {
+			return int64(f)
+		}
+		return f
+	case *lua.LUserData:
+		// JSON null, or a value with no JSON representation
+		return nil
 	case *lua.LTable:
-		maxn := v.MaxN()
-		if maxn == 0 { // table
-			ret := make(map[string]interface{})
-			v.ForEach(func(key, value lua.LValue) {
-				keystr := fmt.Sprint(toGoValue(key))
-				ret[keystr] = toGoValue(value)
-			})
-			return ret
-		} else { // array
-			ret := make([]interface{}, 0, maxn)
-			for i := 1; i <= maxn; i++ {
-				ret = append(ret, toGoValue(v.RawGetInt(i)))
-			}
-			return ret
+		if isArray(l, v) {
+			return tableToSlice(l, v)
 		}
+		return tableToMap(l, v)
 	default:
-		return v
+		return nil
+	}
+}
+
+// toBoundedGoValue is toGoValue refusing values larger than maxSize bytes,
+// as measured by valueSize.
+func toBoundedGoValue(l *lua.LState, lv lua.LValue, maxSize int) (interface{}, error) {
+	if valueSize(lv, maxSize) > maxSize {
+		return nil, fmt.Errorf("a value exceeding the maximum size of %d bytes", maxSize)
+	}
+	return toGoValue(l, lv), nil
+}
+
+// valueSize returns the size of lv, counting the length of strings and 8
+// bytes for any other value or table, keys included. It stops counting once
+// the size exceeds maxSize, so a table containing itself is measured too.
+func valueSize(lv lua.LValue, maxSize int) int {
+	switch v := lv.(type) {
+	case lua.LString:
+		return len(v)
+	case *lua.LTable:
+		size := 8
+		v.ForEach(func(key, value lua.LValue) {
+			if size > maxSize {
+				return
+			}
+			size += valueSize(key, maxSize-size)
+			size += valueSize(value, maxSize-size)
+		})
+		return size
+	default:
+		return 8
 	}
 }
+
+// isArray returns true if tbl must be converted to a slice: either it was
+// converted from a slice, or it is a non empty sequence.
+func isArray(l *lua.LState, tbl *lua.LTable) bool {
+	switch tbl.Metatable {
+	case l.GetTypeMetatable(arrayTypeName):
+		return true
+	case l.GetTypeMetatable(objectTypeName):
+		return false
+	}
+
+	n := tbl.Len()
+	if n == 0 {
+		return false
+	}
+	count := 0
+	tbl.ForEach(func(_, _ lua.LValue) {
+		count++
+	})
+	return count == n
+}
+
+func tableToSlice(l *lua.LState, tbl *lua.LTable) []interface{} {
+	n := tbl.Len()
+	ret := make([]interface{}, 0, n)
+	for i := 1; i <= n; i++ {
+		ret = append(ret, toGoValue(l, tbl.RawGetInt(i)))
+	}
+	return ret
+}
+
+func tableToMap(l *lua.LState, tbl *lua.LTable) map[string]interface{} {
+	ret := make(map[string]interface{})
+	tbl.ForEach(func(key, value lua.LValue) {
+		if _, ok := value.(*lua.LFunction); ok {
+			return
+		}
+		ret[fmt.Sprint(toGoValue(l, key))] = toGoValue(l, value)
+	})
+	return ret
+}
+
+// luaNull returns the lua value standing for JSON null.
+func luaNull(l *lua.LState) lua.LValue {
+	return l.Get(lua.RegistryIndex).(*lua.LTable).RawGetString(nullRegistryKey)
+}
@@ -0,0 +1,249 @@
+package resource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	lua "github.com/yuin/gopher-lua"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// jsonObject is a random JSON object, with the Go types produced when
+// decoding an unstructured object.
+type jsonObject map[string]interface{}
+
+// Generate implements quick.Generator.
+func (jsonObject) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(jsonObject(randomObject(r, 4)))
+}
+
+func randomValue(r *rand.Rand, depth int) interface{} {
+	n := 6
+	if depth > 0 {
+		n = 8
+	}
+	switch r.Intn(n) {
+	case 0:
+		return nil
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return fmt.Sprintf("s%d", r.Int())
+	case 3:
+		// integers up to the largest lua number representing them exactly
+		return r.Int63n(2*maxExactInteger) - maxExactInteger
+	case 4:
+		if r.Intn(4) == 0 {
+			// whole numbers decoded as float64, e.g. from 1.0
+			return float64(r.Intn(2000) - 1000)
+		}
+		return r.NormFloat64() * 1e6
+	case 5:
+		return ""
+	case 6:
+		return randomObject(r, depth-1)
+	default:
+		s := make([]interface{}, r.Intn(4))
+		for i := range s {
+			s[i] = randomValue(r, depth-1)
+		}
+		return s
+	}
+}
+
+func randomObject(r *rand.Rand, depth int) map[string]interface{} {
+	m := make(map[string]interface{})
+	for i := r.Intn(5); i > 0; i-- {
+		m[fmt.Sprintf("k%d", r.Intn(100))] = randomValue(r, depth)
+	}
+	return m
+}
+
+// wholeFloatsAsIntegers returns v with the whole float64 numbers it holds
+// converted to int64, as a round trip through lua does.
+func wholeFloatsAsIntegers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= maxExactInteger {
+			return int64(v)
+		}
+		return v
+	case jsonObject:
+		return wholeFloatsAsIntegers(map[string]interface{}(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			m[key] = wholeFloatsAsIntegers(element)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i := range v {
+			s[i] = wholeFloatsAsIntegers(v[i])
+		}
+		return s
+	}
+	return v
+}
+
+// sameJSON returns whether a and b encode to the same JSON.
+func sameJSON(a, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
+
+func roundTrip(m map[string]interface{}) interface{} {
+	l := newSandboxedState(DefaultLuaLimits)
+	defer l.Close()
+	return toGoValue(l, mapToTable(l, m))
+}
+
+func TestRoundTripProperty(t *testing.T) {
+	property := func(obj jsonObject) bool {
+		got := roundTrip(obj)
+		return reflect.DeepEqual(got, wholeFloatsAsIntegers(obj)) && sameJSON(got, obj)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRoundTripThroughScriptProperty(t *testing.T) {
+	script, err := CompileLuaScript("transform", `function transform() return obj end`, DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	property := func(obj jsonObject) bool {
+		r := &UnstructuredResource{Unstructured: unstructured.Unstructured{Object: obj}}
+		transformed, err := r.Transform(context.Background(), script)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return reflect.DeepEqual(transformed.Object, wholeFloatsAsIntegers(obj)) && sameJSON(transformed.Object, obj)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	obj := map[string]interface{}{
+		"replicas":    int64(3),
+		"ratio":       0.25,
+		"emptyList":   []interface{}{},
+		"emptyObject": map[string]interface{}{},
+		"null":        nil,
+		"matrix":      []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{}},
+		"mixed":       []interface{}{int64(80), nil, "http", 1.5, map[string]interface{}{}},
+		"ports": []interface{}{
+			map[string]interface{}{"port": int64(443), "protocol": "TCP"},
+		},
+	}
+	if got := roundTrip(obj); !reflect.DeepEqual(got, obj) {
+		t.Errorf("round trip changed object:\n got: %#v\nwant: %#v", got, obj)
+	}
+}
+
+func TestRoundTripWholeFloats(t *testing.T) {
+	obj := map[string]interface{}{
+		"cpu":   1.0,
+		"ratio": 0.5,
+		"big":   1e20,
+		"list":  []interface{}{2.0, -3.0},
+	}
+	want := map[string]interface{}{
+		"cpu":   int64(1),
+		"ratio": 0.5,
+		"big":   1e20,
+		"list":  []interface{}{int64(2), int64(-3)},
+	}
+	got := roundTrip(obj)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected round trip:\n got: %#v\nwant: %#v", got, want)
+	}
+	if !sameJSON(got, obj) {
+		t.Errorf("round trip changed the JSON of %#v: %#v", obj, got)
+	}
+}
+
+func TestToLuaValueGoTypes(t *testing.T) {
+	l := newSandboxedState(DefaultLuaLimits)
+	defer l.Close()
+
+	obj := map[string]interface{}{
+		"int":     7,
+		"int32":   int32(8),
+		"uint":    uint(9),
+		"float32": float32(0.5),
+		"bytes":   []byte("data"),
+		"strings": []string{"a", "b"},
+		"maps":    []map[string]interface{}{{"a": int64(1)}},
+		"labels":  map[string]string{"app": "web"},
+		"nilMap":  map[string]string(nil),
+	}
+	want := map[string]interface{}{
+		"int":     int64(7),
+		"int32":   int64(8),
+		"uint":    int64(9),
+		"float32": 0.5,
+		"bytes":   "data",
+		"strings": []interface{}{"a", "b"},
+		"maps":    []interface{}{map[string]interface{}{"a": int64(1)}},
+		"labels":  map[string]interface{}{"app": "web"},
+		"nilMap":  nil,
+	}
+	if got := toGoValue(l, mapToTable(l, obj)); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected conversion:\n got: %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestTablesBuiltByScripts(t *testing.T) {
+	l := newSandboxedState(DefaultLuaLimits)
+	defer l.Close()
+
+	l.SetGlobal("obj", mapToTable(l, map[string]interface{}{"emptyList": []interface{}{"x"}}))
+	if err := l.DoString(`
+result = {
+  list = {"a", "b"},
+  empty = {},
+  sparse = {[1] = "a", [3] = "c"},
+  keys = {[1] = "a", name = "b"},
+  cleared = obj.emptyList,
+  unset = null,
+  fn = function() end,
+}
+table.remove(result.cleared)
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"list":    []interface{}{"a", "b"},
+		"empty":   map[string]interface{}{},
+		"sparse":  map[string]interface{}{"1": "a", "3": "c"},
+		"keys":    map[string]interface{}{"1": "a", "name": "b"},
+		"cleared": []interface{}{},
+		"unset":   nil,
+	}
+	if got := toGoValue(l, l.GetGlobal("result")); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected conversion:\n got: %#v\nwant: %#v", got, want)
+	}
+
+	if got := toGoValue(l, lua.LNumber(2.5)); got != 2.5 {
+		t.Errorf("expected 2.5, got %#v", got)
+	}
+	if got := toGoValue(l, lua.LNumber(3)); got != int64(3) {
+		t.Errorf("expected int64(3), got %#v", got)
+	}
+}
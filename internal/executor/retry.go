@@ -0,0 +1,41 @@
+package executor
+
+import (
+	"context"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// requestRetryBackoff is the delay between the attempts of a request for a
+// resource, retried as the RetryPolicy of the Cleaner allows
+var requestRetryBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Cap:      5 * time.Second,
+}
+
+// retryRequest sends a request for a resource with send, again while it
+// fails on a conflict or a transient error, up to the attempts allowed by
+// the RetryPolicy of the Cleaner.
+func (e *Executor) retryRequest(ctx context.Context, send func() error) error {
+	backoff := requestRetryBackoff
+	backoff.Steps = 1
+	if policy := e.cleaner.Spec.RetryPolicy; policy != nil && policy.MaxAttempts > 1 {
+		backoff.Steps = int(policy.MaxAttempts)
+	}
+	return retry.OnError(backoff, func(err error) bool {
+		return ctx.Err() == nil && retriable(err)
+	}, send)
+}
+
+// retriable returns whether a request failing with err may succeed when
+// sent again.
+func retriable(err error) bool {
+	return apierrors.IsConflict(err) || throttled(err) ||
+		utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
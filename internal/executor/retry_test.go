@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/executor/resource"
+)
+
+func TestRetryRequest(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+	conflict := apierrors.NewConflict(configMaps, "settings", fmt.Errorf("modified"))
+	forbidden := apierrors.NewForbidden(configMaps, "settings", fmt.Errorf("denied"))
+	unavailable := apierrors.NewServiceUnavailable("unavailable")
+
+	tests := []struct {
+		name        string
+		maxAttempts int32
+		err         error
+		sent        int
+	}{
+		{"no retry policy", 0, conflict, 1},
+		{"throttled without retry policy", 0, unavailable, 1},
+		{"conflict", 3, conflict, 3},
+		{"throttled", 3, unavailable, 3},
+		{"forbidden", 3, forbidden, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := newLibraryCleaner()
+			if tt.maxAttempts != 0 {
+				cleaner.Spec.RetryPolicy = &cleanyv1alpha1.RetryPolicy{MaxAttempts: tt.maxAttempts}
+			}
+			e := &Executor{cleaner: cleaner, throttle: &throttle{}}
+
+			sent := 0
+			err := e.retryRequest(context.Background(), func() error {
+				return e.throttle.do(context.Background(), func() error {
+					sent++
+					return tt.err
+				})
+			})
+			if err != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+			if sent != tt.sent {
+				t.Errorf("expected %d requests, got %d", tt.sent, sent)
+			}
+		})
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	obj := newObject("v1", "ConfigMap", "default", "settings")
+	obj.SetUID("settings")
+	latest := obj.DeepCopy()
+	latest.SetLabels(map[string]string{"team": "web"})
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), nil, latest)
+	conflicts := 1
+	dynamicClient.PrependReactor("update", "configmaps",
+		func(clienttesting.Action) (bool, runtime.Object, error) {
+			if conflicts == 0 {
+				return false, nil, nil
+			}
+			conflicts--
+			return true, nil, apierrors.NewConflict(gvr.GroupResource(), obj.GetName(), fmt.Errorf("modified"))
+		})
+
+	transform, err := resource.CompileLuaScript("transform", `
+function transform()
+  obj.metadata.labels = obj.metadata.labels or {}
+  obj.metadata.labels["cleaned"] = "true"
+  return obj
+end`, resource.DefaultLuaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transform.Close()
+
+	cleaner := newLibraryCleaner()
+	cleaner.Spec.RetryPolicy = &cleanyv1alpha1.RetryPolicy{MaxAttempts: 2}
+	e := &Executor{cleaner: cleaner, throttle: &throttle{}, dynamicClient: dynamicClient}
+
+	resourceInterface := dynamicClient.Resource(gvr).Namespace(obj.GetNamespace())
+	original, updated, err := e.update(context.Background(), resourceInterface, obj, transform, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original.GetLabels()["team"] != "web" {
+		t.Errorf("expected the latest version to be transformed, got %v", original.GetLabels())
+	}
+	stored, err := resourceInterface.Get(context.Background(), obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, labels := range []map[string]string{updated.GetLabels(), stored.GetLabels()} {
+		if labels["team"] != "web" || labels["cleaned"] != "true" {
+			t.Errorf("expected the latest version to be updated, got labels %v", labels)
+		}
+	}
+}
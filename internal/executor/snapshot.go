@@ -0,0 +1,492 @@
+package executor
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+const (
+	// snapshotSecretType is the type of the Secrets holding snapshots
+	snapshotSecretType = corev1.SecretType("cleany.wys1203.com/snapshots")
+
+	// maxSnapshotChunkSize is the size of the snapshots stored in a single
+	// Secret, below the 1MiB limit of Secrets
+	maxSnapshotChunkSize = 768 * 1024
+
+	// maxReportResources is the number of resources listed in a
+	// CleaningReport, those beyond are listed in its Secrets
+	maxReportResources = 1000
+
+	// resourceKeySuffix follows the index of a resource in the key of the
+	// Secret listing it
+	resourceKeySuffix = ".resource"
+)
+
+// takeSnapshots removes the full resources from resourceInfo when they are
+// larger than the inline limit in total, or when there are more resources
+// than maxReportResources, and returns them by index along with the
+// resources beyond maxReportResources, to be stored in Secrets. Snapshots
+// of Secrets are always stored in Secrets, never in the report. It returns
+// nil snapshots when they all fit in the report.
+func (e *Executor) takeSnapshots(resourceInfo []cleanyv1alpha1.ResourceInfo,
+) ([]cleanyv1alpha1.ResourceInfo, map[int][]byte, []cleanyv1alpha1.ResourceInfo) {
+	size := 0
+	for i := range resourceInfo {
+		if !isSecret(&resourceInfo[i]) {
+			size += len(resourceInfo[i].FullResource)
+		}
+	}
+	all := size > e.snapshotInlineLimit || len(resourceInfo) > maxReportResources
+
+	snapshots := make(map[int][]byte)
+	for i := range resourceInfo {
+		if resourceInfo[i].FullResource != nil && (all || isSecret(&resourceInfo[i])) {
+			snapshots[i] = resourceInfo[i].FullResource
+			resourceInfo[i].FullResource = nil
+		}
+	}
+	switch {
+	case len(resourceInfo) > maxReportResources:
+		return resourceInfo[:maxReportResources], snapshots, resourceInfo[maxReportResources:]
+	case len(snapshots) == 0:
+		return resourceInfo, nil, nil
+	default:
+		return resourceInfo, snapshots, nil
+	}
+}
+
+// isSecret returns whether info is that of a Secret, whose snapshot must
+// not be readable by anyone reading the report.
+func isSecret(info *cleanyv1alpha1.ResourceInfo) bool {
+	return info.Resource.APIVersion == "v1" && info.Resource.Kind == "Secret"
+}
+
+// storeSnapshots stores the snapshots of the resources of report, and the
+// resources listed after those of its ResourceInfo, in Secrets owned by the
+// report, each holding up to maxSnapshotChunkSize bytes. It returns the
+// Secrets created.
+func (e *Executor) storeSnapshots(ctx context.Context, report *cleanyv1alpha1.CleaningReport,
+	snapshots map[int][]byte, stored []cleanyv1alpha1.ResourceInfo,
+) ([]*corev1.Secret, error) {
+	data := make(map[string][]byte, len(snapshots)+len(stored))
+	for i, snapshot := range snapshots {
+		data[strconv.Itoa(i)] = snapshot
+	}
+	for i := range stored {
+		resource, err := json.Marshal(&stored[i])
+		if err != nil {
+			return nil, err
+		}
+		data[resourceKey(len(report.Spec.ResourceInfo)+i)] = resource
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	// the entries of a resource are kept together, in the order of the
+	// resources
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(keyIndex(a), keyIndex(b)), cmp.Compare(a, b))
+	})
+
+	var secrets []*corev1.Secret
+	var chunk *corev1.Secret
+	size := 0
+	for _, key := range keys {
+		if chunk != nil && size+len(data[key]) > maxSnapshotChunkSize {
+			if err := e.createSnapshotSecret(ctx, report, chunk); err != nil {
+				return nil, err
+			}
+			secrets = append(secrets, chunk)
+			chunk = nil
+		}
+		if chunk == nil {
+			chunk = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: report.Name + "-snapshots-",
+					Namespace:    report.Namespace,
+					Labels:       map[string]string{cleanyv1alpha1.ReportLabel: report.Name},
+				},
+				Type: snapshotSecretType,
+				Data: make(map[string][]byte),
+			}
+			size = 0
+		}
+		chunk.Data[key] = data[key]
+		size += len(data[key])
+	}
+	if chunk == nil {
+		return secrets, nil
+	}
+	if err := e.createSnapshotSecret(ctx, report, chunk); err != nil {
+		return nil, err
+	}
+	return append(secrets, chunk), nil
+}
+
+func (e *Executor) createSnapshotSecret(ctx context.Context, report *cleanyv1alpha1.CleaningReport,
+	secret *corev1.Secret,
+) error {
+	if err := controllerutil.SetControllerReference(report, secret, e.scheme); err != nil {
+		return err
+	}
+	if err := e.k8sClient.Create(ctx, secret); err != nil {
+		return fmt.Errorf("storing snapshots of CleaningReport %s: %w", report.Name, err)
+	}
+	return nil
+}
+
+// updateStoredResources replaces the resources listed in secrets, the
+// Secrets of a report, by those of resourceInfo at the same index.
+func (e *Executor) updateStoredResources(ctx context.Context, secrets []*corev1.Secret,
+	resourceInfo []cleanyv1alpha1.ResourceInfo,
+) error {
+	for _, secret := range secrets {
+		changed := false
+		for key, data := range secret.Data {
+			i := keyIndex(key)
+			if key != resourceKey(i) || i >= len(resourceInfo) {
+				continue
+			}
+			resource, err := json.Marshal(&resourceInfo[i])
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(data, resource) {
+				secret.Data[key] = resource
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := e.k8sClient.Update(ctx, secret); err != nil {
+			return fmt.Errorf("storing resources of CleaningReport %s: %w", secret.Labels[cleanyv1alpha1.ReportLabel],
+				err)
+		}
+	}
+	return nil
+}
+
+// resourceKey returns the key of the Secret listing the resource at index i
+// of a report.
+func resourceKey(i int) string {
+	return strconv.Itoa(i) + resourceKeySuffix
+}
+
+// keyIndex returns the index of the resource in the key of a Secret of a
+// report, or -1 if the key is invalid.
+func keyIndex(key string) int {
+	i, err := strconv.Atoi(strings.TrimSuffix(key, resourceKeySuffix))
+	if err != nil || i < 0 {
+		return -1
+	}
+	return i
+}
+
+// LoadResources returns all the resources listed by report, along with
+// their full resources by index, wherever they are stored.
+func LoadResources(ctx context.Context, reader client.Reader, report *cleanyv1alpha1.CleaningReport,
+) ([]cleanyv1alpha1.ResourceInfo, map[int][]byte, error) {
+	if report.Spec.Snapshots != cleanyv1alpha1.SnapshotStoreSecrets {
+		return report.Spec.ResourceInfo, inlineSnapshots(report.Spec.ResourceInfo), nil
+	}
+
+	inline := len(report.Spec.ResourceInfo)
+	resourceInfo := make([]cleanyv1alpha1.ResourceInfo, inline+report.Spec.StoredResources)
+	copy(resourceInfo, report.Spec.ResourceInfo)
+	found := make([]bool, report.Spec.StoredResources)
+	// the snapshots of the report are those of Secrets only
+	snapshots := inlineSnapshots(report.Spec.ResourceInfo)
+	secrets := &corev1.SecretList{}
+	if err := reader.List(ctx, secrets, client.InNamespace(report.Namespace),
+		client.MatchingLabels{cleanyv1alpha1.ReportLabel: report.Name}); err != nil {
+		return nil, nil, err
+	}
+	for i := range secrets.Items {
+		if !metav1.IsControlledBy(&secrets.Items[i], report) {
+			continue
+		}
+		for key, data := range secrets.Items[i].Data {
+			index := keyIndex(key)
+			switch {
+			case index < 0 || index >= len(resourceInfo):
+				return nil, nil, fmt.Errorf("invalid entry %s in Secret %s", key, secrets.Items[i].Name)
+			case key == strconv.Itoa(index):
+				snapshots[index] = data
+			case index >= inline:
+				if err := json.Unmarshal(data, &resourceInfo[index]); err != nil {
+					return nil, nil, fmt.Errorf("invalid entry %s in Secret %s: %w", key, secrets.Items[i].Name, err)
+				}
+				found[index-inline] = true
+			}
+		}
+	}
+	if i := slices.Index(found, false); i >= 0 {
+		return nil, nil, fmt.Errorf("resource %d of CleaningReport %s not found in its Secrets", inline+i, report.Name)
+	}
+	return resourceInfo, snapshots, nil
+}
+
+// inlineSnapshots returns the full resources stored in resourceInfo by
+// index.
+func inlineSnapshots(resourceInfo []cleanyv1alpha1.ResourceInfo) map[int][]byte {
+	snapshots := make(map[int][]byte, len(resourceInfo))
+	for i := range resourceInfo {
+		if resourceInfo[i].FullResource != nil {
+			snapshots[i] = resourceInfo[i].FullResource
+		}
+	}
+	return snapshots
+}
+
+// reportDigest returns the SHA-256 of the action listed in spec and of the
+// identity, action and snapshot of each of the resources it lists, all of
+// resourceInfo.
+func reportDigest(spec *cleanyv1alpha1.CleaningReportSpec, resourceInfo []cleanyv1alpha1.ResourceInfo,
+	snapshots map[int][]byte,
+) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%t\x00", spec.Action, spec.DryRun)
+	for i := range resourceInfo {
+		info := &resourceInfo[i]
+		ref := &info.Resource
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00", ref.APIVersion, ref.Kind, ref.Namespace,
+			ref.Name, ref.UID, ref.ResourceVersion, info.Action, info.SkipReason)
+		snapshot := sha256.Sum256(snapshots[i])
+		h.Write(snapshot[:])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Restore re-creates, from their snapshots, the resources deleted by the run
+// recorded in report and named in selection, see RestoreAnnotation. Nothing
+// is restored unless the report and its snapshots match the digest recorded
+// by the run. When namespace is set, only the resources in it are restored,
+// as when restoring with the permissions of the controller.
+func Restore(
+	ctx context.Context,
+	reader client.Reader,
+	dynamicClient dynamic.Interface,
+	mapper meta.RESTMapper,
+	report *cleanyv1alpha1.CleaningReport,
+	selection string,
+	namespace string,
+) (*cleanyv1alpha1.RestoreStatus, error) {
+	status := &cleanyv1alpha1.RestoreStatus{Selection: selection, Time: metav1.Now()}
+	if report.Spec.DryRun {
+		status.Errors = append(status.Errors, "the run was a dry run, no resource was deleted")
+		return status, nil
+	}
+	if report.Status.Phase != "" {
+		status.Errors = append(status.Errors, "the report lists an action requiring approval, "+
+			"resources are restored from its execution report")
+		return status, nil
+	}
+
+	resourceInfo, snapshots, err := LoadResources(ctx, reader, report)
+	if err != nil {
+		return nil, err
+	}
+	if report.Status.Digest == "" || report.Status.Digest != reportDigest(&report.Spec, resourceInfo, snapshots) {
+		status.Errors = append(status.Errors, "the report or its snapshots do not match the digest "+
+			"recorded by the run")
+		return status, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(selection, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+
+	objects := make(map[int]*unstructured.Unstructured)
+	for i := range resourceInfo {
+		info := &resourceInfo[i]
+		name := objectName(info.Resource.Namespace, info.Resource.Name)
+		if !deleted(report, info) || (selection != "*" && !slices.Contains(names, name)) {
+			continue
+		}
+		obj, err := snapshotObject(info, snapshots[i], namespace)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("%s %s: %v", info.Resource.Kind, name, err))
+			continue
+		}
+		objects[i] = obj
+	}
+
+	// owners are restored before the resources they own, which then refer
+	// to their new UID
+	r := &restorer{dynamicClient: dynamicClient, mapper: mapper, restored: make(map[types.UID]types.UID)}
+	for len(objects) > 0 {
+		for _, i := range nextToRestore(objects) {
+			info := &resourceInfo[i]
+			if err := r.restore(ctx, objects[i]); err != nil {
+				status.Errors = append(status.Errors, fmt.Sprintf("%s %s: %v", info.Resource.Kind,
+					objectName(info.Resource.Namespace, info.Resource.Name), err))
+			} else {
+				status.RestoredResources++
+			}
+			delete(objects, i)
+		}
+	}
+	return status, nil
+}
+
+// deleted returns whether the run recorded in report deleted the resource.
+func deleted(report *cleanyv1alpha1.CleaningReport, info *cleanyv1alpha1.ResourceInfo) bool {
+	action := report.Spec.Action
+	if info.Action != "" {
+		action = info.Action
+	}
+	return action == cleanyv1alpha1.ActionDelete && info.SkipReason == ""
+}
+
+// snapshotObject returns the resource in snapshot, once checked to be the
+// one identified by info and, if namespace is set, to be in it.
+func snapshotObject(info *cleanyv1alpha1.ResourceInfo, snapshot []byte, namespace string,
+) (*unstructured.Unstructured, error) {
+	if snapshot == nil {
+		return nil, fmt.Errorf("no snapshot")
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(snapshot, &obj.Object); err != nil {
+		return nil, err
+	}
+	ref := &info.Resource
+	if obj.GetAPIVersion() != ref.APIVersion || obj.GetKind() != ref.Kind || obj.GetNamespace() != ref.Namespace ||
+		obj.GetName() != ref.Name || (ref.UID != "" && obj.GetUID() != ref.UID) {
+		return nil, fmt.Errorf("the snapshot is of %s %s %s", obj.GetAPIVersion(), obj.GetKind(),
+			objectName(obj.GetNamespace(), obj.GetName()))
+	}
+	if namespace != "" && obj.GetNamespace() != namespace {
+		return nil, fmt.Errorf("only resources in namespace %s are restored without a ServiceAccount", namespace)
+	}
+	return obj, nil
+}
+
+// nextToRestore returns the indexes of the objects not owned by another one
+// of objects, or of all of them if they own each other.
+func nextToRestore(objects map[int]*unstructured.Unstructured) []int {
+	uids := make(map[types.UID]bool, len(objects))
+	for _, obj := range objects {
+		uids[obj.GetUID()] = true
+	}
+	var next, all []int
+	for i, obj := range objects {
+		all = append(all, i)
+		if !slices.ContainsFunc(obj.GetOwnerReferences(), func(ref metav1.OwnerReference) bool {
+			return ref.UID != obj.GetUID() && uids[ref.UID]
+		}) {
+			next = append(next, i)
+		}
+	}
+	if next == nil {
+		next = all
+	}
+	slices.Sort(next)
+	return next
+}
+
+// restorer creates resources from their snapshots.
+type restorer struct {
+	dynamicClient dynamic.Interface
+	mapper        meta.RESTMapper
+
+	// restored maps the UIDs in the snapshots of the restored resources to
+	// their new UID
+	restored map[types.UID]types.UID
+}
+
+// restore creates obj without its server set fields, nor the owner
+// references to owners that are gone.
+func (r *restorer) restore(ctx context.Context, obj *unstructured.Unstructured) error {
+	uid := obj.GetUID()
+	r.resolveOwnerReferences(ctx, obj)
+	stripServerFields(obj)
+
+	gvk := obj.GroupVersionKind()
+	mapping, err := r.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	created, err := r.dynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace()).
+		Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("already exists")
+	}
+	if err != nil {
+		return err
+	}
+	r.restored[uid] = created.GetUID()
+	return nil
+}
+
+// resolveOwnerReferences points the owner references of obj to the owners
+// restored before it, and removes those to owners that no longer exist, or
+// were re-created with another UID, for obj not to be garbage collected.
+func (r *restorer) resolveOwnerReferences(ctx context.Context, obj *unstructured.Unstructured) {
+	var refs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if uid, ok := r.restored[ref.UID]; ok {
+			ref.UID = uid
+			refs = append(refs, ref)
+		} else if r.exists(ctx, ref, obj.GetNamespace()) {
+			refs = append(refs, ref)
+		}
+	}
+	obj.SetOwnerReferences(refs)
+}
+
+// exists returns whether the owner referred to by ref, in namespace if it
+// is namespaced, still exists with the same UID.
+func (r *restorer) exists(ctx context.Context, ref metav1.OwnerReference, namespace string) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false
+	}
+	mapping, err := r.mapper.RESTMapping(gv.WithKind(ref.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return false
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		namespace = ""
+	}
+	owner, err := r.dynamicClient.Resource(mapping.Resource).Namespace(namespace).
+		Get(ctx, ref.Name, metav1.GetOptions{})
+	return err == nil && owner.GetUID() == ref.UID
+}
+
+// stripServerFields removes the fields set by the API server, which cannot
+// be set on creation.
+func stripServerFields(obj *unstructured.Unstructured) {
+	obj.SetUID("")
+	obj.SetResourceVersion("")
+	obj.SetGeneration(0)
+	obj.SetCreationTimestamp(metav1.Time{})
+	obj.SetDeletionTimestamp(nil)
+	obj.SetDeletionGracePeriodSeconds(nil)
+	obj.SetManagedFields(nil)
+	obj.SetSelfLink("")
+	unstructured.RemoveNestedField(obj.Object, "status")
+}
@@ -0,0 +1,484 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+func newSnapshotInfo(t *testing.T, namespace, name string, size int) cleanyv1alpha1.ResourceInfo {
+	obj := newObject("v1", "ConfigMap", namespace, name)
+	obj.Object["data"] = map[string]interface{}{"payload": strings.Repeat("x", size)}
+	return snapshotInfo(t, obj)
+}
+
+// snapshotInfo returns the ResourceInfo of obj, as deleted by a run.
+func snapshotInfo(t *testing.T, obj *unstructured.Unstructured) cleanyv1alpha1.ResourceInfo {
+	obj.SetUID(types.UID("uid-" + obj.GetName()))
+	obj.SetResourceVersion("7")
+	obj.SetCreationTimestamp(metav1.Now())
+	obj.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl"}})
+	fullResource, err := json.Marshal(obj.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cleanyv1alpha1.ResourceInfo{
+		Resource: corev1.ObjectReference{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(),
+			Namespace: obj.GetNamespace(), Name: obj.GetName(), UID: obj.GetUID(), ResourceVersion: "7"},
+		FullResource: fullResource,
+	}
+}
+
+// recordedReport returns a report of the deletion of resourceInfo, with the
+// digest recorded by a run.
+func recordedReport(resourceInfo ...cleanyv1alpha1.ResourceInfo) *cleanyv1alpha1.CleaningReport {
+	report := &cleanyv1alpha1.CleaningReport{
+		ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "default"},
+		Spec:       cleanyv1alpha1.CleaningReportSpec{Action: cleanyv1alpha1.ActionDelete, ResourceInfo: resourceInfo},
+	}
+	report.Status.Digest = reportDigest(&report.Spec, report.Spec.ResourceInfo, inlineSnapshots(report.Spec.ResourceInfo))
+	return report
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build()
+	cleaner := newLibraryCleaner()
+	e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+		snapshotInlineLimit: 1024, k8sClient: k8sClient, scheme: scheme}
+
+	// small snapshots stay in the report
+	small := []cleanyv1alpha1.ResourceInfo{newSnapshotInfo(t, "default", "small", 10)}
+	report, err := e.createReport(ctx, cleanyv1alpha1.ActionDelete, "", small, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Spec.Snapshots == cleanyv1alpha1.SnapshotStoreSecrets || report.Spec.ResourceInfo[0].FullResource == nil {
+		t.Errorf("expected inline snapshots, got %+v", report.Spec)
+	}
+	if report.Status.Digest != reportDigest(&report.Spec, report.Spec.ResourceInfo, inlineSnapshots(report.Spec.ResourceInfo)) {
+		t.Errorf("expected the digest of the report to be recorded, got %q", report.Status.Digest)
+	}
+
+	// snapshots of Secrets are never inline, whatever their size
+	secret := newObject("v1", "Secret", "default", "token")
+	secret.Object["data"] = map[string]interface{}{"token": "c2VjcmV0"}
+	mixed := []cleanyv1alpha1.ResourceInfo{newSnapshotInfo(t, "default", "small", 10), snapshotInfo(t, secret)}
+	secretSnapshot := mixed[1].FullResource
+	report, err = e.createReport(ctx, cleanyv1alpha1.ActionDelete, "", mixed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Spec.Snapshots != cleanyv1alpha1.SnapshotStoreSecrets || report.Spec.ResourceInfo[1].FullResource != nil {
+		t.Fatalf("expected the snapshot of the Secret in Secrets, got %+v", report.Spec)
+	}
+	if report.Spec.ResourceInfo[0].FullResource == nil {
+		t.Error("expected the snapshot of the ConfigMap to stay inline")
+	}
+	resourceInfo, snapshots, err := LoadResources(ctx, k8sClient, report.CleaningReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || string(snapshots[1]) != string(secretSnapshot) {
+		t.Errorf("expected both snapshots to be loaded, got %d", len(snapshots))
+	}
+	if report.Status.Digest != reportDigest(&report.Spec, resourceInfo, snapshots) {
+		t.Errorf("expected the digest to cover both snapshots, got %q", report.Status.Digest)
+	}
+	if err := k8sClient.DeleteAllOf(ctx, &corev1.Secret{}, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+
+	// large snapshots are split in Secrets
+	var large []cleanyv1alpha1.ResourceInfo
+	for _, name := range []string{"a", "b", "c"} {
+		large = append(large, newSnapshotInfo(t, "default", name, maxSnapshotChunkSize/2))
+	}
+	expected := make([][]byte, len(large))
+	for i := range large {
+		expected[i] = large[i].FullResource
+	}
+	report, err = e.createReport(ctx, cleanyv1alpha1.ActionDelete, "", large, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Spec.Snapshots != cleanyv1alpha1.SnapshotStoreSecrets {
+		t.Fatalf("expected snapshots in Secrets, got %q", report.Spec.Snapshots)
+	}
+	for i := range report.Spec.ResourceInfo {
+		if report.Spec.ResourceInfo[i].FullResource != nil {
+			t.Errorf("expected snapshot %d to be removed from the report", i)
+		}
+	}
+	secrets := &corev1.SecretList{}
+	if err := k8sClient.List(ctx, secrets); err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 3 {
+		t.Errorf("expected a Secret per snapshot larger than half a chunk, got %d", len(secrets.Items))
+	}
+
+	resourceInfo, snapshots, err = LoadResources(ctx, k8sClient, report.CleaningReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		if string(snapshots[i]) != string(expected[i]) {
+			t.Errorf("snapshot %d was not restored as stored", i)
+		}
+	}
+	if report.Status.Digest == "" || report.Status.Digest != reportDigest(&report.Spec, resourceInfo, snapshots) {
+		t.Errorf("expected the digest to cover the snapshots stored in Secrets, got %q", report.Status.Digest)
+	}
+}
+
+func TestStoredResources(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).Build()
+	cleaner := newLibraryCleaner()
+	e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+		snapshotInlineLimit: 1 << 20, k8sClient: k8sClient, scheme: scheme}
+
+	// the resources beyond maxReportResources are listed in the Secrets
+	resourceInfo := make([]cleanyv1alpha1.ResourceInfo, maxReportResources+2)
+	for i := range resourceInfo {
+		resourceInfo[i] = newSnapshotInfo(t, "default", fmt.Sprintf("cm-%d", i), 0)
+	}
+	report, err := e.createReport(ctx, cleanyv1alpha1.ActionDelete, "", resourceInfo, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Spec.ResourceInfo) != maxReportResources || report.Spec.StoredResources != 2 ||
+		report.Spec.Snapshots != cleanyv1alpha1.SnapshotStoreSecrets {
+		t.Fatalf("expected %d resources in the report and 2 in Secrets, got %d and %d",
+			maxReportResources, len(report.Spec.ResourceInfo), report.Spec.StoredResources)
+	}
+
+	// the outcome of the run is recorded wherever the resources are listed
+	for i := range resourceInfo {
+		resourceInfo[i].Message = "deleted"
+	}
+	if err := e.finishReport(ctx, report, resourceInfo); err != nil {
+		t.Fatal(err)
+	}
+	loaded, snapshots, err := LoadResources(ctx, k8sClient, report.CleaningReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(resourceInfo) || len(snapshots) != len(resourceInfo) {
+		t.Fatalf("expected %d resources and snapshots, got %d and %d", len(resourceInfo), len(loaded), len(snapshots))
+	}
+	last := loaded[len(loaded)-1]
+	if last.Resource.Name != fmt.Sprintf("cm-%d", maxReportResources+1) || last.Message != "deleted" {
+		t.Errorf("expected the outcome of the last resource in the Secrets, got %+v", last)
+	}
+	if report.Status.Digest != reportDigest(&report.Spec, loaded, snapshots) {
+		t.Errorf("expected the digest to cover the resources listed in Secrets, got %q", report.Status.Digest)
+	}
+
+	// a report missing some of its resources is refused
+	secrets := &corev1.SecretList{}
+	if err := k8sClient.List(ctx, secrets); err != nil {
+		t.Fatal(err)
+	}
+	for i := range secrets.Items {
+		if _, ok := secrets.Items[i].Data[resourceKey(maxReportResources+1)]; ok {
+			if err := k8sClient.Delete(ctx, &secrets.Items[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, _, err := LoadResources(ctx, k8sClient, report.CleaningReport); err == nil {
+		t.Error("expected an error for a resource missing from the Secrets")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	existing := newObject("v1", "ConfigMap", "default", "existing")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme, existing)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+
+	scanned := newSnapshotInfo(t, "default", "scanned", 10)
+	scanned.Action = cleanyv1alpha1.ActionScan
+	protected := newSnapshotInfo(t, "default", "protected", 10)
+	protected.SkipReason = "protected"
+	report := recordedReport(
+		newSnapshotInfo(t, "default", "deleted", 10),
+		newSnapshotInfo(t, "team", "other", 10),
+		newSnapshotInfo(t, "default", "existing", 10),
+		scanned,
+		protected,
+	)
+
+	status, err := Restore(ctx, nil, dynamicClient, mapper, report, "default/deleted, default/existing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RestoredResources != 1 || len(status.Errors) != 1 || !strings.Contains(status.Errors[0], "existing") {
+		t.Errorf("expected the deleted resource to be restored, got %+v", status)
+	}
+	restored, err := dynamicClient.Resource(configMaps).Namespace("default").Get(ctx, "deleted", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.GetUID() != "" || restored.GetManagedFields() != nil || restored.GetResourceVersion() == "7" {
+		t.Errorf("expected server set fields to be stripped, got %v", restored.Object["metadata"])
+	}
+	if _, err := dynamicClient.Resource(configMaps).Namespace("team").Get(ctx, "other", metav1.GetOptions{}); err == nil {
+		t.Error("expected resources not selected to not be restored")
+	}
+
+	status, err = Restore(ctx, nil, dynamicClient, mapper, report, "*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deleted and existing already exist, scanned and protected were not deleted
+	if status.RestoredResources != 1 || len(status.Errors) != 2 {
+		t.Errorf("expected all deleted resources to be restored, got %+v", status)
+	}
+}
+
+func TestRestoreChecks(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	// a report without the digest of the run, or with another snapshot
+	tampered := recordedReport(newSnapshotInfo(t, "default", "deleted", 10))
+	tampered.Spec.ResourceInfo[0].FullResource = newSnapshotInfo(t, "kube-system", "deleted", 10).FullResource
+	forged := recordedReport(newSnapshotInfo(t, "default", "deleted", 10))
+	forged.Status.Digest = ""
+	for _, report := range []*cleanyv1alpha1.CleaningReport{tampered, forged} {
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme)
+		status, err := Restore(ctx, nil, dynamicClient, mapper, report, "*", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.RestoredResources != 0 || len(status.Errors) != 1 || !strings.Contains(status.Errors[0], "digest") {
+			t.Errorf("expected a report not matching its digest to be refused, got %+v", status)
+		}
+	}
+
+	// a snapshot of another resource than the one listed
+	info := newSnapshotInfo(t, "default", "listed", 10)
+	info.FullResource = newSnapshotInfo(t, "kube-system", "listed", 10).FullResource
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme)
+	status, err := Restore(ctx, nil, dynamicClient, mapper, recordedReport(info), "*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RestoredResources != 0 || len(status.Errors) != 1 || !strings.Contains(status.Errors[0], "kube-system") {
+		t.Errorf("expected a snapshot of another resource to be refused, got %+v", status)
+	}
+
+	// without a ServiceAccount, only the namespace of the report
+	report := recordedReport(newSnapshotInfo(t, "default", "deleted", 10), newSnapshotInfo(t, "team", "other", 10),
+		snapshotInfo(t, newObject("v1", "Namespace", "", "team")))
+	status, err = Restore(ctx, nil, dynamicClient, mapper, report, "*", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RestoredResources != 1 || len(status.Errors) != 2 {
+		t.Errorf("expected only the resource in the namespace of the report to be restored, got %+v", status)
+	}
+}
+
+func TestRestoreOwnerReferences(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	existing := newObject("v1", "ConfigMap", "default", "existing")
+	existing.SetUID("uid-existing")
+	recreated := newObject("v1", "ConfigMap", "default", "recreated")
+	recreated.SetUID("uid-recreated-again")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme, existing, recreated)
+	dynamicClient.PrependReactor("create", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		obj.SetUID(types.UID("new-" + obj.GetName()))
+		return false, nil, nil
+	})
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+
+	ownerRef := func(name string) metav1.OwnerReference {
+		return metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: name, UID: types.UID("uid-" + name)}
+	}
+	owned := newObject("v1", "ConfigMap", "default", "owned")
+	owned.SetOwnerReferences([]metav1.OwnerReference{ownerRef("owner"), ownerRef("existing"),
+		ownerRef("recreated"), ownerRef("gone")})
+	// the owned resource is listed first, but restored after its owner
+	report := recordedReport(snapshotInfo(t, owned), snapshotInfo(t, newObject("v1", "ConfigMap", "default", "owner")))
+
+	status, err := Restore(ctx, nil, dynamicClient, mapper, report, "*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RestoredResources != 2 || len(status.Errors) != 0 {
+		t.Fatalf("expected the owner and owned resources to be restored, got %+v", status)
+	}
+	restored, err := dynamicClient.Resource(configMaps).Namespace("default").Get(ctx, "owned", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uids := map[string]types.UID{}
+	for _, ref := range restored.GetOwnerReferences() {
+		uids[ref.Name] = ref.UID
+	}
+	expected := map[string]types.UID{"owner": "new-owner", "existing": "uid-existing"}
+	if !reflect.DeepEqual(uids, expected) {
+		t.Errorf("expected references to the restored and existing owners only, got %v", uids)
+	}
+}
+
+func TestReportBeforeAction(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := cleanyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+	tests := []struct {
+		name string
+		// failSecrets fails the creation of the Secrets holding snapshots
+		failSecrets bool
+	}{
+		{name: "snapshots stored"},
+		{name: "snapshots not stored", failSecrets: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			var resources []models.ResourceResult
+			for _, name := range []string{"first", "second"} {
+				obj := newObject("v1", "ConfigMap", "default", name)
+				obj.SetUID(types.UID(name))
+				obj.Object["data"] = map[string]interface{}{"payload": strings.Repeat("x", 100)}
+				objects = append(objects, obj)
+				resources = append(resources, models.ResourceResult{Resource: obj.DeepCopy(), GVR: configMaps})
+			}
+			k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+				WithStatusSubresource(&cleanyv1alpha1.CleaningReport{}).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+						if _, ok := obj.(*corev1.Secret); ok && tt.failSecrets {
+							return fmt.Errorf("denied")
+						}
+						return c.Create(ctx, obj, opts...)
+					},
+				}).Build()
+
+			// each resource is only deleted once the report lists it along
+			// with its snapshot
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme, objects...)
+			dynamicClient.PrependReactor("delete", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				reports := &cleanyv1alpha1.CleaningReportList{}
+				if err := k8sClient.List(ctx, reports); err != nil {
+					return true, nil, err
+				}
+				if len(reports.Items) != 1 || !reports.Items[0].Status.InProgress {
+					return true, nil, fmt.Errorf("no report in progress")
+				}
+				_, snapshots, err := LoadResources(ctx, k8sClient, &reports.Items[0])
+				if err != nil || len(snapshots) != 2 {
+					return true, nil, fmt.Errorf("snapshots not stored: %v", err)
+				}
+				return false, nil, nil
+			})
+
+			cleaner := newLibraryCleaner()
+			cleaner.Spec.Action = cleanyv1alpha1.ActionDelete
+			e := &Executor{cleaner: cleaner, owner: cleaner, reportLabel: cleanyv1alpha1.CleanerLabel,
+				protection: NewProtection(config.New()), snapshotInlineLimit: 100, throttle: &throttle{},
+				k8sClient: k8sClient, dynamicClient: dynamicClient, scheme: scheme}
+
+			summary := &models.RunSummary{}
+			err := e.act(ctx, resources, nil, false, summary)
+			reports := &cleanyv1alpha1.CleaningReportList{}
+			if listErr := k8sClient.List(ctx, reports); listErr != nil {
+				t.Fatal(listErr)
+			}
+
+			if tt.failSecrets {
+				if err == nil || summary.Deleted != 0 || len(dynamicClient.Actions()) != 0 {
+					t.Errorf("expected the run to be aborted before acting, got %v and %+v", err, summary)
+				}
+				if len(reports.Items) != 0 {
+					t.Errorf("expected the report without snapshots to be deleted, got %d reports", len(reports.Items))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Deleted != 2 || summary.Failed != 0 || len(reports.Items) != 1 {
+				t.Fatalf("expected the resources to be deleted and reported, got %+v", summary)
+			}
+			report := &reports.Items[0]
+			resourceInfo, snapshots, err := LoadResources(ctx, k8sClient, report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Status.InProgress || report.Status.Digest != reportDigest(&report.Spec, resourceInfo, snapshots) {
+				t.Errorf("expected the digest of the outcome once done, got %+v", report.Status)
+			}
+			if len(report.Spec.ResourceInfo) != 2 || report.Spec.ResourceInfo[0].Resource.Name != "first" {
+				t.Errorf("expected the resources in the order recorded, got %+v", report.Spec.ResourceInfo)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+)
+
+const (
+	// minThrottleDelay is the delay between requests after the API server
+	// first throttles or fails a request
+	minThrottleDelay = 100 * time.Millisecond
+
+	// maxThrottleDelay bounds the delay between requests
+	maxThrottleDelay = 30 * time.Second
+)
+
+// NewActionLimiter returns the rate limiter of the delete and update
+// requests shared by all Executors.
+func NewActionLimiter(cfg *config.Config) *rate.Limiter {
+	if cfg.ActionQPS == 0 {
+		return rate.NewLimiter(rate.Inf, cfg.ActionBurst)
+	}
+	return rate.NewLimiter(rate.Limit(cfg.ActionQPS), cfg.ActionBurst)
+}
+
+// throttle paces the delete and update requests of a run. Beside the rate
+// limiters, it waits an adaptive delay between requests, raised each time
+// the API server throttles or fails a request and lowered as they succeed.
+type throttle struct {
+	limiters []*rate.Limiter
+	delay    time.Duration
+}
+
+// newThrottle returns the throttle of the requests of cleaner, limited by
+// limiter, if not nil, and by the rate limit of cleaner.
+func newThrottle(limiter *rate.Limiter, cleaner *cleanyv1alpha1.Cleaner) *throttle {
+	t := &throttle{}
+	if limiter != nil {
+		t.limiters = append(t.limiters, limiter)
+	}
+	if rateLimit := cleaner.Spec.RateLimit; rateLimit != nil {
+		burst := int(rateLimit.Burst)
+		if burst == 0 {
+			burst = int(rateLimit.QPS)
+		}
+		t.limiters = append(t.limiters, rate.NewLimiter(rate.Limit(rateLimit.QPS), burst))
+	}
+	return t
+}
+
+// do sends a request with send, once the limiters and the delay allow it.
+// It only paces requests: a request the API server throttles or fails is
+// not sent again, the RetryPolicy of the Cleaner decides, see retryRequest.
+func (t *throttle) do(ctx context.Context, send func() error) error {
+	if err := t.wait(ctx); err != nil {
+		return err
+	}
+	err := send()
+	if !throttled(err) {
+		t.delay /= 2
+		if t.delay < minThrottleDelay {
+			t.delay = 0
+		}
+		return err
+	}
+
+	t.delay = max(2*t.delay, minThrottleDelay)
+	if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+		t.delay = max(t.delay, time.Duration(seconds)*time.Second)
+	}
+	t.delay = min(t.delay, maxThrottleDelay)
+	return err
+}
+
+// wait waits for the limiters and the delay.
+func (t *throttle) wait(ctx context.Context) error {
+	for _, limiter := range t.limiters {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if t.delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttled returns whether err is the API server throttling the request,
+// or failing it on its side.
+func throttled(err error) bool {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		return false
+	}
+	code := status.Status().Code
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
@@ -0,0 +1,65 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestThrottle(t *testing.T) {
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "web")
+	tooManyRequests := apierrors.NewTooManyRequests("slow down", 0)
+	unavailable := apierrors.NewServiceUnavailable("unavailable")
+
+	tests := []struct {
+		name      string
+		responses []error
+		throttled bool
+	}{
+		{"success", []error{nil}, false},
+		{"not throttled", []error{notFound}, false},
+		{"throttled", []error{tooManyRequests, unavailable}, true},
+		{"recovered", []error{tooManyRequests, nil, nil, nil}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &throttle{}
+			for _, response := range tt.responses {
+				sent := 0
+				err := th.do(context.Background(), func() error {
+					sent++
+					return response
+				})
+				// requests are not retried, whatever the response
+				if err != response || sent != 1 {
+					t.Errorf("expected a single request failing with %v, got %d failing with %v", response, sent, err)
+				}
+			}
+			if (th.delay != 0) != tt.throttled {
+				t.Errorf("expected throttled %t, got delay %s", tt.throttled, th.delay)
+			}
+		})
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	tests := []struct {
+		err       error
+		throttled bool
+	}{
+		{nil, false},
+		{fmt.Errorf("connection refused"), false},
+		{apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "web", fmt.Errorf("denied")), false},
+		{apierrors.NewTooManyRequests("slow down", 1), true},
+		{apierrors.NewInternalError(fmt.Errorf("etcd")), true},
+		{fmt.Errorf("wrapped: %w", apierrors.NewServiceUnavailable("unavailable")), true},
+	}
+	for _, tt := range tests {
+		if throttled(tt.err) != tt.throttled {
+			t.Errorf("expected throttled(%v) to be %t", tt.err, tt.throttled)
+		}
+	}
+}
@@ -2,34 +2,110 @@ package manager
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"sync"
 	"time"
 
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
 	"github.com/wys1203/Cleany/internal/executor"
+	"github.com/wys1203/Cleany/internal/executor/models"
+	"github.com/wys1203/Cleany/internal/metrics"
 )
 
 const (
 	StatusInQueue = "in-queue"
 	StatusRunning = "running"
 	StatusDone    = "done"
+
+	// StatusBackoff is the status of a task waiting to be attempted again
+	// after its run failed, see RetryPolicy
+	StatusBackoff = "backoff"
 )
 
+const (
+	// MaxRunHistory is the number of runs kept for each Cleaner
+	MaxRunHistory = 10
+
+	// maxRunErrors is the number of errors kept in each run record
+	maxRunErrors = 10
+
+	// defaultRetryBackoff and defaultMaxRetryBackoff are the delays between
+	// the attempts of a run when the RetryPolicy does not set them
+	defaultRetryBackoff    = 10 * time.Second
+	defaultMaxRetryBackoff = 5 * time.Minute
+)
+
+// managerlog is for logging in this package.
+var managerlog = logf.Log.WithName("cleaner-manager")
+
 type Task struct {
+	// Name is the namespace/name of the Cleaner, see TaskName and
+	// NamespacedTaskName
 	Name   string
 	Status string
 
 	Cleaner *cleanyv1alpha1.Cleaner
+
+	// Namespaced is set when Cleaner is the AsCleaner view of a
+	// NamespacedCleaner
+	Namespaced bool
+
+	// ReportName is set to take the action listed in an approved
+	// CleaningReport, instead of selecting resources
+	ReportName string
+
+	// Attempt is the number of the attempt of the run, from 1
+	Attempt int
+
+	// queuedAt is when the task was added to the queue
+	queuedAt time.Time
+}
+
+// TaskName returns the name of the task running cleaner.
+func TaskName(cleaner *cleanyv1alpha1.Cleaner) string {
+	return client.ObjectKeyFromObject(cleaner).String()
+}
+
+// NamespacedTaskName returns the name of the task running a NamespacedCleaner,
+// given it or its AsCleaner view. It is distinct from the name of the task
+// of a Cleaner with the same namespace and name.
+func NamespacedTaskName(cleaner client.Object) string {
+	return "NamespacedCleaner/" + client.ObjectKeyFromObject(cleaner).String()
+}
+
+// runner runs the tasks of a Cleaner, see executor.Executor.
+type runner interface {
+	Run(ctx context.Context) (*models.RunSummary, error)
+	RunApproved(ctx context.Context, reportName string) (*models.RunSummary, error)
 }
 
+// CleanerManager runs cleaner tasks on a pool of workers.
+// It is added to the controller manager as a Runnable that needs leader
+// election, so with --leader-elect only the leader executes cleaners.
 type CleanerManager struct {
-	manager.Manager
+	mgr manager.Manager
 
-	// workerCount is the number of workers to run the cleaner
-	workerCount int
+	// cfg contains the worker count, queue size and run timeout
+	cfg *config.Config
+
+	// limiter limits the delete and update requests of all tasks
+	limiter *rate.Limiter
+
+	// newRunner returns the runner of a task, an Executor
+	newRunner func(ctx context.Context, task *Task) (runner, error)
+
+	// recorder records the Events on the Cleaners, those of mgr if nil
+	recorder record.EventRecorder
 
 	// taskQueue is the queue of tasks to be cleaned
 	taskQueue chan *Task
@@ -37,41 +113,83 @@ type CleanerManager struct {
 	// taskStatus is the status of the task
 	taskStatus map[string]*Task
 
+	// runHistory contains the completed runs of each task, most recent first
+	runHistory map[string][]cleanyv1alpha1.CleanerRun
+
+	// stopped is set once the workers have been stopped, after which
+	// no more tasks are accepted
+	stopped bool
+
 	taskStatusMu sync.Mutex
 }
 
-func NewCleanerManager(m manager.Manager, workerCount int) *CleanerManager {
-	return &CleanerManager{
-		Manager:     m,
-		workerCount: workerCount,
-		taskQueue:   make(chan *Task, 2000),
-		taskStatus:  make(map[string]*Task),
+var _ manager.LeaderElectionRunnable = &CleanerManager{}
+
+func NewCleanerManager(m manager.Manager, cfg *config.Config) *CleanerManager {
+	c := &CleanerManager{
+		mgr:        m,
+		cfg:        cfg,
+		limiter:    executor.NewActionLimiter(cfg),
+		taskQueue:  make(chan *Task, cfg.QueueSize),
+		taskStatus: make(map[string]*Task),
+		runHistory: make(map[string][]cleanyv1alpha1.CleanerRun),
 	}
+	c.newRunner = c.newExecutor
+	return c
+}
+
+// NeedLeaderElection makes sure workers only run on the elected leader.
+func (c *CleanerManager) NeedLeaderElection() bool {
+	return true
 }
 
+// Start runs the workers until ctx is cancelled, which happens when the
+// manager is stopped or leadership is lost. Running tasks are cancelled and
+// tasks still in the queue are released, so the next leader can pick them up.
 func (c *CleanerManager) Start(ctx context.Context) error {
-	for i := 0; i < c.workerCount; i++ {
-		go c.worker(ctx)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < c.cfg.WorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.worker(ctx)
+		}()
 	}
 
-	return c.Manager.Start(ctx)
+	<-ctx.Done()
+	wg.Wait()
+
+	c.releaseTasks()
+	return nil
 }
 
 func (c *CleanerManager) AddTask(task *Task) bool {
 	c.taskStatusMu.Lock()
 	defer c.taskStatusMu.Unlock()
 
-	// check if the task is already in the queue or running or done
-	if _, ok := c.taskStatus[task.Name]; ok {
+	if c.stopped {
 		return false
 	}
 
-	// add the task to the queue
-	task.Status = StatusInQueue
-	c.taskStatus[task.Name] = task
+	// check if the task is already in the queue or running
+	if t, ok := c.taskStatus[task.Name]; ok && t.Status != StatusDone {
+		return false
+	}
 
-	c.taskQueue <- task
-	return true
+	// add the task to the queue, without blocking when it is full
+	if task.Attempt == 0 {
+		task.Attempt = 1
+	}
+	task.Status = StatusInQueue
+	task.queuedAt = time.Now()
+	select {
+	case c.taskQueue <- task:
+		c.taskStatus[task.Name] = task
+		c.updateQueueDepth()
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *CleanerManager) GetTaskStatus(name string) *Task {
@@ -84,52 +202,300 @@ func (c *CleanerManager) GetTaskStatus(name string) *Task {
 	return nil
 }
 
+// GetRunHistory returns the completed runs of a task, most recent first.
+// Only the runs completed since the CleanerManager started are known, the
+// reconcilers keep the earlier ones in the status of the Cleaners.
+func (c *CleanerManager) GetRunHistory(name string) []cleanyv1alpha1.CleanerRun {
+	c.taskStatusMu.Lock()
+	defer c.taskStatusMu.Unlock()
+
+	history := make([]cleanyv1alpha1.CleanerRun, len(c.runHistory[name]))
+	for i := range c.runHistory[name] {
+		c.runHistory[name][i].DeepCopyInto(&history[i])
+	}
+	return history
+}
+
 func (c *CleanerManager) worker(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			// Main context cancelled, but don't return immediately.
-			// Instead, proceed to check if there's a running task that needs to complete.
+			return
 		case task := <-c.taskQueue:
-			c.taskStatusMu.Lock()
-			task.Status = StatusRunning
-			c.taskStatus[task.Name] = task
-			c.taskStatusMu.Unlock()
-
-			// Do the cleaning
-			taskCtx, cancel := context.WithTimeout(ctx, 1*time.Minute)
-
-			go func() {
-				exe, err := executor.NewExecutor(taskCtx, task.Name, c.Manager.GetConfig(), c.Manager.GetClient(), c.Manager.GetScheme())
-				if err != nil {
-					log.Printf("error creating executor for %s: %v", task.Name, err)
-					cancel()
-					return
-				}
-				if err := exe.Run(taskCtx); err != nil {
-					log.Printf("error cleaning %s: %v", task.Name, err)
-				}
-				cancel() // Ensure resources are released once Execute is done.
-			}()
-
-			// Wait for either the task to complete or the main context to be cancelled.
-			select {
-			case <-taskCtx.Done():
-				// Task completed or task context cancelled (due to timeout or main context cancellation).
-			case <-ctx.Done():
-				// Main context cancelled. Wait for the task to complete.
-				<-taskCtx.Done()
-			}
-
-			c.taskStatusMu.Lock()
-			task.Status = StatusDone
-			c.taskStatus[task.Name] = task
-			c.taskStatusMu.Unlock()
-
 			if ctx.Err() != nil {
-				// If the main context is cancelled, exit the loop and end the worker.
+				// Leadership lost while waiting: leave the task for releaseTasks.
+				c.requeue(task)
 				return
 			}
+			c.updateQueueDepth()
+			metrics.ObserveSince(metrics.TaskWait, task.queuedAt)
+			c.run(ctx, task)
+		}
+	}
+}
+
+// run executes a single task. The task context is derived from ctx, so a
+// running task is cancelled as soon as the worker stops.
+func (c *CleanerManager) run(ctx context.Context, task *Task) {
+	c.setTaskStatus(task, StatusRunning)
+	c.eventRecorder().Eventf(eventObject(task), corev1.EventTypeNormal, "RunStarted", "attempt %d started",
+		task.Attempt)
+
+	record := cleanyv1alpha1.CleanerRun{
+		ID:        string(uuid.NewUUID()),
+		StartTime: metav1.Now(),
+		Action:    task.Cleaner.Spec.Action,
+		Result:    cleanyv1alpha1.RunResultSucceeded,
+		Attempts:  int32(task.Attempt),
+	}
+
+	timeout := c.cfg.RunTimeout
+	if task.Cleaner.Spec.Timeout != nil {
+		timeout = task.Cleaner.Spec.Timeout.Duration
+	}
+	taskCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	exe, err := c.newRunner(taskCtx, task)
+	if err != nil {
+		managerlog.Error(err, "failed to create executor", "task", task.Name)
+	} else {
+		var summary *models.RunSummary
+		if task.ReportName != "" {
+			summary, err = exe.RunApproved(taskCtx, task.ReportName)
+		} else {
+			summary, err = exe.Run(taskCtx)
+		}
+		if err != nil {
+			managerlog.Error(err, "failed to run cleaner", "task", task.Name, "attempt", task.Attempt)
+		}
+		if summary == nil {
+			summary = &models.RunSummary{}
+		}
+		record.MatchingResources = summary.Matched
+		record.DeletedResources = summary.Deleted
+		record.TransformedResources = summary.Transformed
+		record.FailedResources = summary.Failed
+		record.SkippedResources = summary.Skipped
+		record.DryRun = summary.DryRun
+		switch {
+		case summary.LimitExceeded != "":
+			record.Result = cleanyv1alpha1.RunResultLimitExceeded
+			record.Message = summary.LimitExceeded
+		case summary.PendingApproval:
+			record.Result = cleanyv1alpha1.RunResultPendingApproval
+			record.Message = fmt.Sprintf("CleaningReport %s awaits approval", summary.ReportName)
+		}
+		record.ReportName = summary.ReportName
+		record.Errors = append(record.Errors, summary.Errors...)
+	}
+
+	if ctx.Err() != nil {
+		// The run was interrupted by the worker stopping. Forget about it so
+		// it is not reported as done and can be scheduled again.
+		c.forgetTask(task)
+		return
+	}
+
+	if err != nil {
+		if c.retry(task, err) {
+			return
+		}
+		record.Errors = append([]string{err.Error()}, record.Errors...)
+	}
+	if len(record.Errors) > 0 {
+		record.Result = cleanyv1alpha1.RunResultFailed
+	}
+	if len(record.Errors) > maxRunErrors {
+		record.Errors = record.Errors[:maxRunErrors]
+	}
+	endTime := metav1.NewTime(time.Now())
+	record.EndTime = &endTime
+
+	c.recordRunEvent(task, &record)
+	metrics.Runs.WithLabelValues(task.Name, string(record.Result)).Inc()
+	metrics.RunDuration.WithLabelValues(task.Name).Observe(endTime.Sub(record.StartTime.Time).Seconds())
+	c.recordRun(task, record)
+}
+
+// newExecutor returns the Executor running task.
+func (c *CleanerManager) newExecutor(ctx context.Context, task *Task) (runner, error) {
+	return executor.NewExecutor(ctx, client.ObjectKeyFromObject(task.Cleaner), task.Namespaced, c.cfg,
+		c.limiter, c.eventRecorder(), c.mgr.GetConfig(), c.mgr.GetClient(), c.mgr.GetAPIReader(), c.mgr.GetScheme())
+}
+
+// recordRunEvent records an Event on the Cleaner of task with the outcome
+// of its run. Limits exceeded are recorded by the Executor.
+func (c *CleanerManager) recordRunEvent(task *Task, run *cleanyv1alpha1.CleanerRun) {
+	counts := fmt.Sprintf("%d matching, %d deleted, %d transformed, %d skipped, %d failed",
+		run.MatchingResources, run.DeletedResources, run.TransformedResources, run.SkippedResources,
+		run.FailedResources)
+	switch run.Result {
+	case cleanyv1alpha1.RunResultFailed:
+		message := "run failed"
+		if run.Attempts > 1 {
+			message = fmt.Sprintf("run failed after %d attempts", run.Attempts)
+		}
+		c.eventRecorder().Eventf(eventObject(task), corev1.EventTypeWarning, "RunFailed", "%s: %s (%s)",
+			message, run.Errors[0], counts)
+	case cleanyv1alpha1.RunResultPendingApproval:
+		c.eventRecorder().Event(eventObject(task), corev1.EventTypeNormal, "PendingApproval", run.Message)
+	case cleanyv1alpha1.RunResultSucceeded:
+		message := "run succeeded"
+		if run.DryRun {
+			message = "dry run succeeded"
+		}
+		c.eventRecorder().Eventf(eventObject(task), corev1.EventTypeNormal, "RunSucceeded", "%s: %s",
+			message, counts)
+	}
+}
+
+// eventRecorder returns the recorder of the Events on the Cleaners.
+func (c *CleanerManager) eventRecorder() record.EventRecorder {
+	if c.recorder != nil {
+		return c.recorder
+	}
+	return c.mgr.GetEventRecorderFor("cleaner-manager")
+}
+
+// retry schedules another attempt of task, whose run failed with err, if
+// the RetryPolicy of its Cleaner allows it. Runs of approved CleaningReports
+// are not retried, the report records their failure.
+func (c *CleanerManager) retry(task *Task, err error) bool {
+	policy := task.Cleaner.Spec.RetryPolicy
+	if policy == nil || task.ReportName != "" || task.Attempt >= int(policy.MaxAttempts) {
+		return false
+	}
+
+	delay := retryDelay(policy, task.Attempt)
+	managerlog.Info("retrying failed run", "task", task.Name, "attempt", task.Attempt, "delay", delay.String(),
+		"error", err.Error())
+	c.eventRecorder().Eventf(eventObject(task), corev1.EventTypeWarning, "RunRetrying",
+		"attempt %d failed, retrying in %s: %v", task.Attempt, delay, err)
+	next := &Task{
+		Name:       task.Name,
+		Cleaner:    task.Cleaner,
+		Namespaced: task.Namespaced,
+		Attempt:    task.Attempt + 1,
+	}
+	c.setTaskStatus(next, StatusBackoff)
+	time.AfterFunc(delay, func() {
+		c.queueRetry(next)
+	})
+	return true
+}
+
+// queueRetry puts task, waiting for its next attempt, back in the queue.
+// It is dropped if the workers stopped in the meantime or the queue is full.
+func (c *CleanerManager) queueRetry(task *Task) {
+	c.taskStatusMu.Lock()
+	defer c.taskStatusMu.Unlock()
+
+	if c.taskStatus[task.Name] != task {
+		return
+	}
+	if !c.stopped {
+		task.Status = StatusInQueue
+		task.queuedAt = time.Now()
+		select {
+		case c.taskQueue <- task:
+			c.updateQueueDepth()
+			return
+		default:
+			managerlog.Info("dropping retry, the queue is full", "task", task.Name, "attempt", task.Attempt)
+		}
+	}
+	delete(c.taskStatus, task.Name)
+}
+
+// retryDelay returns the delay before the attempt following attempt.
+func retryDelay(policy *cleanyv1alpha1.RetryPolicy, attempt int) time.Duration {
+	delay := policy.Backoff.Duration
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+	maxDelay := policy.MaxBackoff.Duration
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxRetryBackoff
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// eventObject returns the Cleaner, or NamespacedCleaner, run by task, to
+// record Events on.
+func eventObject(task *Task) client.Object {
+	if task.Namespaced {
+		return &cleanyv1alpha1.NamespacedCleaner{ObjectMeta: task.Cleaner.ObjectMeta}
+	}
+	return task.Cleaner
+}
+
+// ForgetCleaner deletes the run metrics of the task name, once its Cleaner or
+// NamespacedCleaner is deleted.
+func (c *CleanerManager) ForgetCleaner(name string) {
+	metrics.DeleteCleaner(name)
+}
+
+// recordRun marks task as done and adds record to its run history.
+func (c *CleanerManager) recordRun(task *Task, record cleanyv1alpha1.CleanerRun) {
+	c.taskStatusMu.Lock()
+	defer c.taskStatusMu.Unlock()
+
+	task.Status = StatusDone
+	c.taskStatus[task.Name] = task
+
+	history := append([]cleanyv1alpha1.CleanerRun{record}, c.runHistory[task.Name]...)
+	if len(history) > MaxRunHistory {
+		history = history[:MaxRunHistory]
+	}
+	c.runHistory[task.Name] = history
+}
+
+func (c *CleanerManager) setTaskStatus(task *Task, status string) {
+	c.taskStatusMu.Lock()
+	defer c.taskStatusMu.Unlock()
+
+	task.Status = status
+	c.taskStatus[task.Name] = task
+}
+
+func (c *CleanerManager) forgetTask(task *Task) {
+	c.taskStatusMu.Lock()
+	defer c.taskStatusMu.Unlock()
+
+	delete(c.taskStatus, task.Name)
+}
+
+// requeue puts back a task a worker took from the queue but did not run.
+func (c *CleanerManager) requeue(task *Task) {
+	select {
+	case c.taskQueue <- task:
+	default:
+		c.forgetTask(task)
+	}
+}
+
+// releaseTasks stops accepting tasks and drops all tasks still in the queue.
+func (c *CleanerManager) releaseTasks() {
+	c.taskStatusMu.Lock()
+	defer c.taskStatusMu.Unlock()
+
+	c.stopped = true
+	for {
+		select {
+		case task := <-c.taskQueue:
+			delete(c.taskStatus, task.Name)
+		default:
+			c.updateQueueDepth()
+			return
 		}
 	}
 }
+
+// updateQueueDepth reports the number of tasks in the queue.
+func (c *CleanerManager) updateQueueDepth() {
+	metrics.QueueDepth.Set(float64(len(c.taskQueue)))
+}
@@ -0,0 +1,339 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor/models"
+)
+
+// newTestManager returns a CleanerManager with a queue of queueSize tasks,
+// whose workers are not started.
+func newTestManager(queueSize int) *CleanerManager {
+	cfg := config.New()
+	cfg.QueueSize = queueSize
+	c := NewCleanerManager(nil, cfg)
+	c.recorder = record.NewFakeRecorder(100)
+	return c
+}
+
+// fakeRunner returns summary and err for every run.
+type fakeRunner struct {
+	summary *models.RunSummary
+	err     error
+}
+
+func (r *fakeRunner) Run(context.Context) (*models.RunSummary, error) {
+	return r.summary, r.err
+}
+
+func (r *fakeRunner) RunApproved(context.Context, string) (*models.RunSummary, error) {
+	return r.summary, r.err
+}
+
+// runWith makes c run its tasks with r.
+func runWith(c *CleanerManager, r runner) {
+	c.newRunner = func(context.Context, *Task) (runner, error) {
+		return r, nil
+	}
+}
+
+func newTask(name string) *Task {
+	cleaner := &cleanyv1alpha1.Cleaner{}
+	cleaner.Name = name
+	return &Task{Name: TaskName(cleaner), Cleaner: cleaner}
+}
+
+func TestAddTask(t *testing.T) {
+	c := newTestManager(2)
+
+	task := newTask("a")
+	if !c.AddTask(task) {
+		t.Fatal("expected the task to be queued")
+	}
+	if task.Status != StatusInQueue || task.Attempt != 1 {
+		t.Errorf("expected the first attempt in the queue, got %s attempt %d", task.Status, task.Attempt)
+	}
+
+	// a task is only queued once until done
+	for _, status := range []string{StatusInQueue, StatusRunning, StatusBackoff} {
+		c.setTaskStatus(task, status)
+		if c.AddTask(newTask("a")) {
+			t.Errorf("expected a task %s to be refused", status)
+		}
+	}
+	c.setTaskStatus(task, StatusDone)
+	<-c.taskQueue
+	if !c.AddTask(newTask("a")) {
+		t.Error("expected a task done to be queued again")
+	}
+
+	// tasks are refused rather than waiting for room in the queue
+	if !c.AddTask(newTask("b")) || c.AddTask(newTask("c")) {
+		t.Error("expected the task to be refused once the queue is full")
+	}
+	if c.GetTaskStatus(TaskName(newTask("c").Cleaner)) != nil {
+		t.Error("expected the task refused not to be recorded")
+	}
+}
+
+func TestLeadershipLost(t *testing.T) {
+	c := newTestManager(3)
+	c.cfg.WorkerCount = 2
+	for _, name := range []string{"a", "b", "c"} {
+		if !c.AddTask(newTask(name)) {
+			t.Fatalf("expected task %s to be queued", name)
+		}
+	}
+
+	// the workers stop as soon as leadership is lost, without running the
+	// tasks they take from the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.taskQueue) != 0 {
+		t.Errorf("expected the queue to be released, got %d tasks", len(c.taskQueue))
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if task := c.GetTaskStatus(TaskName(newTask(name).Cleaner)); task != nil {
+			t.Errorf("expected task %s to be forgotten, got %s", name, task.Status)
+		}
+	}
+	if c.AddTask(newTask("d")) {
+		t.Error("expected tasks to be refused once the workers stopped")
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	c := newTestManager(1)
+	task := newTask("a")
+	if !c.AddTask(task) {
+		t.Fatal("expected the task to be queued")
+	}
+
+	// a task taken by a worker losing leadership goes back in the queue,
+	// for releaseTasks to release
+	c.requeue(<-c.taskQueue)
+	if len(c.taskQueue) != 1 || c.GetTaskStatus(task.Name) != task {
+		t.Fatalf("expected the task back in the queue")
+	}
+
+	// unless another task took its place
+	other := newTask("b")
+	c.setTaskStatus(other, StatusInQueue)
+	c.requeue(other)
+	if c.GetTaskStatus(other.Name) != nil {
+		t.Error("expected the task not requeued to be forgotten")
+	}
+
+	c.releaseTasks()
+	if len(c.taskQueue) != 0 || c.GetTaskStatus(task.Name) != nil {
+		t.Error("expected the requeued task to be released")
+	}
+}
+
+func TestRunHistory(t *testing.T) {
+	c := newTestManager(1)
+	runWith(c, &fakeRunner{summary: &models.RunSummary{}})
+
+	task := newTask("a")
+	for i := 0; i < MaxRunHistory+2; i++ {
+		c.run(context.Background(), task)
+	}
+
+	history := c.GetRunHistory(task.Name)
+	if len(history) != MaxRunHistory {
+		t.Fatalf("expected %d runs, got %d", MaxRunHistory, len(history))
+	}
+	ids := make(map[string]bool)
+	for i := range history {
+		ids[history[i].ID] = true
+		if i > 0 && history[i].StartTime.After(history[i-1].StartTime.Time) {
+			t.Errorf("expected the most recent run first, got run %d after run %d", i, i-1)
+		}
+	}
+	if len(ids) != MaxRunHistory || ids[""] {
+		t.Errorf("expected each run to have its own ID, got %v", ids)
+	}
+	if task.Status != StatusDone {
+		t.Errorf("expected the task to be done, got %s", task.Status)
+	}
+
+	// the history is a copy
+	history[0].Result = cleanyv1alpha1.RunResultFailed
+	if c.GetRunHistory(task.Name)[0].Result != cleanyv1alpha1.RunResultSucceeded {
+		t.Error("expected the recorded history to be left unchanged")
+	}
+}
+
+func TestRunWithoutSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		result cleanyv1alpha1.RunResult
+	}{
+		{"succeeded", nil, cleanyv1alpha1.RunResultSucceeded},
+		{"failed", errors.New("boom"), cleanyv1alpha1.RunResultFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestManager(1)
+			runWith(c, &fakeRunner{err: tt.err})
+
+			task := newTask("a")
+			c.run(context.Background(), task)
+
+			history := c.GetRunHistory(task.Name)
+			if len(history) != 1 || history[0].Result != tt.result || history[0].MatchingResources != 0 {
+				t.Errorf("expected a %s run, got %+v", tt.result, history)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   cleanyv1alpha1.RetryPolicy
+		attempt  int
+		expected time.Duration
+	}{
+		{"first attempt", cleanyv1alpha1.RetryPolicy{Backoff: metav1.Duration{Duration: time.Second}}, 1, time.Second},
+		{"doubled", cleanyv1alpha1.RetryPolicy{Backoff: metav1.Duration{Duration: time.Second}}, 4, 8 * time.Second},
+		{"capped", cleanyv1alpha1.RetryPolicy{Backoff: metav1.Duration{Duration: time.Second},
+			MaxBackoff: metav1.Duration{Duration: 5 * time.Second}}, 4, 5 * time.Second},
+		{"capped by default", cleanyv1alpha1.RetryPolicy{Backoff: metav1.Duration{Duration: time.Minute}}, 10,
+			defaultMaxRetryBackoff},
+		{"many attempts", cleanyv1alpha1.RetryPolicy{}, 1000, defaultMaxRetryBackoff},
+		{"default", cleanyv1alpha1.RetryPolicy{}, 2, 2 * defaultRetryBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delay := retryDelay(&tt.policy, tt.attempt); delay != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, delay)
+			}
+		})
+	}
+}
+
+// newRetriedTask returns a task whose Cleaner retries failed runs after
+// backoff, up to maxAttempts attempts.
+func newRetriedTask(name string, maxAttempts int32, backoff time.Duration) *Task {
+	task := newTask(name)
+	task.Attempt = 1
+	task.Cleaner.Spec.RetryPolicy = &cleanyv1alpha1.RetryPolicy{MaxAttempts: maxAttempts,
+		Backoff: metav1.Duration{Duration: backoff}}
+	return task
+}
+
+func TestRetry(t *testing.T) {
+	c := newTestManager(1)
+	runWith(c, &fakeRunner{err: errors.New("boom")})
+
+	task := newRetriedTask("a", 2, time.Millisecond)
+	c.run(context.Background(), task)
+
+	// the failed run is attempted again once the backoff elapsed, and the
+	// task is not queued in the meantime
+	next := c.GetTaskStatus(task.Name)
+	if next == nil || next.Attempt != 2 {
+		t.Fatalf("expected a second attempt, got %+v", next)
+	}
+	if len(c.GetRunHistory(task.Name)) != 0 {
+		t.Error("expected the failed attempt not to be recorded as a run")
+	}
+	select {
+	case queued := <-c.taskQueue:
+		if queued != next || queued.Status != StatusInQueue {
+			t.Errorf("expected the second attempt in the queue, got %+v", queued)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second attempt to be queued")
+	}
+
+	// the last attempt is recorded as failed
+	c.run(context.Background(), next)
+	history := c.GetRunHistory(task.Name)
+	if len(history) != 1 || history[0].Result != cleanyv1alpha1.RunResultFailed || history[0].Attempts != 2 {
+		t.Errorf("expected a run failed after 2 attempts, got %+v", history)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		full    bool
+		stopped bool
+		queued  bool
+	}{
+		{"queued", false, false, true},
+		{"queue full", true, false, false},
+		{"stopped", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestManager(1)
+			if tt.full && !c.AddTask(newTask("other")) {
+				t.Fatal("expected the queue to be filled")
+			}
+			if tt.stopped {
+				c.releaseTasks()
+			}
+
+			task := newRetriedTask("a", 2, time.Hour)
+			c.setTaskStatus(task, StatusBackoff)
+			c.queueRetry(task)
+
+			// a retry dropped is forgotten, so that the next scheduled run
+			// is not refused
+			status := c.GetTaskStatus(task.Name)
+			switch {
+			case tt.queued && (status != task || task.Status != StatusInQueue):
+				t.Errorf("expected the retry to be queued, got %+v", status)
+			case !tt.queued && status != nil:
+				t.Errorf("expected the retry to be dropped, got %+v", status)
+			}
+		})
+	}
+}
+
+func TestNoRetryAfterStop(t *testing.T) {
+	c := newTestManager(1)
+	runWith(c, &fakeRunner{err: errors.New("boom")})
+
+	task := newRetriedTask("a", 2, 10*time.Millisecond)
+	c.run(context.Background(), task)
+	if next := c.GetTaskStatus(task.Name); next == nil || next.Status != StatusBackoff {
+		t.Fatalf("expected the task to wait for its next attempt, got %+v", next)
+	}
+
+	// leadership is lost before the next attempt is due
+	c.releaseTasks()
+	time.Sleep(50 * time.Millisecond)
+	if len(c.taskQueue) != 0 || c.GetTaskStatus(task.Name) != nil {
+		t.Error("expected the next attempt to be dropped once the workers stopped")
+	}
+
+	// nor is a run interrupted by the workers stopping retried
+	c = newTestManager(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.newRunner = func(context.Context, *Task) (runner, error) {
+		cancel()
+		return &fakeRunner{err: context.Canceled}, nil
+	}
+	task = newRetriedTask("a", 2, time.Millisecond)
+	c.run(ctx, task)
+	if c.GetTaskStatus(task.Name) != nil || len(c.GetRunHistory(task.Name)) != 0 {
+		t.Error("expected the interrupted run to be forgotten, not retried")
+	}
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "cleany"
+
+var (
+	// Runs counts the completed runs by cleaner, the task name of the
+	// Cleaner or NamespacedCleaner, and result
+	Runs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "Number of completed cleaner runs, by cleaner and result.",
+	}, []string{"cleaner", "result"})
+
+	// RunDuration observes the duration of the runs by cleaner
+	RunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the cleaner runs, by cleaner.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"cleaner"})
+
+	// ObjectsMatched counts the resources selected by the runs
+	ObjectsMatched = newObjectCounter("objects_matched_total", "Number of resources selected by the runs")
+
+	// ObjectsDeleted counts the resources deleted by the runs, dry runs
+	// excluded
+	ObjectsDeleted = newObjectCounter("objects_deleted_total", "Number of resources deleted by the runs")
+
+	// ObjectsTransformed counts the resources updated by the runs, dry runs
+	// excluded
+	ObjectsTransformed = newObjectCounter("objects_transformed_total", "Number of resources updated by the runs")
+
+	// ObjectsFailed counts the resources the action of a run failed on
+	ObjectsFailed = newObjectCounter("objects_failed_total", "Number of resources the action of the runs failed on")
+
+	// LuaDuration observes the duration of the calls to lua functions, by
+	// function name
+	LuaDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lua_call_duration_seconds",
+		Help:      "Duration of the calls to lua functions, by function.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+	}, []string{"function"})
+
+	// QueueDepth is the number of tasks waiting for a worker
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of cleaner tasks waiting for a worker.",
+	})
+
+	// TaskWait observes how long tasks wait for a worker
+	TaskWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_wait_duration_seconds",
+		Help:      "Time cleaner tasks wait in the queue for a worker.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(Runs, RunDuration, ObjectsMatched, ObjectsDeleted, ObjectsTransformed,
+		ObjectsFailed, LuaDuration, QueueDepth, TaskWait)
+}
+
+// DeleteCleaner deletes the series of the runs of cleaner, the task name of
+// a deleted Cleaner or NamespacedCleaner.
+func DeleteCleaner(cleaner string) {
+	Runs.DeletePartialMatch(prometheus.Labels{"cleaner": cleaner})
+	RunDuration.DeleteLabelValues(cleaner)
+}
+
+// newObjectCounter returns a counter of resources by group, version and kind.
+func newObjectCounter(name, help string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help + ", by group, version and kind.",
+	}, []string{"group", "version", "kind"})
+}
+
+// CountObject increments counter for a resource of kind gvk.
+func CountObject(counter *prometheus.CounterVec, gvk schema.GroupVersionKind) {
+	counter.WithLabelValues(gvk.Group, gvk.Version, gvk.Kind).Inc()
+}
+
+// ObserveSince observes on observer the time elapsed since start.
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func TestCountObject(t *testing.T) {
+	deployment := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	CountObject(ObjectsDeleted, deployment)
+	CountObject(ObjectsDeleted, deployment)
+	CountObject(ObjectsDeleted, schema.GroupVersionKind{Version: "v1", Kind: "Pod"})
+
+	if count := testutil.ToFloat64(ObjectsDeleted.WithLabelValues("apps", "v1", "Deployment")); count != 2 {
+		t.Errorf("expected 2 deleted Deployments, got %g", count)
+	}
+	if count := testutil.ToFloat64(ObjectsDeleted.WithLabelValues("", "v1", "Pod")); count != 1 {
+		t.Errorf("expected 1 deleted Pod, got %g", count)
+	}
+
+	count, err := testutil.GatherAndCount(metrics.Registry, "cleany_objects_deleted_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected the counters to be exported by the controller-runtime registry, got %d series", count)
+	}
+}
+
+func TestDeleteCleaner(t *testing.T) {
+	for _, cleaner := range []string{"default/deleted", "default/kept"} {
+		Runs.WithLabelValues(cleaner, "Succeeded").Inc()
+		Runs.WithLabelValues(cleaner, "Failed").Inc()
+		RunDuration.WithLabelValues(cleaner).Observe(1)
+	}
+
+	DeleteCleaner("default/deleted")
+	if count := testutil.CollectAndCount(Runs); count != 2 {
+		t.Errorf("expected only the runs of the kept cleaner, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(RunDuration); count != 1 {
+		t.Errorf("expected only the run duration of the kept cleaner, got %d series", count)
+	}
+}
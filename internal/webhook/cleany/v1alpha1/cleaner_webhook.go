@@ -0,0 +1,408 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
+	"k8s.io/client-go/discovery"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+	"github.com/wys1203/Cleany/internal/executor"
+	"github.com/wys1203/Cleany/internal/executor/resource"
+)
+
+// log is for logging in this package.
+var cleanerlog = logf.Log.WithName("cleaner-resource")
+
+// SetupCleanerWebhookWithManager registers the webhook for Cleaner in the manager.
+func SetupCleanerWebhookWithManager(mgr ctrl.Manager, cfg *config.Config) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+
+	return ctrl.NewWebhookManagedBy(mgr).For(&cleanyv1alpha1.Cleaner{}).
+		WithValidator(&CleanerCustomValidator{
+			Client:    mgr.GetClient(),
+			Discovery: discoveryClient,
+		}).
+		WithDefaulter(&CleanerCustomDefaulter{
+			Discovery:  discoveryClient,
+			RunTimeout: cfg.RunTimeout,
+		}).
+		Complete()
+}
+
+const (
+	// defaultReportsHistoryLimit is the default number of CleaningReports
+	// kept for each Cleaner
+	defaultReportsHistoryLimit = 10
+)
+
+// +kubebuilder:webhook:path=/mutate-cleany-wys1203-com-v1alpha1-cleaner,mutating=true,failurePolicy=fail,sideEffects=None,groups=cleany.wys1203.com,resources=cleaners,verbs=create;update,versions=v1alpha1,name=mcleaner-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// CleanerCustomDefaulter makes the defaults of a Cleaner explicit, so that
+// the stored spec describes what runs.
+type CleanerCustomDefaulter struct {
+	// Discovery resolves the preferred version of the kinds selected by
+	// the Cleaner
+	Discovery discovery.DiscoveryInterface
+
+	// RunTimeout is the default Timeout
+	RunTimeout time.Duration
+}
+
+var _ webhook.CustomDefaulter = &CleanerCustomDefaulter{}
+
+// Default implements webhook.CustomDefaulter so a webhook will be registered for the type Cleaner.
+func (d *CleanerCustomDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	cleaner, ok := obj.(*cleanyv1alpha1.Cleaner)
+	if !ok {
+		return fmt.Errorf("expected a Cleaner object but got %T", obj)
+	}
+	cleanerlog.V(1).Info("default", "name", cleaner.GetName())
+
+	d.defaultSpec(cleaner.Name, &cleaner.Spec)
+	// the system namespaces are excluded on each run, not listed in
+	// ExcludedNamespaces, so that opting out later takes effect
+	if cleaner.Spec.ResourcePolicySet.ExcludeSystemNamespaces == nil {
+		cleaner.Spec.ResourcePolicySet.ExcludeSystemNamespaces = ptr.To(true)
+	}
+	if ref := cleaner.Spec.ServiceAccountRef; ref != nil && ref.Namespace == "" {
+		ref.Namespace = cleaner.Namespace
+	}
+	return nil
+}
+
+// defaultSpec sets the defaults shared by Cleaners and NamespacedCleaners.
+func (d *CleanerCustomDefaulter) defaultSpec(name string, spec *cleanyv1alpha1.CleanerSpec) {
+	if spec.Action == "" {
+		spec.Action = cleanyv1alpha1.ActionDelete
+	}
+	spec.Schedule = strings.Join(strings.Fields(spec.Schedule), " ")
+	if spec.Timeout == nil {
+		spec.Timeout = &metav1.Duration{Duration: d.RunTimeout}
+	}
+	if spec.ReportsHistoryLimit == nil {
+		spec.ReportsHistoryLimit = ptr.To[int32](defaultReportsHistoryLimit)
+	}
+
+	for i := range spec.ResourcePolicySet.ResourceSelectors {
+		selector := &spec.ResourcePolicySet.ResourceSelectors[i]
+		if selector.Version != "" {
+			continue
+		}
+		// left empty when it cannot be resolved, which the validation reports
+		apiResource, err := resolveKind(d.Discovery, selector.Group, selector.Kind)
+		if err != nil {
+			cleanerlog.Info("cannot resolve version", "name", name,
+				"group", selector.Group, "kind", selector.Kind, "error", err.Error())
+			continue
+		}
+		if apiResource != nil {
+			selector.Version = apiResource.Version
+		}
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-cleany-wys1203-com-v1alpha1-cleaner,mutating=false,failurePolicy=fail,sideEffects=None,groups=cleany.wys1203.com,resources=cleaners,verbs=create;update,versions=v1alpha1,name=vcleaner-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// CleanerCustomValidator rejects Cleaners that would only fail once run:
+// invalid schedules, selectors and expressions, lua scripts that do not
+// load or do not define the functions they are called through, and kinds
+// the cluster does not serve.
+type CleanerCustomValidator struct {
+	// Client reads the lua libraries of the Cleaner
+	Client client.Client
+
+	// Discovery resolves the kinds selected by the Cleaner
+	Discovery discovery.DiscoveryInterface
+}
+
+var _ webhook.CustomValidator = &CleanerCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type Cleaner.
+func (v *CleanerCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	cleaner, ok := obj.(*cleanyv1alpha1.Cleaner)
+	if !ok {
+		return nil, fmt.Errorf("expected a Cleaner object but got %T", obj)
+	}
+	cleanerlog.V(1).Info("validate create", "name", cleaner.GetName())
+
+	return v.validateCleaner(ctx, cleaner)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Cleaner.
+func (v *CleanerCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	cleaner, ok := newObj.(*cleanyv1alpha1.Cleaner)
+	if !ok {
+		return nil, fmt.Errorf("expected a Cleaner object for the newObj but got %T", newObj)
+	}
+	cleanerlog.V(1).Info("validate update", "name", cleaner.GetName())
+
+	return v.validateCleaner(ctx, cleaner)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Cleaner.
+func (v *CleanerCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateCleaner returns an Invalid error listing every problem found in
+// cleaner.
+func (v *CleanerCustomValidator) validateCleaner(ctx context.Context, cleaner *cleanyv1alpha1.Cleaner,
+) (admission.Warnings, error) {
+	warnings, allErrs := v.validate(ctx, cleaner, false)
+	if len(allErrs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(cleanyv1alpha1.GroupVersion.WithKind("Cleaner").GroupKind(),
+		cleaner.Name, allErrs)
+}
+
+// validate returns every problem found in cleaner, the AsCleaner view of a
+// NamespacedCleaner if namespaced is set. Checks depending on the cluster
+// are skipped with a warning when the cluster cannot be queried.
+func (v *CleanerCustomValidator) validate(ctx context.Context, cleaner *cleanyv1alpha1.Cleaner, namespaced bool,
+) (admission.Warnings, field.ErrorList) {
+	var warnings admission.Warnings
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if _, err := cron.ParseStandard(cleaner.Spec.Schedule); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("schedule"), cleaner.Spec.Schedule, err.Error()))
+	}
+	if timeout := cleaner.Spec.Timeout; timeout != nil && timeout.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("timeout"), timeout.Duration.String(), "must be positive"))
+	}
+	if cleaner.Spec.Action == cleanyv1alpha1.ActionTransform && cleaner.Spec.Transform == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("transform"), "required when action is Transform"))
+	}
+
+	// Libraries can be created after the Cleaner, which the controller
+	// reports. Scripts are then only compiled, as loading them may require
+	// missing modules.
+	modules, _, err := executor.LoadLuaLibraries(ctx, v.Client, cleaner)
+	loadScripts := err == nil
+	if apierrors.IsNotFound(err) {
+		warnings = append(warnings, fmt.Sprintf("lua scripts not fully validated: %v", err))
+	} else if err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("luaLibraries"), field.OmitValueType{}, err.Error()))
+	}
+
+	validateScript := func(path *field.Path, source, fn string) {
+		if err := validateLua(ctx, path, source, fn, modules, loadScripts); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+	validateScript(specPath.Child("transform"), cleaner.Spec.Transform, "transform")
+
+	policyPath := specPath.Child("resourcePolicySet")
+	policySet := &cleaner.Spec.ResourcePolicySet
+	validateScript(policyPath.Child("aggregatedSelection"), policySet.AggregatedSelection, "evaluate")
+	if expression := policySet.AggregatedSelectionCEL; expression != "" {
+		if _, err := resource.CompileAggregatedCEL(expression); err != nil {
+			allErrs = append(allErrs, field.Invalid(policyPath.Child("aggregatedSelectionCEL"), expression, err.Error()))
+		}
+	}
+
+	for i := range policySet.ResourceSelectors {
+		selector := &policySet.ResourceSelectors[i]
+		selectorPath := policyPath.Child("resourceSelectors").Index(i)
+
+		validateScript(selectorPath.Child("evaluate"), selector.Evaluate, "evaluate")
+		if selector.NamespaceSelector != "" {
+			if _, err := labels.Parse(selector.NamespaceSelector); err != nil {
+				allErrs = append(allErrs, field.Invalid(selectorPath.Child("namespaceSelector"),
+					selector.NamespaceSelector, err.Error()))
+			}
+		}
+
+		apiResource, warning, err := v.validateKind(selectorPath, selector)
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		if err != nil {
+			allErrs = append(allErrs, err)
+		}
+		version := ""
+		if apiResource != nil {
+			version = apiResource.Version
+			if namespaced && !apiResource.Namespaced {
+				allErrs = append(allErrs, field.Invalid(selectorPath.Child("kind"), selector.Kind,
+					"cluster scoped kinds cannot be selected by a NamespacedCleaner"))
+			}
+		}
+		if selector.EvaluateCEL != "" {
+			if err := v.validateCEL(selectorPath.Child("evaluateCEL"), selector, version); err != nil {
+				allErrs = append(allErrs, err)
+			}
+		}
+	}
+
+	return warnings, allErrs
+}
+
+// validateKind verifies the cluster serves the kind selected by selector and
+// returns the resource serving it, resolving an empty Version to the
+// preferred one. When discovery fails, a warning is returned instead.
+func (v *CleanerCustomValidator) validateKind(path *field.Path, selector *cleanyv1alpha1.ResourceSelector,
+) (apiResource *metav1.APIResource, warning string, fieldErr *field.Error) {
+	if selector.Version == "" {
+		apiResource, err := resolveKind(v.Discovery, selector.Group, selector.Kind)
+		if err != nil {
+			return nil, fmt.Sprintf("%s not validated: %v", path, err), nil
+		}
+		if apiResource == nil {
+			return nil, "", field.Invalid(path.Child("kind"), selector.Kind,
+				fmt.Sprintf("kind is not served by the cluster in group %q", selector.Group))
+		}
+		return apiResource, "", nil
+	}
+
+	gv := schema.GroupVersion{Group: selector.Group, Version: selector.Version}
+	resources, err := v.Discovery.ServerResourcesForGroupVersion(gv.String())
+	if apierrors.IsNotFound(err) {
+		return nil, "", field.Invalid(path.Child("version"), selector.Version,
+			fmt.Sprintf("group version %q is not served by the cluster", gv))
+	}
+	if err != nil {
+		return nil, fmt.Sprintf("%s not validated: %v", path, err), nil
+	}
+	if apiResource = findKind(resources, gv, selector.Kind); apiResource == nil {
+		return nil, "", field.Invalid(path.Child("kind"), selector.Kind,
+			fmt.Sprintf("kind is not served by the cluster in group version %q", gv))
+	}
+	return apiResource, "", nil
+}
+
+// validateCEL compiles the evaluateCEL expression of selector, type checked
+// against the schema of the kind in version when not empty and the cluster
+// publishes it.
+func (v *CleanerCustomValidator) validateCEL(path *field.Path, selector *cleanyv1alpha1.ResourceSelector,
+	version string,
+) *field.Error {
+	var s *spec.Schema
+	if version != "" {
+		gvk := schema.GroupVersionKind{Group: selector.Group, Version: version, Kind: selector.Kind}
+		schemaResolver := &resolver.ClientDiscoveryResolver{Discovery: v.Discovery}
+		if resolved, err := schemaResolver.ResolveSchema(gvk); err == nil {
+			s = resolved
+		}
+	}
+
+	if _, err := resource.CompileCEL(selector.EvaluateCEL, s); err != nil {
+		return field.Invalid(path, selector.EvaluateCEL, err.Error())
+	}
+	return nil
+}
+
+// validateLua compiles source and, if load is set, loads it with modules
+// and verifies it defines the function fn.
+func validateLua(ctx context.Context, path *field.Path, source, fn string, modules resource.LuaModules,
+	load bool,
+) *field.Error {
+	if source == "" {
+		return nil
+	}
+
+	script, err := resource.CompileLuaScript(path.String(), source, resource.DefaultLuaLimits)
+	if err != nil {
+		return field.Invalid(path, field.OmitValueType{}, err.Error())
+	}
+	defer script.Close()
+	if !load {
+		return nil
+	}
+
+	script.UseModules(modules)
+	if err := script.Validate(ctx, fn); err != nil {
+		return field.Invalid(path, field.OmitValueType{}, err.Error())
+	}
+	return nil
+}
+
+// resolveKind returns the resource serving kind in group, trying the
+// preferred version of the group first, or nil if no version of group
+// serves kind.
+func resolveKind(discoveryClient discovery.DiscoveryInterface, group, kind string) (*metav1.APIResource, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range groups.Groups {
+		if groups.Groups[i].Name != group {
+			continue
+		}
+		versions := []string{groups.Groups[i].PreferredVersion.Version}
+		for _, version := range groups.Groups[i].Versions {
+			if version.Version != groups.Groups[i].PreferredVersion.Version {
+				versions = append(versions, version.Version)
+			}
+		}
+
+		for _, version := range versions {
+			gv := schema.GroupVersion{Group: group, Version: version}
+			resources, err := discoveryClient.ServerResourcesForGroupVersion(gv.String())
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if apiResource := findKind(resources, gv, kind); apiResource != nil {
+				return apiResource, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// findKind returns the resource of kind in resources, listed for gv, with
+// its group and version set, or nil if there is none.
+func findKind(resources *metav1.APIResourceList, gv schema.GroupVersion, kind string) *metav1.APIResource {
+	for i := range resources.APIResources {
+		// subresources share the kind of their resource
+		if resources.APIResources[i].Kind == kind && !strings.Contains(resources.APIResources[i].Name, "/") {
+			apiResource := resources.APIResources[i].DeepCopy()
+			apiResource.Group, apiResource.Version = gv.Group, gv.Version
+			return apiResource
+		}
+	}
+	return nil
+}
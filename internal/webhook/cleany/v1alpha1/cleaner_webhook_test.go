@@ -0,0 +1,302 @@
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/openapi"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+// fakeDiscovery serves pods, namespaces, the deployments scale subresource
+// and cronjobs, without publishing schemas.
+type fakeDiscovery struct {
+	*discoveryfake.FakeDiscovery
+}
+
+func (d *fakeDiscovery) OpenAPIV3() openapi.Client {
+	return noSchemas{}
+}
+
+type noSchemas struct{}
+
+func (noSchemas) Paths() (map[string]openapi.GroupVersion, error) {
+	return nil, errors.New("openapi not available")
+}
+
+func newValidator(t *testing.T) *CleanerCustomValidator {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "common", Namespace: "default"},
+			Data:       map[string]string{"labels.lua": "return {}"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "default"},
+			Data:       map[string]string{"broken.lua": "function ("},
+		},
+	).Build()
+
+	discovery := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{}}
+	discovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Kind: "Pod", Namespaced: true},
+				{Name: "pods/status", Kind: "Pod", Namespaced: true},
+				{Name: "namespaces", Kind: "Namespace"},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments/scale", Kind: "Scale", Namespaced: true}},
+		},
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []metav1.APIResource{{Name: "cronjobs", Kind: "CronJob", Namespaced: true}},
+		},
+		{
+			GroupVersion: "batch/v1beta1",
+			APIResources: []metav1.APIResource{
+				{Name: "cronjobs", Kind: "CronJob", Namespaced: true},
+				{Name: "legacyjobs", Kind: "LegacyJob", Namespaced: true},
+			},
+		},
+	}
+	return &CleanerCustomValidator{Client: k8sClient, Discovery: &fakeDiscovery{discovery}}
+}
+
+func newCleaner() *cleanyv1alpha1.Cleaner {
+	return &cleanyv1alpha1.Cleaner{
+		ObjectMeta: metav1.ObjectMeta{Name: "cleaner", Namespace: "default"},
+		Spec: cleanyv1alpha1.CleanerSpec{
+			Schedule: "0 * * * *",
+			Action:   cleanyv1alpha1.ActionDelete,
+			ResourcePolicySet: cleanyv1alpha1.ResourcePolicySet{
+				ResourceSelectors: []cleanyv1alpha1.ResourceSelector{{
+					Version:           "v1",
+					Kind:              "Pod",
+					NamespaceSelector: "env in (dev, test)",
+					Evaluate:          `local labels = require("labels") function evaluate() return {matching = true} end`,
+					EvaluateCEL:       `object.metadata.name.startsWith("tmp-")`,
+				}},
+			},
+			LuaLibraries: []cleanyv1alpha1.LuaLibraryReference{{Name: "common"}},
+		},
+	}
+}
+
+func TestValidateCleaner(t *testing.T) {
+	validator := newValidator(t)
+	warnings, err := validator.ValidateCreate(context.Background(), newCleaner())
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("expected valid cleaner, got %v %v", warnings, err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(*cleanyv1alpha1.Cleaner)
+		fields []string
+	}{
+		{"schedule", func(c *cleanyv1alpha1.Cleaner) { c.Spec.Schedule = "every hour" },
+			[]string{"spec.schedule"}},
+		{"transform required", func(c *cleanyv1alpha1.Cleaner) { c.Spec.Action = cleanyv1alpha1.ActionTransform },
+			[]string{"spec.transform"}},
+		{"transform function", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.Action = cleanyv1alpha1.ActionTransform
+			c.Spec.Transform = `function evaluate() end`
+		}, []string{"spec.transform"}},
+		{"evaluate syntax", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Evaluate = "function evaluate("
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].evaluate"}},
+		{"aggregated evaluate", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.AggregatedSelection = `resources = {}`
+		}, []string{"spec.resourcePolicySet.aggregatedSelection"}},
+		{"aggregated CEL", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.AggregatedSelectionCEL = `resources.size(`
+		}, []string{"spec.resourcePolicySet.aggregatedSelectionCEL"}},
+		{"namespace selector", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].NamespaceSelector = "env in dev"
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].namespaceSelector"}},
+		{"evaluate CEL", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].EvaluateCEL = `object.metadata.name +`
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].evaluateCEL"}},
+		{"version", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Version = "v2"
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].version"}},
+		{"kind", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Group = "apps"
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Kind = "Deployment"
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].kind"}},
+		{"timeout", func(c *cleanyv1alpha1.Cleaner) { c.Spec.Timeout = &metav1.Duration{} },
+			[]string{"spec.timeout"}},
+		{"unresolved version", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Version = ""
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Kind = "Pods"
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].kind"}},
+		{"broken library", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.LuaLibraries = append(c.Spec.LuaLibraries, cleanyv1alpha1.LuaLibraryReference{Name: "broken"})
+		}, []string{"spec.luaLibraries"}},
+		{"several errors", func(c *cleanyv1alpha1.Cleaner) {
+			c.Spec.Schedule = ""
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Kind = "Pods"
+		}, []string{"spec.schedule", "spec.resourcePolicySet.resourceSelectors[0].kind"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := newCleaner()
+			tt.mutate(cleaner)
+			_, err := validator.ValidateUpdate(context.Background(), newCleaner(), cleaner)
+			if !apierrors.IsInvalid(err) {
+				t.Fatalf("expected invalid error, got %v", err)
+			}
+			causes := err.(apierrors.APIStatus).Status().Details.Causes
+			if len(causes) != len(tt.fields) {
+				t.Fatalf("expected errors on %v, got %v", tt.fields, err)
+			}
+			for i, field := range tt.fields {
+				if causes[i].Field != field {
+					t.Errorf("expected error on %s, got %v", field, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMissingLibrary(t *testing.T) {
+	cleaner := newCleaner()
+	cleaner.Spec.LuaLibraries = []cleanyv1alpha1.LuaLibraryReference{{Name: "missing"}}
+
+	// the scripts would fail to load without the library, so are only compiled
+	warnings, err := newValidator(t).ValidateCreate(context.Background(), cleaner)
+	if err != nil {
+		t.Fatalf("expected missing library to not be rejected, got %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "missing") {
+		t.Errorf("expected a warning about the missing library, got %v", warnings)
+	}
+}
+
+func TestDefaultCleaner(t *testing.T) {
+	defaulter := &CleanerCustomDefaulter{Discovery: newValidator(t).Discovery, RunTimeout: time.Minute}
+
+	cleaner := newCleaner()
+	cleaner.Spec.Action = ""
+	cleaner.Spec.Schedule = " 0  *\t* * * "
+	cleaner.Spec.ResourcePolicySet.ResourceSelectors = []cleanyv1alpha1.ResourceSelector{
+		{Group: "batch", Kind: "CronJob"},
+		{Group: "batch", Kind: "LegacyJob"},
+		{Group: "batch", Kind: "Missing"},
+		{Group: "batch", Version: "v1beta1", Kind: "CronJob"},
+	}
+	cleaner.Spec.ServiceAccountRef = &cleanyv1alpha1.ServiceAccountRef{Name: "cleaner"}
+	if err := defaulter.Default(context.Background(), cleaner); err != nil {
+		t.Fatal(err)
+	}
+
+	if cleaner.Spec.Action != cleanyv1alpha1.ActionDelete {
+		t.Errorf("expected Delete action, got %s", cleaner.Spec.Action)
+	}
+	if cleaner.Spec.Schedule != "0 * * * *" {
+		t.Errorf("expected normalized schedule, got %q", cleaner.Spec.Schedule)
+	}
+	if cleaner.Spec.Timeout == nil || cleaner.Spec.Timeout.Duration != time.Minute {
+		t.Errorf("expected default timeout, got %v", cleaner.Spec.Timeout)
+	}
+	if cleaner.Spec.ReportsHistoryLimit == nil || *cleaner.Spec.ReportsHistoryLimit != defaultReportsHistoryLimit {
+		t.Errorf("expected default reports history limit, got %v", cleaner.Spec.ReportsHistoryLimit)
+	}
+	if policySet := cleaner.Spec.ResourcePolicySet; policySet.ExcludedNamespaces != nil ||
+		policySet.ExcludeSystemNamespaces == nil || !*policySet.ExcludeSystemNamespaces {
+		t.Errorf("expected the system namespaces to be excluded without being listed, got %v and %v",
+			policySet.ExcludedNamespaces, policySet.ExcludeSystemNamespaces)
+	}
+	if cleaner.Spec.ServiceAccountRef.Namespace != "default" {
+		t.Errorf("expected the service account in the cleaner namespace, got %q", cleaner.Spec.ServiceAccountRef.Namespace)
+	}
+	var versions []string
+	for _, selector := range cleaner.Spec.ResourcePolicySet.ResourceSelectors {
+		versions = append(versions, selector.Version)
+	}
+	if !reflect.DeepEqual(versions, []string{"v1", "v1beta1", "", "v1beta1"}) {
+		t.Errorf("unexpected versions %v", versions)
+	}
+
+	// explicit values are kept
+	cleaner.Spec.Timeout = &metav1.Duration{Duration: time.Hour}
+	if err := defaulter.Default(context.Background(), cleaner); err != nil {
+		t.Fatal(err)
+	}
+	if cleaner.Spec.Timeout.Duration != time.Hour {
+		t.Errorf("expected explicit timeout to be kept, got %v", cleaner.Spec.Timeout)
+	}
+}
+
+func TestDefaultExcludedNamespaces(t *testing.T) {
+	defaulter := &CleanerCustomDefaulter{Discovery: newValidator(t).Discovery, RunTimeout: time.Minute}
+
+	tests := []struct {
+		name     string
+		exclude  []*bool
+		excluded []string
+	}{
+		{"default", []*bool{nil, nil}, nil},
+		{"namespaces listed", []*bool{nil, nil}, []string{"staging"}},
+		{"opted out", []*bool{ptr.To(false), ptr.To(false)}, nil},
+		{"opted out of an existing Cleaner", []*bool{nil, ptr.To(false)}, []string{"staging"}},
+		{"opted in again", []*bool{ptr.To(false), ptr.To(true)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := newCleaner()
+			cleaner.Spec.ResourcePolicySet.ExcludedNamespaces = tt.excluded
+
+			// each update of the stored Cleaner sets the flag
+			for i, exclude := range tt.exclude {
+				if exclude != nil {
+					cleaner.Spec.ResourcePolicySet.ExcludeSystemNamespaces = exclude
+				}
+				if err := defaulter.Default(context.Background(), cleaner); err != nil {
+					t.Fatal(err)
+				}
+				data, err := json.Marshal(cleaner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cleaner = &cleanyv1alpha1.Cleaner{}
+				if err := json.Unmarshal(data, cleaner); err != nil {
+					t.Fatal(err)
+				}
+
+				// the system namespaces are never listed, so the flag alone
+				// decides whether they are excluded
+				policySet := cleaner.Spec.ResourcePolicySet
+				if !reflect.DeepEqual(policySet.ExcludedNamespaces, tt.excluded) {
+					t.Errorf("update %d: expected excluded namespaces %v, got %v", i, tt.excluded,
+						policySet.ExcludedNamespaces)
+				}
+				if policySet.ExcludeSystemNamespaces == nil ||
+					*policySet.ExcludeSystemNamespaces != (exclude == nil || *exclude) {
+					t.Errorf("update %d: unexpected excludeSystemNamespaces %v", i, policySet.ExcludeSystemNamespaces)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/discovery"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+	"github.com/wys1203/Cleany/internal/config"
+)
+
+// log is for logging in this package.
+var namespacedcleanerlog = logf.Log.WithName("namespacedcleaner-resource")
+
+// SetupNamespacedCleanerWebhookWithManager registers the webhook for NamespacedCleaner in the manager.
+func SetupNamespacedCleanerWebhookWithManager(mgr ctrl.Manager, cfg *config.Config) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+
+	return ctrl.NewWebhookManagedBy(mgr).For(&cleanyv1alpha1.NamespacedCleaner{}).
+		WithValidator(&NamespacedCleanerCustomValidator{
+			CleanerCustomValidator: CleanerCustomValidator{
+				Client:    mgr.GetClient(),
+				Discovery: discoveryClient,
+			},
+		}).
+		WithDefaulter(&NamespacedCleanerCustomDefaulter{
+			CleanerCustomDefaulter: CleanerCustomDefaulter{
+				Discovery:  discoveryClient,
+				RunTimeout: cfg.RunTimeout,
+			},
+		}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-cleany-wys1203-com-v1alpha1-namespacedcleaner,mutating=true,failurePolicy=fail,sideEffects=None,groups=cleany.wys1203.com,resources=namespacedcleaners,verbs=create;update,versions=v1alpha1,name=mnamespacedcleaner-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// NamespacedCleanerCustomDefaulter sets the same defaults as for a Cleaner,
+// except for the excluded namespaces, as a NamespacedCleaner only selects
+// resources in its own namespace.
+type NamespacedCleanerCustomDefaulter struct {
+	CleanerCustomDefaulter
+}
+
+var _ webhook.CustomDefaulter = &NamespacedCleanerCustomDefaulter{}
+
+// Default implements webhook.CustomDefaulter so a webhook will be registered for the type NamespacedCleaner.
+func (d *NamespacedCleanerCustomDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	namespacedCleaner, ok := obj.(*cleanyv1alpha1.NamespacedCleaner)
+	if !ok {
+		return fmt.Errorf("expected a NamespacedCleaner object but got %T", obj)
+	}
+	namespacedcleanerlog.V(1).Info("default", "name", namespacedCleaner.GetName())
+
+	d.defaultSpec(namespacedCleaner.Name, &namespacedCleaner.Spec.CleanerSpec)
+	return nil
+}
+
+// +kubebuilder:webhook:path=/validate-cleany-wys1203-com-v1alpha1-namespacedcleaner,mutating=false,failurePolicy=fail,sideEffects=None,groups=cleany.wys1203.com,resources=namespacedcleaners,verbs=create;update,versions=v1alpha1,name=vnamespacedcleaner-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// NamespacedCleanerCustomValidator validates a NamespacedCleaner as a
+// Cleaner and also rejects resource selectors reaching outside of its
+// namespace.
+type NamespacedCleanerCustomValidator struct {
+	CleanerCustomValidator
+}
+
+var _ webhook.CustomValidator = &NamespacedCleanerCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type NamespacedCleaner.
+func (v *NamespacedCleanerCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object,
+) (admission.Warnings, error) {
+	namespacedCleaner, ok := obj.(*cleanyv1alpha1.NamespacedCleaner)
+	if !ok {
+		return nil, fmt.Errorf("expected a NamespacedCleaner object but got %T", obj)
+	}
+	namespacedcleanerlog.V(1).Info("validate create", "name", namespacedCleaner.GetName())
+
+	return v.validateNamespacedCleaner(ctx, namespacedCleaner)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type NamespacedCleaner.
+func (v *NamespacedCleanerCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object,
+) (admission.Warnings, error) {
+	namespacedCleaner, ok := newObj.(*cleanyv1alpha1.NamespacedCleaner)
+	if !ok {
+		return nil, fmt.Errorf("expected a NamespacedCleaner object for the newObj but got %T", newObj)
+	}
+	namespacedcleanerlog.V(1).Info("validate update", "name", namespacedCleaner.GetName())
+
+	return v.validateNamespacedCleaner(ctx, namespacedCleaner)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type NamespacedCleaner.
+func (v *NamespacedCleanerCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object,
+) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateNamespacedCleaner returns an Invalid error listing every problem
+// found in namespacedCleaner.
+func (v *NamespacedCleanerCustomValidator) validateNamespacedCleaner(ctx context.Context,
+	namespacedCleaner *cleanyv1alpha1.NamespacedCleaner,
+) (admission.Warnings, error) {
+	var allErrs field.ErrorList
+	if namespacedCleaner.Spec.ServiceAccountRef != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "serviceAccountRef"),
+			"a NamespacedCleaner impersonates its serviceAccountName"))
+	}
+	selectorsPath := field.NewPath("spec", "resourcePolicySet", "resourceSelectors")
+	for i, selector := range namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors {
+		if selector.Namespace != "" && selector.Namespace != namespacedCleaner.Namespace {
+			allErrs = append(allErrs, field.Invalid(selectorsPath.Index(i).Child("namespace"), selector.Namespace,
+				"must be the NamespacedCleaner namespace"))
+		}
+		if selector.NamespaceSelector != "" {
+			allErrs = append(allErrs, field.Forbidden(selectorsPath.Index(i).Child("namespaceSelector"),
+				"resources can only be selected in the NamespacedCleaner namespace"))
+		}
+	}
+
+	warnings, errs := v.validate(ctx, namespacedCleaner.AsCleaner(), true)
+	allErrs = append(allErrs, errs...)
+	if len(allErrs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(cleanyv1alpha1.GroupVersion.WithKind("NamespacedCleaner").GroupKind(),
+		namespacedCleaner.Name, allErrs)
+}
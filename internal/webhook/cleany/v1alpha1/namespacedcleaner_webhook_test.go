@@ -0,0 +1,93 @@
+package v1alpha1
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	cleanyv1alpha1 "github.com/wys1203/Cleany/api/cleany/v1alpha1"
+)
+
+func newNamespacedCleaner() *cleanyv1alpha1.NamespacedCleaner {
+	cleaner := newCleaner()
+	return &cleanyv1alpha1.NamespacedCleaner{
+		ObjectMeta: cleaner.ObjectMeta,
+		Spec: cleanyv1alpha1.NamespacedCleanerSpec{
+			CleanerSpec:        cleaner.Spec,
+			ServiceAccountName: "cleaner",
+		},
+	}
+}
+
+func TestValidateNamespacedCleaner(t *testing.T) {
+	validator := &NamespacedCleanerCustomValidator{CleanerCustomValidator: *newValidator(t)}
+
+	namespacedCleaner := newNamespacedCleaner()
+	namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors[0].NamespaceSelector = ""
+	if _, err := validator.ValidateCreate(context.Background(), namespacedCleaner); err != nil {
+		t.Fatalf("expected valid namespaced cleaner, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(*cleanyv1alpha1.NamespacedCleaner)
+		fields []string
+	}{
+		{"namespace", func(c *cleanyv1alpha1.NamespacedCleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Namespace = "kube-system"
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].namespace"}},
+		{"namespace selector", func(c *cleanyv1alpha1.NamespacedCleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].NamespaceSelector = "env=dev"
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].namespaceSelector"}},
+		{"cluster scoped kind", func(c *cleanyv1alpha1.NamespacedCleaner) {
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].Kind = "Namespace"
+			c.Spec.ResourcePolicySet.ResourceSelectors[0].EvaluateCEL = ""
+		}, []string{"spec.resourcePolicySet.resourceSelectors[0].kind"}},
+		{"service account ref", func(c *cleanyv1alpha1.NamespacedCleaner) {
+			c.Spec.ServiceAccountRef = &cleanyv1alpha1.ServiceAccountRef{Namespace: "kube-system", Name: "admin"}
+		}, []string{"spec.serviceAccountRef"}},
+		{"cleaner spec", func(c *cleanyv1alpha1.NamespacedCleaner) { c.Spec.Schedule = "" },
+			[]string{"spec.schedule"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespacedCleaner := newNamespacedCleaner()
+			namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors[0].NamespaceSelector = ""
+			tt.mutate(namespacedCleaner)
+			_, err := validator.ValidateCreate(context.Background(), namespacedCleaner)
+			if !apierrors.IsInvalid(err) {
+				t.Fatalf("expected invalid error, got %v", err)
+			}
+			causes := err.(apierrors.APIStatus).Status().Details.Causes
+			if len(causes) != len(tt.fields) {
+				t.Fatalf("expected errors on %v, got %v", tt.fields, err)
+			}
+			for i, field := range tt.fields {
+				if causes[i].Field != field {
+					t.Errorf("expected error on %s, got %v", field, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultNamespacedCleaner(t *testing.T) {
+	defaulter := &NamespacedCleanerCustomDefaulter{
+		CleanerCustomDefaulter: CleanerCustomDefaulter{Discovery: newValidator(t).Discovery, RunTimeout: time.Minute},
+	}
+
+	namespacedCleaner := newNamespacedCleaner()
+	namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors[0].Version = ""
+	if err := defaulter.Default(context.Background(), namespacedCleaner); err != nil {
+		t.Fatal(err)
+	}
+	if namespacedCleaner.Spec.ResourcePolicySet.ResourceSelectors[0].Version != "v1" ||
+		namespacedCleaner.Spec.Timeout == nil || namespacedCleaner.Spec.ReportsHistoryLimit == nil {
+		t.Errorf("expected defaults to be set, got %+v", namespacedCleaner.Spec)
+	}
+	if namespacedCleaner.Spec.ResourcePolicySet.ExcludedNamespaces != nil {
+		t.Errorf("expected no excluded namespaces, got %v", namespacedCleaner.Spec.ResourcePolicySet.ExcludedNamespaces)
+	}
+}